@@ -0,0 +1,293 @@
+package mainer
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// argField is a struct field bound to one or more positional arguments.
+type argField struct {
+	index    int
+	variadic bool
+	flagField
+}
+
+// argFields returns the fields of the struct pointed to by v that are bound
+// to positional arguments via the "arg" struct tag, sorted by index. It
+// panics if the tags do not define a contiguous list of indices starting at
+// 0, or if a variadic field is not the last one or is not a slice.
+func argFields(v interface{}) []argField {
+	val := reflect.ValueOf(v).Elem()
+	strct := val.Type()
+
+	var fields []argField
+	for i := 0; i < val.NumField(); i++ {
+		fld := strct.Field(i)
+		tag, ok := fld.Tag.Lookup("arg")
+		if !ok {
+			continue
+		}
+
+		af := argField{flagField: flagField{field: fld, value: val.Field(i)}}
+		if strings.HasSuffix(tag, "...") {
+			tag = strings.TrimSuffix(tag, "...")
+			af.variadic = true
+			if af.value.Kind() != reflect.Slice {
+				panic(fmt.Sprintf("variadic arg set on non-slice field %s", fld.Name))
+			}
+		}
+		ix, err := strconv.Atoi(tag)
+		if err != nil || ix < 0 {
+			panic(fmt.Sprintf("invalid arg index on field %s: %s", fld.Name, tag))
+		}
+		af.index = ix
+		af.names = []string{strconv.Itoa(ix)}
+		fields = append(fields, af)
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].index < fields[j].index
+	})
+	for i, af := range fields {
+		if af.index != i {
+			panic(fmt.Sprintf("arg index %d of field %s is duplicated or leaves a gap", af.index, af.field.Name))
+		}
+		if af.variadic && i < len(fields)-1 {
+			panic(fmt.Sprintf("variadic arg of field %s must be the last one", af.field.Name))
+		}
+	}
+	return fields
+}
+
+// expandStdinArgs returns a copy of nonFlags where the first occurrence of
+// Parser.StdinArgsSentinel is replaced by the non-empty lines read from
+// Parser.Stdin (or os.Stdin). It returns nonFlags unchanged, without reading
+// anything, if the sentinel is not present.
+func (p *Parser) expandStdinArgs(nonFlags []string) ([]string, error) {
+	ix := -1
+	for i, arg := range nonFlags {
+		if arg == p.StdinArgsSentinel {
+			ix = i
+			break
+		}
+	}
+	if ix < 0 {
+		return nonFlags, nil
+	}
+
+	r := p.Stdin
+	if r == nil {
+		r = os.Stdin
+	}
+	var lines []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSuffix(sc.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, &ParseError{Kind: ErrInvalidValue, Err: fmt.Errorf("read args from stdin: %w", err)}
+	}
+
+	res := make([]string, 0, len(nonFlags)-1+len(lines))
+	res = append(res, nonFlags[:ix]...)
+	res = append(res, lines...)
+	return append(res, nonFlags[ix+1:]...), nil
+}
+
+// expandArgsFiles returns a copy of args where each @path argument after
+// the program name is replaced by the arguments read from that file, as
+// described by Parser.AllowArgsFiles. It returns args unchanged if there is
+// no such argument.
+func (p *Parser) expandArgsFiles(args []string) ([]string, error) {
+	if len(args) == 0 || !hasArgsFile(args[1:]) {
+		return args, nil
+	}
+	res := []string{args[0]}
+	return p.appendArgsFiles(res, args[1:], nil)
+}
+
+func (p *Parser) appendArgsFiles(res, args, including []string) ([]string, error) {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@@") {
+			res = append(res, arg[1:])
+			continue
+		}
+		name, ok := strings.CutPrefix(arg, "@")
+		if !ok {
+			res = append(res, arg)
+			continue
+		}
+
+		clean := filepath.Clean(name)
+		if sliceContains(including, clean) {
+			chain := strings.Join(append(including, clean), " -> ")
+			return nil, &ParseError{Kind: ErrInvalidValue, Err: fmt.Errorf("args file includes itself: %s", chain)}
+		}
+		b, err := p.readFile(name)
+		if err != nil {
+			return nil, &ParseError{Kind: ErrInvalidValue, Err: fmt.Errorf("read args file: %w", err)}
+		}
+		fileArgs, err := splitArgs(string(b))
+		if err != nil {
+			return nil, &ParseError{Kind: ErrInvalidValue, Err: fmt.Errorf("args file %s: %w", name, err)}
+		}
+		if res, err = p.appendArgsFiles(res, fileArgs, append(including[:len(including):len(including)], clean)); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func hasArgsFile(args []string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArgs splits s into arguments separated by white space, with support
+// for single and double quotes and backslash escapes as described by
+// Parser.AllowArgsFiles.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		sb      strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				// only \" and \\ are escapes in double quotes
+				sb.WriteRune('\\')
+			}
+			sb.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == quote {
+				quote = 0
+			} else {
+				sb.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case quote:
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				sb.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, sb.String())
+				sb.Reset()
+				inArg = false
+			}
+		default:
+			sb.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, sb.String())
+	}
+	return args, nil
+}
+
+// setArgValues stores the positional arguments in the fields of v bound to
+// them. Each non-variadic field is required, and it is an error to have more
+// arguments than fields, unless the last field is variadic. It does nothing
+// if no field is bound to positional arguments.
+func (p *Parser) setArgValues(args []string, v interface{}) error {
+	afs := argFields(v)
+	if len(afs) == 0 {
+		return nil
+	}
+
+	fields := make([]flagField, 0, len(afs))
+	for _, af := range afs {
+		fields = append(fields, af.flagField)
+	}
+
+	// the values are set via a distinct FlagSet so that they are converted
+	// the same way as flags, the variadic slice (if any) replaces its existing
+	// values.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerFlags(fs, fields, true, p.converters)
+
+	for i, af := range afs {
+		if af.variadic {
+			if i > len(args) {
+				i = len(args)
+			}
+			for _, arg := range args[i:] {
+				if err := setArgValue(fs, af, arg); err != nil {
+					return err
+				}
+			}
+			if i < len(args) {
+				p.debugf("argument %s set to %s", af.field.Name, debugValue(af.field, af.value))
+			}
+			return nil
+		}
+
+		if i >= len(args) {
+			return &ParseError{
+				Kind: ErrRequired,
+				Err:  errors.New("missing required argument: " + af.field.Name),
+			}
+		}
+		if err := setArgValue(fs, af, args[i]); err != nil {
+			return err
+		}
+		p.debugf("argument %s set to %s", af.field.Name, debugValue(af.field, af.value))
+	}
+
+	if len(args) > len(afs) {
+		return &ParseError{
+			Kind: ErrUnexpectedArg,
+			Err:  errors.New("unexpected argument: " + args[len(afs)]),
+		}
+	}
+	return nil
+}
+
+func setArgValue(fs *flag.FlagSet, af argField, arg string) error {
+	if err := fs.Lookup(af.names[0]).Value.Set(arg); err != nil {
+		return &ParseError{
+			Kind: ErrInvalidValue,
+			Err:  fmt.Errorf("invalid value %q for argument %s: %w", arg, af.field.Name, numError(err)),
+		}
+	}
+	return nil
+}
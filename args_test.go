@@ -0,0 +1,264 @@
+package mainer
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+)
+
+type Fargs struct {
+	V    bool          `flag:"v"`
+	Src  string        `arg:"0"`
+	N    int           `arg:"1"`
+	Dur  time.Duration `arg:"2"`
+	Rest []string      `arg:"3..."`
+
+	args []string
+}
+
+func (f *Fargs) SetArgs(args []string) {
+	f.args = args
+}
+
+func TestParseArgFields(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want *Fargs
+		kind ParseErrorKind
+		err  string
+	}{
+		{
+			args: []string{"a", "-v", "1", "2s"},
+			want: &Fargs{V: true, Src: "a", N: 1, Dur: 2 * time.Second, args: []string{"a", "1", "2s"}},
+		},
+		{
+			args: []string{"a", "1", "-v", "2s", "x", "--", "-y"},
+			want: &Fargs{V: true, Src: "a", N: 1, Dur: 2 * time.Second, Rest: []string{"x", "-y"}, args: []string{"a", "1", "2s", "x", "-y"}},
+		},
+		{
+			args: []string{"a", "1"},
+			kind: ErrRequired,
+			err:  "missing required argument: Dur",
+		},
+		{
+			kind: ErrRequired,
+			err:  "missing required argument: Src",
+		},
+		{
+			args: []string{"a", "x", "2s"},
+			kind: ErrInvalidValue,
+			err:  `invalid value "x" for argument N: parse error`,
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			f := Fargs{Rest: []string{"default"}}
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, tc.kind)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			if tc.want.Rest == nil {
+				tc.want.Rest = []string{"default"}
+			}
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(Fargs{})), tc.want)
+		})
+	}
+}
+
+func TestParseArgFieldsExtra(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Src string `arg:"0"`
+		Dst string `arg:"1"`
+	}
+
+	var p Parser
+	var f F
+	err := p.Parse([]string{"", "a", "b"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{Src: "a", Dst: "b"})
+
+	err = p.Parse([]string{"", "a", "b", "c"}, &f)
+	c.Assert(err, qt.ErrorMatches, `unexpected argument: c`)
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrUnexpectedArg)
+}
+
+func TestParseArgFieldsInvalid(t *testing.T) {
+	c := qt.New(t)
+
+	type Gap struct {
+		A string `arg:"0"`
+		B string `arg:"2"`
+	}
+	type Dup struct {
+		A string `arg:"0"`
+		B string `arg:"0"`
+	}
+	type Index struct {
+		A string `arg:"x"`
+	}
+	type NotLast struct {
+		A []string `arg:"0..."`
+		B string   `arg:"1"`
+	}
+	type NotSlice struct {
+		A string `arg:"0..."`
+	}
+
+	var p Parser
+	c.Assert(func() { _ = p.Parse([]string{""}, &Gap{}) }, qt.PanicMatches, `arg index 2 of field B is duplicated or leaves a gap`)
+	c.Assert(func() { _ = p.Parse([]string{""}, &Dup{}) }, qt.PanicMatches, `arg index 0 of field B is duplicated or leaves a gap`)
+	c.Assert(func() { _ = p.Parse([]string{""}, &Index{}) }, qt.PanicMatches, `invalid arg index on field A: x`)
+	c.Assert(func() { _ = p.Parse([]string{""}, &NotLast{}) }, qt.PanicMatches, `variadic arg of field A must be the last one`)
+	c.Assert(func() { _ = p.Parse([]string{""}, &NotSlice{}) }, qt.PanicMatches, `variadic arg set on non-slice field A`)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("boom")
+}
+
+func TestParseStdinArgs(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args  []string // args only, the 0-index is automatically added in test
+		stdin string
+		want  []string
+	}{
+		{args: []string{"a", "b"}, stdin: "x\ny\n", want: []string{"a", "b"}},
+		{args: []string{"a", "-", "b"}, stdin: "x\n\ny\r\nz", want: []string{"a", "x", "y", "z", "b"}},
+		{args: []string{"-v", "-", "-"}, stdin: "x\n", want: []string{"x", "-"}},
+		{args: []string{"--", "-"}, stdin: "-v\n", want: []string{"-v"}},
+		{args: []string{"-"}, stdin: "", want: []string{}},
+	}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			stdin := strings.NewReader(tc.stdin)
+			p := Parser{StdinArgsSentinel: "-", Stdin: stdin, Cache: NewParseCache(10)}
+			var f struct {
+				V bool `flag:"v"`
+			}
+			got, err := p.ParseArgs(append([]string{""}, tc.args...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.DeepEquals, tc.want)
+			if !sliceContains(tc.args, "-") {
+				// stdin is not consumed if the sentinel is not provided
+				c.Assert(stdin.Len(), qt.Equals, len(tc.stdin))
+			}
+		})
+	}
+
+	p := Parser{StdinArgsSentinel: "-", Stdin: failingReader{}}
+	var f struct{}
+	err := p.Parse([]string{"", "-"}, &f)
+	c.Assert(err, qt.ErrorMatches, `read args from stdin: boom`)
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+}
+
+func TestParseArgsFiles(t *testing.T) {
+	c := qt.New(t)
+
+	files := map[string]string{
+		"base.args":   "-v\n-s 'hello world'\n",
+		"nested.args": "@base.args x \"a \\\"b\\\" c:\\dir\" y\\ z\n",
+		"loop1.args":  "a @loop2.args",
+		"loop2.args":  "b @./loop1.args",
+		"self.args":   "@self.args",
+		"quote.args":  "'unterminated",
+		"empty.args":  "\n \t\n",
+	}
+	readFile := func(name string) ([]byte, error) {
+		if s, ok := files[name]; ok {
+			return []byte(s), nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	cases := []struct {
+		args  []string // args only, the 0-index is automatically added in test
+		wantS string
+		wantV bool
+		want  []string
+		err   string
+	}{
+		{args: []string{"a", "b"}, want: []string{"a", "b"}},
+		{args: []string{"@base.args", "a"}, wantS: "hello world", wantV: true, want: []string{"a"}},
+		{args: []string{"-s", "x", "@nested.args", "@empty.args", "@@lit"}, wantS: "hello world", wantV: true, want: []string{"x", `a "b" c:\dir`, "y z", "@lit"}},
+		{args: []string{"@loop1.args"}, err: `args file includes itself: loop1.args -> loop2.args -> loop1.args`},
+		{args: []string{"@self.args"}, err: `args file includes itself: self.args -> self.args`},
+		{args: []string{"@quote.args"}, err: `args file quote.args: unterminated ' quote`},
+		{args: []string{"@nope.args"}, err: `read args file: file does not exist`},
+	}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			p := Parser{AllowArgsFiles: true, ReadFile: readFile, Cache: NewParseCache(10)}
+			var f struct {
+				V bool   `flag:"v"`
+				S string `flag:"s"`
+			}
+			got, err := p.ParseArgs(append([]string{""}, tc.args...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.DeepEquals, tc.want)
+			c.Assert(f.S, qt.Equals, tc.wantS)
+			c.Assert(f.V, qt.Equals, tc.wantV)
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{"", nil, ""},
+		{"  a  b\n\tc ", []string{"a", "b", "c"}, ""},
+		{`'' ""`, []string{"", ""}, ""},
+		{`a'b c'd "e f"g`, []string{"ab cd", "e fg"}, ""},
+		{`'a\b' "a\b" a\b "\\\"" \'`, []string{`a\b`, `a\b`, "ab", `\"`, "'"}, ""},
+		{`"abc`, nil, `unterminated " quote`},
+		{`abc\`, nil, `trailing backslash`},
+	}
+	for _, tc := range cases {
+		c.Run(tc.in, func(c *qt.C) {
+			got, err := splitArgs(tc.in)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.DeepEquals, tc.want)
+		})
+	}
+}
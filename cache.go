@@ -0,0 +1,193 @@
+package mainer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ParseCache is a bounded, least-recently-used cache of parsed values, to be
+// set as Parser.Cache to avoid parsing the same args repeatedly. It is safe
+// for concurrent use.
+//
+// An entry is keyed by a hash of the type of the parsed value, the args and,
+// if used by the Parser, the environment variables and the path, size and
+// modification time of the config file, so that a change to any of those
+// bypasses the cached entry. Additionally, an entry is only used if the
+// initial value to parse into is the same (as reported by reflect.DeepEqual)
+// as the one of the cached parse. Only successful parses are cached.
+//
+// On a cache hit, a copy of the cached parsed value is stored into the value
+// to parse into, without calling any of its hooks (e.g. SetArgs, SetFlags or
+// Validate). Because unexported fields set by the hooks are copied too, this
+// is equivalent to a full parse unless the hooks have side effects outside of
+// the value. The exported slice fields are cloned, but other references
+// (maps, pointers and unexported slices) are shared with the cached value,
+// so they must not be modified.
+//
+// The cache must not be shared by Parsers with a different configuration, as
+// the configuration is not part of the key.
+type ParseCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+// NewParseCache returns a ParseCache that holds at most size entries. It
+// panics if size is not positive.
+func NewParseCache(size int) *ParseCache {
+	if size <= 0 {
+		panic(fmt.Sprintf("invalid parse cache size: %d", size))
+	}
+	return &ParseCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+type cacheEntry struct {
+	key      [sha256.Size]byte
+	initial  reflect.Value
+	parsed   reflect.Value
+	res      Result
+	nonFlags []string
+}
+
+// get stores the cached parsed value in v and returns true if there is an
+// entry for key with the same initial value as v.
+func (c *ParseCache) get(key [sha256.Size]byte, v interface{}) (Result, []string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return Result{}, nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	val := reflect.ValueOf(v).Elem()
+	if !reflect.DeepEqual(entry.initial.Interface(), val.Interface()) {
+		return Result{}, nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	val.Set(copyStruct(entry.parsed))
+	return entry.res, cloneStrings(entry.nonFlags), true
+}
+
+// add adds an entry for key, where initial is the value of v before parsing,
+// evicting the least recently used entry if the cache is full.
+func (c *ParseCache) add(key [sha256.Size]byte, initial reflect.Value, v interface{}, res Result, nonFlags []string) {
+	entry := &cacheEntry{
+		key:      key,
+		initial:  initial,
+		parsed:   copyStruct(reflect.ValueOf(v).Elem()),
+		res:      res,
+		nonFlags: cloneStrings(nonFlags),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey returns the key of the parse of args into v. It returns false if
+// the parse cannot be cached.
+func (p *Parser) cacheKey(args []string, v interface{}) ([sha256.Size]byte, bool) {
+	if p.StdinArgsSentinel != "" && len(args) > 0 && sliceContains(args[1:], p.StdinArgsSentinel) {
+		// the args read from stdin cannot be part of the key
+		return [sha256.Size]byte{}, false
+	}
+
+	if (p.AllowFileValues || p.AllowFDValues) && len(args) > 0 && mayReadFileValue(args[1:]) {
+		// the contents of the files cannot be part of the key
+		return [sha256.Size]byte{}, false
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00", reflect.TypeOf(v), len(args))
+	for _, arg := range args {
+		fmt.Fprintf(h, "%d:%s\x00", len(arg), arg)
+	}
+
+	if p.EnvVars {
+		environ := os.Environ()
+		sort.Strings(environ)
+		fmt.Fprintf(h, "env\x00%d\x00", len(environ))
+		for _, kv := range environ {
+			fmt.Fprintf(h, "%d:%s\x00", len(kv), kv)
+		}
+	}
+
+	path, err := p.configFilePath(args, v)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	if path != "" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return [sha256.Size]byte{}, false
+		}
+		fmt.Fprintf(h, "config\x00%s\x00%d\x00%d\x00", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key, true
+}
+
+// copyStruct returns a copy of the struct val, where the exported slice
+// fields are cloned.
+func copyStruct(val reflect.Value) reflect.Value {
+	cp := reflect.New(val.Type()).Elem()
+	cp.Set(val)
+	for i := 0; i < cp.NumField(); i++ {
+		fld := cp.Field(i)
+		if fld.Kind() != reflect.Slice || fld.IsNil() || !fld.CanSet() {
+			continue
+		}
+		clone := reflect.MakeSlice(fld.Type(), fld.Len(), fld.Len())
+		reflect.Copy(clone, fld)
+		fld.Set(clone)
+	}
+	return cp
+}
+
+func cloneStrings(sl []string) []string {
+	if sl == nil {
+		return nil
+	}
+	return append([]string(nil), sl...)
+}
+
+// mayReadFileValue returns true if any of args may be a value read from a
+// file or a file descriptor as supported by Parser.AllowFileValues and
+// Parser.AllowFDValues. It is conservative, as it cannot tell flags from
+// their values without parsing.
+func mayReadFileValue(args []string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") || strings.Contains(arg, "=@") ||
+			strings.HasPrefix(arg, "fd:") || strings.Contains(arg, "=fd:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package mainer
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+)
+
+type cachedF struct {
+	Addr string   `flag:"addr" env:"ADDR"`
+	Tags []string `flag:"tag"`
+	V    bool     `flag:"v"`
+
+	args  []string
+	calls int
+}
+
+func (f *cachedF) SetArgs(args []string) {
+	f.args = args
+	f.calls++
+}
+
+var equalsCachedF = qt.CmpEquals(cmp.AllowUnexported(cachedF{}))
+
+func TestParseCache(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_ADDR", ":80")
+
+	var debug bytes.Buffer
+	p := Parser{EnvVars: true, Cache: NewParseCache(2), Debug: &debug}
+	args := []string{"prog", "-tag", "a", "x", "-tag", "b"}
+
+	var f1 cachedF
+	res1, err := p.ParseResult(args, &f1)
+	c.Assert(err, qt.IsNil)
+	want := cachedF{Addr: ":80", Tags: []string{"a", "b"}, args: []string{"x"}, calls: 1}
+	c.Assert(f1, equalsCachedF, want)
+	c.Assert(debug.String(), qt.Not(qt.Contains), "parse cache hit")
+
+	// cache hit, the hook is not called again but the result is identical
+	debug.Reset()
+	var f2 cachedF
+	res2, err := p.ParseResult(args, &f2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f2, equalsCachedF, f1)
+	c.Assert(res2, qt.Equals, res1)
+	c.Assert(debug.String(), qt.Equals, "parse cache hit\n")
+
+	// the cached slices are not shared
+	f2.Tags[0] = "z"
+	var f3 cachedF
+	_, err = p.ParseResult(args, &f3)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f3, equalsCachedF, want)
+
+	// a different initial value bypasses the cache
+	debug.Reset()
+	f4 := cachedF{V: true}
+	err = p.Parse(args, &f4)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f4.V, qt.IsTrue)
+	c.Assert(debug.String(), qt.Not(qt.Contains), "parse cache hit")
+
+	// an env change bypasses the cache
+	c.Setenv("PROG_ADDR", ":81")
+	debug.Reset()
+	var f5 cachedF
+	err = p.Parse(args, &f5)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f5.Addr, qt.Equals, ":81")
+	c.Assert(f5.calls, qt.Equals, 1)
+	c.Assert(debug.String(), qt.Not(qt.Contains), "parse cache hit")
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		var f cachedF
+		err = p.Parse([]string{"prog", "-z"}, &f)
+		c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -z")
+	}
+}
+
+func TestParseCacheEviction(t *testing.T) {
+	c := qt.New(t)
+
+	cache := NewParseCache(2)
+	p := Parser{Cache: cache}
+	for _, arg := range []string{"a", "b", "a", "c"} {
+		var f cachedF
+		err := p.Parse([]string{"prog", arg}, &f)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(cache.lru.Len(), qt.Equals, 2)
+
+	// b was the least recently used and got evicted
+	for arg, hit := range map[string]bool{"a": true, "b": false, "c": true} {
+		key, ok := p.cacheKey([]string{"prog", arg}, &cachedF{})
+		c.Assert(ok, qt.IsTrue)
+		_, found := cache.entries[key]
+		c.Assert(found, qt.Equals, hit, qt.Commentf(arg))
+	}
+
+	c.Assert(func() { NewParseCache(0) }, qt.PanicMatches, `invalid parse cache size: 0`)
+}
+
+func BenchmarkParse(b *testing.B) {
+	args := []string{"prog", "-addr", ":80", "-tag", "a", "x", "-tag", "b", "-v"}
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		var p Parser
+		if cached {
+			name = "cached"
+			p.Cache = NewParseCache(10)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var f cachedF
+				if err := p.Parse(args, &f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package mainer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// WriteCompletion writes a completion script for the flags defined by v to
+// w, for the specified shell, which must be "bash" or "zsh". The progName is
+// the name of the command to complete (only its base name is used), and v
+// must be a pointer to a struct with the same requirements as for Parse.
+//
+// The script completes the names of all flags (with a single dash, as
+// displayed in the usage). For zsh, the usage description of the flags and
+// the placeholder of their value are displayed too. Positional arguments,
+// and the values of flags that are not boolean, are completed as file
+// names. The bash script must be sourced (e.g. in ~/.bashrc), while the zsh
+// script must be saved as a file named "_<progName>" in a directory of
+// $fpath.
+func (p *Parser) WriteCompletion(v interface{}, shell, progName string, w io.Writer) error {
+	progName = filepath.Base(progName)
+
+	var buf bytes.Buffer
+	switch shell {
+	case "bash":
+		writeBashCompletion(&buf, progName, p.FlagNames(v))
+	case "zsh":
+		writeZshCompletion(&buf, progName, p.FlagNames(v), argFields(v))
+	default:
+		return fmt.Errorf("unsupported completion shell: %s", shell)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func writeBashCompletion(buf *bytes.Buffer, progName string, infos []FlagInfo) {
+	var all, withValue []string
+	for _, fi := range infos {
+		for _, nm := range append([]string{fi.Name}, fi.Aliases...) {
+			all = append(all, "-"+nm)
+			if !fi.IsBool {
+				withValue = append(withValue, "-"+nm, "--"+nm)
+			}
+		}
+	}
+
+	fn := "_" + shellIdent(progName) + "_completion"
+	fmt.Fprintf(buf, "# bash completion for %s\n\n", progName)
+	fmt.Fprintf(buf, "%s() {\n", fn)
+	buf.WriteString("  local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	if len(withValue) > 0 {
+		buf.WriteString("  local prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+		buf.WriteString("  case \"$prev\" in\n")
+		fmt.Fprintf(buf, "    %s)\n", strings.Join(withValue, "|"))
+		buf.WriteString("      return 0\n")
+		buf.WriteString("      ;;\n")
+		buf.WriteString("  esac\n")
+	}
+	buf.WriteString("  if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(buf, "    COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(all, " "))
+	buf.WriteString("  fi\n")
+	buf.WriteString("}\n\n")
+	fmt.Fprintf(buf, "complete -o default -F %s %s\n", fn, progName)
+}
+
+func writeZshCompletion(buf *bytes.Buffer, progName string, infos []FlagInfo, args []argField) {
+	fmt.Fprintf(buf, "#compdef %s\n\n", progName)
+	buf.WriteString("_arguments \\\n")
+
+	for _, fi := range infos {
+		names := append([]string{"-" + fi.Name}, prefixAll("-", fi.Aliases)...)
+
+		// slices and counters can be repeated, otherwise the names of a flag
+		// are mutually exclusive.
+		var excl string
+		switch {
+		case fi.Kind == reflect.Slice || (fi.IsBool && isIntKind(fi.Kind)):
+			excl = "*"
+		case len(names) > 1:
+			excl = "(" + strings.Join(names, " ") + ")"
+		}
+		nameSpec := names[0]
+		if len(names) > 1 {
+			// brace expansion generates a spec for each name
+			nameSpec = "{" + strings.Join(names, ",") + "}"
+		}
+
+		desc := strings.ReplaceAll(fi.Usage, "\n", " ")
+		rest := "[" + zshEscape(desc, "[]") + "]"
+		if !fi.IsBool {
+			placeholder := fi.Placeholder
+			if placeholder == "" {
+				placeholder = "value"
+			}
+			rest += ":" + zshEscape(placeholder, ":") + ":_files"
+		}
+		fmt.Fprintf(buf, "  %s%s%s \\\n", zshQuote(excl), nameSpec, zshQuote(rest))
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintf(buf, "  %s\n", zshQuote("*:argument:_files"))
+		return
+	}
+	for i, af := range args {
+		pos := fmt.Sprint(i + 1)
+		if af.variadic {
+			pos = "*"
+		}
+		sep := " \\"
+		if i == len(args)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(buf, "  %s%s\n", zshQuote(pos+":"+zshEscape(af.field.Name, ":")+":_files"), sep)
+	}
+}
+
+// shellIdent returns s with any character that is not valid in a shell
+// function name replaced with an underscore.
+func shellIdent(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// zshEscape escapes the characters chars (and backslashes) in s with a
+// backslash.
+func zshEscape(s, chars string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(chars, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// zshQuote returns s as a single-quoted shell word, or an empty string if s
+// is empty.
+func zshQuote(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func prefixAll(prefix string, sl []string) []string {
+	out := make([]string, 0, len(sl))
+	for _, s := range sl {
+		out = append(out, prefix+s)
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package mainer
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type Fcomp struct {
+	Help    bool     `flag:"h,help" usage:"show [help]"`
+	Verbose int      `flag:"v,count"`
+	Addr    string   "flag:\"addr\" usage:\"listen on `host:port`\""
+	Tags    []string `flag:"tag,t" usage:"it's a tag"`
+	Src     string   `arg:"0"`
+	Rest    []string `arg:"1..."`
+}
+
+func TestWriteCompletion(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		shell string
+		v     interface{}
+		want  string
+		err   string
+	}{
+		{
+			shell: "bash",
+			v:     &Fcomp{},
+			want: `# bash completion for my-prog
+
+_my_prog_completion() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  local prev="${COMP_WORDS[COMP_CWORD-1]}"
+  case "$prev" in
+    -addr|--addr|-tag|--tag|-t|--t)
+      return 0
+      ;;
+  esac
+  if [[ "$cur" == -* ]]; then
+    COMPREPLY=($(compgen -W "-h -help -v -addr -tag -t" -- "$cur"))
+  fi
+}
+
+complete -o default -F _my_prog_completion my-prog
+`,
+		},
+		{
+			shell: "bash",
+			v:     &struct{}{},
+			want: `# bash completion for my-prog
+
+_my_prog_completion() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  if [[ "$cur" == -* ]]; then
+    COMPREPLY=($(compgen -W "" -- "$cur"))
+  fi
+}
+
+complete -o default -F _my_prog_completion my-prog
+`,
+		},
+		{
+			shell: "zsh",
+			v:     &Fcomp{},
+			want: `#compdef my-prog
+
+_arguments \
+  '(-h -help)'{-h,-help}'[show \[help\]]' \
+  '*'-v'[]' \
+  -addr'[listen on host:port]:host\:port:_files' \
+  '*'{-tag,-t}'[it'\''s a tag]:string:_files' \
+  '1:Src:_files' \
+  '*:Rest:_files'
+`,
+		},
+		{
+			shell: "zsh",
+			v:     &struct{}{},
+			want: `#compdef my-prog
+
+_arguments \
+  '*:argument:_files'
+`,
+		},
+		{
+			shell: "fish",
+			v:     &Fcomp{},
+			err:   `unsupported completion shell: fish`,
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(tc.shell, func(c *qt.C) {
+			var buf bytes.Buffer
+			err := p.WriteCompletion(tc.v, tc.shell, "/usr/bin/my-prog", &buf)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				c.Assert(buf.Len(), qt.Equals, 0)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(buf.String(), qt.Equals, tc.want)
+
+			if tc.shell != "bash" {
+				return
+			}
+			if _, err := exec.LookPath("bash"); err != nil {
+				c.Skip("bash not available")
+			}
+			cmd := exec.Command("bash", "-n")
+			cmd.Stdin = strings.NewReader(buf.String())
+			out, err := cmd.CombinedOutput()
+			c.Assert(err, qt.IsNil, qt.Commentf("%s", out))
+		})
+	}
+}
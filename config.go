@@ -0,0 +1,261 @@
+package mainer
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigDecoder defines the method required to decode a config file. The
+// Decode method is called with a pointer to a map[string]interface{} as v,
+// and the decoded map's keys must be the canonical flag names. Scalar values
+// are converted to their string representation and set the same way as
+// command-line values, and a []interface{} value may be used for slice
+// fields.
+type ConfigDecoder interface {
+	Decode(r io.Reader, v interface{}) error
+}
+
+// jsonDecoder is the default ConfigDecoder. It decodes a JSON object,
+// keeping numbers in their textual representation so that they are
+// converted by the flag's value the same way as a command-line value.
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// configFilePath returns the path of the config file to read, as described
+// by Parser.ConfigFlag, or an empty string if there is none. It returns an
+// error if the path set by the flag cannot be resolved, as described by
+// Parser.AllowFileValues and Parser.AllowFDValues.
+func (p *Parser) configFilePath(args []string, v interface{}) (string, error) {
+	if p.ConfigFlag == "" {
+		return p.ConfigFile, nil
+	}
+
+	// the flag takes precedence, it is resolved on a fresh value so that v is
+	// not altered (errors are reported by the actual parsing).
+	dry := *p
+	dry.CollectAllErrors = true
+	dry.AllowFileValues, dry.AllowFDValues = false, false
+	tmp := reflect.New(reflect.TypeOf(v).Elem())
+	tmp.Elem().Set(freshStruct(reflect.ValueOf(v).Elem()))
+	if scan, _ := dry.scanFlags(args, tmp.Interface()); scan != nil && scan.flagSet[p.ConfigFlag] {
+		path := p.configFlagField(tmp.Interface()).value.String()
+		resolved, err := p.fileValueResolver().resolve(path)
+		if err != nil {
+			return "", &ParseError{
+				Kind: ErrInvalidValue,
+				Flag: p.ConfigFlag,
+				Err:  fmt.Errorf("invalid value %q for flag -%s: %w", path, p.ConfigFlag, err),
+			}
+		}
+		return resolved, nil
+	}
+
+	if p.EnvVars {
+		ff := p.configFlagField(v)
+		prefix := p.envPrefix(args) + ff.envPrefix
+		for _, name := range envVarNames(prefix, ff.field) {
+			if s, ok := p.lookupEnv(name); ok {
+				if s != "" {
+					return s, nil
+				}
+				break
+			}
+		}
+	}
+	return p.ConfigFile, nil
+}
+
+// configFlagField returns the flag field of v named by Parser.ConfigFlag.
+// It panics if there is no such field or if it is not a string.
+func (p *Parser) configFlagField(v interface{}) flagField {
+	for _, ff := range p.flagFields(v) {
+		if ff.names[0] != p.ConfigFlag {
+			continue
+		}
+		if ff.value.Kind() != reflect.String {
+			panic(fmt.Sprintf("config flag %s set on non-string field %s", p.ConfigFlag, ff.field.Name))
+		}
+		return ff
+	}
+	panic(fmt.Sprintf("undefined config flag %s", p.ConfigFlag))
+}
+
+// parseConfigFile reads the config file at path and stores its values in
+// the matching flag fields of v. It returns the set of canonical flag names
+// that were set by the config file.
+func (p *Parser) parseConfigFile(path string, v interface{}) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &ParseError{Kind: ErrConfig, Err: err}
+	}
+	defer f.Close()
+
+	dec := p.ConfigDecoder
+	if dec == nil {
+		dec = jsonDecoder{}
+	}
+
+	var values map[string]interface{}
+	if err := dec.Decode(f, &values); err != nil {
+		return nil, &ParseError{Kind: ErrConfig, Err: fmt.Errorf("invalid config file %s: %w", path, err)}
+	}
+	return p.setConfigValues(values, v)
+}
+
+// setConfigValues stores the values in the matching flag fields of v, where
+// the key of values is the canonical flag name. The values are converted to
+// strings and set the same way as command-line flags (via a distinct
+// FlagSet, so that they are not reported as set by args).
+func (p *Parser) setConfigValues(values map[string]interface{}, v interface{}) (map[string]bool, error) {
+	fields := p.flagFields(v)
+	byName := make(map[string]flagField, len(fields))
+	for _, ff := range fields {
+		byName[ff.names[0]] = ff
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerFlags(fs, fields, p.OverwriteSlices, p.converters)
+
+	// process the keys in a deterministic order so that the reported error is
+	// stable.
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var configSet map[string]bool
+	for _, key := range keys {
+		ff, ok := byName[key]
+		if !ok {
+			if p.IgnoreUnknownConfigKeys {
+				continue
+			}
+			return nil, &ParseError{
+				Kind: ErrUnknownFlag,
+				Flag: key,
+				Err:  errors.New("config key provided but not defined: " + key),
+			}
+		}
+
+		val := values[key]
+		if val == nil {
+			continue
+		}
+		if err := setConfigValue(fs.Lookup(key), ff, val); err != nil {
+			return nil, &ParseError{
+				Kind: ErrInvalidValue,
+				Flag: key,
+				Err:  fmt.Errorf("invalid value %v for config key %s: %w", val, key, err),
+			}
+		}
+		p.debugf("config %s overrode to %s", key, debugValue(ff.field, ff.value))
+		if configSet == nil {
+			configSet = make(map[string]bool)
+		}
+		configSet[key] = true
+	}
+	return configSet, nil
+}
+
+func setConfigValue(fl *flag.Flag, ff flagField, val interface{}) error {
+	if ff.count {
+		// the count flag increments on each Set, set the number directly
+		s, err := configValueString(val)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return numError(err)
+		}
+
+		prev := reflect.New(ff.value.Type()).Elem()
+		prev.Set(ff.value)
+		if isUintKind(ff.value.Kind()) {
+			if n < 0 || ff.value.OverflowUint(uint64(n)) {
+				return errRange
+			}
+			ff.value.SetUint(uint64(n))
+		} else {
+			if ff.value.OverflowInt(n) {
+				return errRange
+			}
+			ff.value.SetInt(n)
+		}
+
+		// the range is checked as for a value set by the command-line
+		if lo, hi := fieldRange(ff); lo != "" || hi != "" {
+			if err := checkRange(ff.field.Name, ff.value, lo, hi); err != nil {
+				ff.value.Set(prev)
+				return err
+			}
+		}
+		return nil
+	}
+
+	list, ok := val.([]interface{})
+	if !ok {
+		s, err := configValueString(val)
+		if err != nil {
+			return err
+		}
+		return fl.Value.Set(s)
+	}
+
+	_, isValue := flagValue(ff.value)
+	if _, isText := textUnmarshaler(ff.value); isValue || isText || ff.value.Kind() != reflect.Slice {
+		return errors.New("unexpected list")
+	}
+
+	strs := make([]string, 0, len(list))
+	for _, elem := range list {
+		s, err := configValueString(elem)
+		if err != nil {
+			return err
+		}
+		strs = append(strs, s)
+	}
+	if sep, ok := ff.field.Tag.Lookup("flagSeparator"); ok {
+		return fl.Value.Set(strings.Join(strs, sep))
+	}
+	for _, s := range strs {
+		if err := fl.Value.Set(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configValueString returns the string representation of a scalar value
+// decoded from a config file.
+func configValueString(val interface{}) (string, error) {
+	switch val := val.(type) {
+	case string:
+		return val, nil
+	case json.Number:
+		return val.String(), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64), nil
+	case []interface{}, map[string]interface{}:
+		return "", fmt.Errorf("unsupported value type %T", val)
+	default:
+		return fmt.Sprint(val), nil
+	}
+}
@@ -0,0 +1,287 @@
+package mainer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type Cfg struct {
+	Addr    string        `flag:"addr,a" env:"ADDR"`
+	Timeout time.Duration `flag:"timeout"`
+	Port    int           `flag:"port"`
+	Debug   bool          `flag:"debug"`
+	Tags    []string      `flag:"tag"`
+	IDs     []int         `flag:"ids" flagSeparator:","`
+	Verbose int           `flag:"v,count"`
+
+	sources map[string]FlagSource
+}
+
+func (c *Cfg) SetFlagSources(sources map[string]FlagSource) {
+	c.sources = sources
+}
+
+func writeConfigFile(c *qt.C, content string) string {
+	file := filepath.Join(c.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(content), 0600)
+	c.Assert(err, qt.IsNil)
+	return file
+}
+
+func TestParseConfigFile(t *testing.T) {
+	c := qt.New(t)
+
+	file := writeConfigFile(c, `{
+		"addr": ":80",
+		"timeout": "10s",
+		"port": 8080,
+		"debug": true,
+		"tag": ["a", "b"],
+		"ids": [1, 2, 3],
+		"v": 2
+	}`)
+
+	p := Parser{ConfigFile: file}
+	var cfg Cfg
+	err := p.Parse([]string{"prog"}, &cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Addr, qt.Equals, ":80")
+	c.Assert(cfg.Timeout, qt.Equals, 10*time.Second)
+	c.Assert(cfg.Port, qt.Equals, 8080)
+	c.Assert(cfg.Debug, qt.IsTrue)
+	c.Assert(cfg.Tags, qt.DeepEquals, []string{"a", "b"})
+	c.Assert(cfg.IDs, qt.DeepEquals, []int{1, 2, 3})
+	c.Assert(cfg.Verbose, qt.Equals, 2)
+	c.Assert(cfg.sources["addr"], qt.Equals, SourceConfig)
+	c.Assert(cfg.sources["port"], qt.Equals, SourceConfig)
+
+	// env vars and flags take precedence
+	c.Setenv("PROG_ADDR", ":81")
+	p.EnvVars = true
+	cfg = Cfg{}
+	err = p.Parse([]string{"prog", "-port", "9000"}, &cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Addr, qt.Equals, ":81")
+	c.Assert(cfg.Port, qt.Equals, 9000)
+	c.Assert(cfg.Timeout, qt.Equals, 10*time.Second)
+	c.Assert(cfg.sources["addr"], qt.Equals, SourceEnv)
+	c.Assert(cfg.sources["port"], qt.Equals, SourceFlag)
+	c.Assert(cfg.sources["timeout"], qt.Equals, SourceConfig)
+
+	// slices are merged per the OverwriteSlices policy
+	cfg = Cfg{Tags: []string{"z"}}
+	err = p.Parse([]string{"prog", "-tag", "c"}, &cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Tags, qt.DeepEquals, []string{"z", "a", "b", "c"})
+
+	p.OverwriteSlices = true
+	cfg = Cfg{Tags: []string{"z"}}
+	err = p.Parse([]string{"prog", "-tag", "c"}, &cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Tags, qt.DeepEquals, []string{"c"})
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		desc    string
+		content string
+		ignore  bool
+		kind    ParseErrorKind
+		err     string
+	}{
+		{"unknown key", `{"nope": 1}`, false, ErrUnknownFlag, `config key provided but not defined: nope`},
+		{"alias key", `{"a": ":80"}`, false, ErrUnknownFlag, `config key provided but not defined: a`},
+		{"invalid value", `{"port": "x"}`, false, ErrInvalidValue, `invalid value x for config key port: .+`},
+		{"invalid list", `{"port": [1]}`, false, ErrInvalidValue, `invalid value \[1\] for config key port: unexpected list`},
+		{"invalid object", `{"addr": {}}`, false, ErrInvalidValue, `invalid value map\[\] for config key addr: unsupported value type .+`},
+		{"invalid json", `{`, false, ErrConfig, `invalid config file .+`},
+		{"ignore unknown", `{"nope": 1, "port": 1}`, true, 0, ``},
+		{"null value", `{"port": null}`, false, 0, ``},
+	}
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			p := Parser{ConfigFile: writeConfigFile(c, tc.content), IgnoreUnknownConfigKeys: tc.ignore}
+			var cfg Cfg
+			err := p.Parse([]string{"prog"}, &cfg)
+			if tc.err == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tc.err)
+			var pe *ParseError
+			c.Assert(errors.As(err, &pe), qt.IsTrue)
+			c.Assert(pe.Kind, qt.Equals, tc.kind)
+		})
+	}
+
+	// missing file
+	p := Parser{ConfigFile: filepath.Join(c.TempDir(), "missing.json")}
+	var cfg Cfg
+	err := p.Parse([]string{"prog"}, &cfg)
+	c.Assert(errors.Is(err, os.ErrNotExist), qt.IsTrue)
+}
+
+func TestParseConfigFileCountRange(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		V int8  `flag:"v,count"`
+		U uint8 `flag:"u,count"`
+		L int   `flag:"l,count" max:"3"`
+	}
+
+	cases := []struct {
+		content string
+		args    []string
+		want    F
+		err     string
+	}{
+		{`{"v": 2, "u": 3, "l": 1}`, []string{"-v", "-l"}, F{V: 3, U: 3, L: 2}, ``},
+		{`{"v": 127}`, nil, F{V: 127}, ``},
+		{`{"v": 300}`, nil, F{}, `invalid value 300 for config key v: value out of range`},
+		{`{"v": -129}`, nil, F{}, `invalid value -129 for config key v: value out of range`},
+		{`{"u": 256}`, nil, F{}, `invalid value 256 for config key u: value out of range`},
+		{`{"u": -1}`, nil, F{}, `invalid value -1 for config key u: value out of range`},
+		{`{"l": 4}`, nil, F{}, `invalid value 4 for config key l: value out of range: must be .+`},
+		{`{"l": 3}`, []string{"-l"}, F{}, `invalid boolean flag l: value out of range: must be at most 3`},
+	}
+	for _, tc := range cases {
+		c.Run(tc.content+strings.Join(tc.args, " "), func(c *qt.C) {
+			p := Parser{ConfigFile: writeConfigFile(c, tc.content)}
+			var f F
+			err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.Equals, tc.want)
+		})
+	}
+}
+
+func TestParseConfigFlag(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Config string `flag:"config,c" env:"CONFIG"`
+		Addr   string `flag:"addr" env:"ADDR"`
+		Port   int    `flag:"port"`
+	}
+
+	dir := c.TempDir()
+	writeFile := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(file, []byte(content), 0600), qt.IsNil)
+		return file
+	}
+	defaultFile := writeFile("default.json", `{"addr": "default", "port": 1}`)
+	envFile := writeFile("env.json", `{"addr": "env", "port": 2}`)
+	flagFile := writeFile("flag.json", `{"addr": "flag", "port": 3}`)
+
+	cases := []struct {
+		desc       string
+		configFile string
+		env        map[string]string // with the PROG_ prefix added automatically
+		args       []string
+		want       F
+	}{
+		{"default", defaultFile, nil, nil, F{Addr: "default", Port: 1}},
+		{"no default", "", nil, nil, F{}},
+		{"env overrides default", defaultFile, map[string]string{"CONFIG": envFile}, nil, F{Config: envFile, Addr: "env", Port: 2}},
+		{"empty env", defaultFile, map[string]string{"CONFIG": ""}, nil, F{Addr: "default", Port: 1}},
+		{"env without default", "", map[string]string{"CONFIG": envFile}, nil, F{Config: envFile, Addr: "env", Port: 2}},
+		{"flag overrides env", defaultFile, map[string]string{"CONFIG": envFile}, []string{"-c", flagFile}, F{Config: flagFile, Addr: "flag", Port: 3}},
+		{"flag overrides default", defaultFile, nil, []string{"-config=" + flagFile, "-port", "4"}, F{Config: flagFile, Addr: "flag", Port: 4}},
+		{"env values still apply", defaultFile, map[string]string{"CONFIG": envFile, "ADDR": "x"}, nil, F{Config: envFile, Addr: "x", Port: 2}},
+	}
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			p := Parser{EnvVars: true, ConfigFile: tc.configFile, ConfigFlag: "config", Cache: NewParseCache(10)}
+			for i := 0; i < 2; i++ { // second parse is a cache hit
+				var f F
+				err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+				c.Assert(err, qt.IsNil)
+				c.Assert(f, qt.Equals, tc.want)
+			}
+		})
+	}
+
+	c.Run("env ignored without EnvVars", func(c *qt.C) {
+		c.Setenv("PROG_CONFIG", envFile)
+		p := Parser{ConfigFile: defaultFile, ConfigFlag: "config"}
+		var f F
+		err := p.Parse([]string{"prog"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f, qt.Equals, F{Addr: "default", Port: 1})
+	})
+
+	c.Run("missing file", func(c *qt.C) {
+		p := Parser{ConfigFlag: "config"}
+		var f F
+		err := p.Parse([]string{"prog", "-config", filepath.Join(dir, "missing.json")}, &f)
+		c.Assert(errors.Is(err, os.ErrNotExist), qt.IsTrue)
+	})
+
+	c.Run("fd value", func(c *qt.C) {
+		var opened int
+		openFD := func(fd int) (io.ReadCloser, error) {
+			if fd != 3 {
+				return nil, errors.New("bad file descriptor")
+			}
+			opened++
+			return io.NopCloser(strings.NewReader(flagFile + "\n")), nil
+		}
+		p := Parser{ConfigFile: defaultFile, ConfigFlag: "config", AllowFDValues: true, OpenFD: openFD}
+		var f F
+		err := p.Parse([]string{"prog", "-config", "fd:3"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f, qt.Equals, F{Config: flagFile, Addr: "flag", Port: 3})
+		c.Assert(opened, qt.Equals, 1)
+
+		f = F{}
+		err = p.Parse([]string{"prog", "-config", "fd:4"}, &f)
+		c.Assert(err, qt.ErrorMatches, `invalid value "fd:4" for flag -config: open file descriptor 4: bad file descriptor`)
+		var pe *ParseError
+		c.Assert(errors.As(err, &pe), qt.IsTrue)
+		c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+
+		// the escaped value is a literal path
+		f = F{}
+		err = p.Parse([]string{"prog", "-config", "fd::3"}, &f)
+		c.Assert(errors.Is(err, os.ErrNotExist), qt.IsTrue)
+		c.Assert(err, qt.ErrorMatches, `open fd:3: .+`)
+	})
+
+	c.Run("file value", func(c *qt.C) {
+		pathFile := writeFile("path.txt", envFile)
+		p := Parser{ConfigFile: defaultFile, ConfigFlag: "config", AllowFileValues: true}
+		var f F
+		err := p.Parse([]string{"prog", "-config", "@" + pathFile}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f, qt.Equals, F{Config: envFile, Addr: "env", Port: 2})
+	})
+
+	c.Run("invalid definition", func(c *qt.C) {
+		p := Parser{ConfigFlag: "nope"}
+		c.Assert(p.ValidateDefinition(&F{}), qt.ErrorMatches, `undefined config flag nope`)
+		p.ConfigFlag = "port"
+		c.Assert(p.ValidateDefinition(&F{}), qt.ErrorMatches, `config flag port set on non-string field Port`)
+		c.Assert(func() { _ = p.Parse([]string{"prog"}, &F{}) }, qt.PanicMatches, `config flag port set on non-string field Port`)
+	})
+}
@@ -0,0 +1,54 @@
+package mainer
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// debugf writes the formatted message as a line to Parser.Debug, if it is
+// set.
+func (p *Parser) debugf(format string, args ...interface{}) {
+	if p.Debug == nil {
+		return
+	}
+	fmt.Fprintf(p.Debug, format+"\n", args...)
+}
+
+// debugDefaults writes the initial value of each flag field of v to
+// Parser.Debug, if it is set.
+func (p *Parser) debugDefaults(v interface{}) {
+	if p.Debug == nil {
+		return
+	}
+	for _, ff := range p.flagFields(v) {
+		p.debugf("applied default -%s=%s", ff.names[0], debugValue(ff.field, ff.value))
+	}
+}
+
+// debugValidation writes the outcome of the validation step to
+// Parser.Debug, if it is set, and returns err.
+func (p *Parser) debugValidation(err error) error {
+	if err != nil {
+		p.debugf("validation failed: %v", err)
+	} else {
+		p.debugf("validation passed")
+	}
+	return err
+}
+
+// debugValue returns the representation of the value val of the field fld
+// in the debug trace, masked if the field is sensitive.
+func debugValue(fld reflect.StructField, val reflect.Value) string {
+	if isSensitive(fld) {
+		return redactedValue
+	}
+	if t, ok := textMarshalerUnmarshaler(val); ok {
+		if b, err := t.MarshalText(); err == nil {
+			return fmt.Sprintf("%q", b)
+		}
+	}
+	if val.Kind() == reflect.String {
+		return fmt.Sprintf("%q", val.String())
+	}
+	return fmt.Sprint(val.Interface())
+}
@@ -0,0 +1,89 @@
+package mainer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type debugF struct {
+	X    int    `flag:"x" env:"X"`
+	Name string `flag:"name" env:"NAME" envDefault:"anon"`
+	Src  string `arg:"0"`
+}
+
+func (f *debugF) Validate() error {
+	if f.X > 10 {
+		return errors.New("x is too big")
+	}
+	return nil
+}
+
+func TestParseDebug(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_X", "2")
+
+	var buf bytes.Buffer
+	p := Parser{
+		EnvVars:    true,
+		ConfigFile: writeConfigFile(c, `{"x": 5}`),
+		Debug:      &buf,
+	}
+	f := debugF{X: 1}
+	err := p.Parse([]string{"prog", "-x", "3", "a"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, debugF{X: 3, Name: "anon", Src: "a"})
+	c.Assert(buf.String(), qt.Equals, `applied default -x=1
+applied default -name=""
+config x overrode to 5
+env PROG_X overrode to "2"
+applied env default PROG_NAME="anon"
+flag -x overrode to 3
+argument Src set to "a"
+validation passed
+`)
+
+	buf.Reset()
+	f = debugF{}
+	err = p.Parse([]string{"prog", "-x", "11", "a"}, &f)
+	c.Assert(err, qt.ErrorMatches, `x is too big`)
+	c.Assert(buf.String(), qt.Matches, `(?s).*\nflag -x overrode to 11\n.*validation failed: x is too big\n`)
+}
+
+func TestParseDebugSensitive(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Token  string `flag:"token" env:"TOKEN" sensitive:"true"`
+		Key    string `flag:"key" env:"KEY" envDefault:"k" secret:"true"`
+		Pass   string `arg:"0" sensitive:"true"`
+		Public string `flag:"public"`
+	}
+
+	c.Setenv("PROG_TOKEN", "env-token")
+
+	var buf bytes.Buffer
+	p := Parser{
+		EnvVars:    true,
+		ConfigFile: writeConfigFile(c, `{"token": "config-token"}`),
+		Debug:      &buf,
+	}
+	f := F{Token: "init"}
+	err := p.Parse([]string{"prog", "-token", "flag-token", "-public", "p", "pass"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{Token: "flag-token", Key: "k", Pass: "pass", Public: "p"})
+	c.Assert(buf.String(), qt.Equals, `applied default -token=****
+applied default -key=****
+applied default -public=""
+config token overrode to ****
+env PROG_TOKEN overrode to "****"
+applied env default PROG_KEY="****"
+flag -token overrode to ****
+flag -public overrode to "p"
+argument Pass set to ****
+validation passed
+`)
+}
@@ -0,0 +1,124 @@
+package mainer
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// ValidateDefinition checks the struct tags of the struct pointed to by v
+// for definition errors, i.e. mistakes of the developer rather than of the
+// user, such as:
+//   - a flag defined on a field of an unsupported type, or defined twice
+//   - a "count" option on a non-integer field
+//   - a flagSeparator struct tag on a flag field that is not a slice
+//   - a "requires" option that refers to an undefined flag
+//   - invalid "arg" struct tags
+//   - a Parser.ConfigFlag that is not defined on a string field
+//   - an "envindexed" struct tag on a field that is not a slice
+//   - an "envsep" struct tag on a field that is not a []string, or with a
+//     value other than "none"
+//   - an "envfallback" struct tag on a field without an "env" struct tag
+//   - a min, max or oneof "validate" rule that does not apply to the type of
+//     the field (e.g. min on a bool), or that has an invalid value
+//
+// Other "validate" rules are ignored, as they may be supported by the
+// Parser.Validator. It returns all errors found, joined with errors.Join if
+// there are many, or nil if the definition is valid. Parse calls it first
+// and panics with the message of the error, so that mistakes are caught
+// early regardless of the args; ValidateDefinition can be used in tests to
+// report all errors at once instead. It panics if v is not a pointer to a
+// struct.
+func (p *Parser) ValidateDefinition(v interface{}) error {
+	val := reflect.ValueOf(v).Elem()
+	strct := val.Type()
+	_ = strct.NumField() // panic early if v is not a pointer to a struct
+
+	var errs []error
+	errs = appendErrors(errs, p.validateFlagsDefinition(v))
+	errs = appendErrors(errs, definitionError(func() { argFields(v) }))
+	if p.ConfigFlag != "" {
+		errs = appendErrors(errs, definitionError(func() { p.configFlagField(v) }))
+	}
+
+	for i := 0; i < strct.NumField(); i++ {
+		fld := strct.Field(i)
+		if fld.Tag.Get("envindexed") == "true" && fld.Type.Kind() != reflect.Slice {
+			errs = append(errs, fmt.Errorf("envindexed set on non-slice field %s", fld.Name))
+		}
+		errs = appendErrors(errs, definitionError(func() { isUnsplitEnvField(fld) }))
+		errs = appendErrors(errs, definitionError(func() { envVarNames("", fld) }))
+		if tag, ok := fld.Tag.Lookup("validate"); ok {
+			for _, rule := range strings.Split(tag, ",") {
+				errs = appendErrors(errs, validateRuleDefinition(fld.Name, val.Field(i), rule))
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+// validateFlagsDefinition returns the definition errors of the flag fields
+// of v.
+func (p *Parser) validateFlagsDefinition(v interface{}) error {
+	var fields []flagField
+	if err := definitionError(func() { fields = p.flagFields(v) }); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	names := make(map[string]bool)
+	var errs []error
+	for _, ff := range fields {
+		errs = appendErrors(errs, definitionError(func() {
+			registerFlags(fs, []flagField{ff}, false, p.converters)
+		}))
+		for _, nm := range ff.names {
+			names[nm] = true
+		}
+	}
+
+	for _, ff := range fields {
+		for _, req := range ff.requires {
+			if !names[req] {
+				errs = append(errs, fmt.Errorf("undefined flag %s required by field %s", req, ff.field.Name))
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+// validateRuleDefinition returns an error if the validation rule does not
+// apply to the type of val, or has an invalid value. Only the min, max and
+// oneof rules are checked.
+func validateRuleDefinition(name string, val reflect.Value, rule string) error {
+	rule, arg, _ := strings.Cut(rule, "=")
+	switch rule {
+	case "min", "max":
+		return definitionError(func() { compareRuleValue(name, val, rule, arg) })
+	case "oneof":
+		if _, ok := textMarshalerUnmarshaler(val); ok {
+			return nil
+		}
+		switch kind := val.Kind(); {
+		case kind == reflect.String, isIntKind(kind), kind == reflect.Float32, kind == reflect.Float64:
+		default:
+			return fmt.Errorf("unsupported oneof validation rule on field %s of kind %s", name, kind)
+		}
+	}
+	return nil
+}
+
+// definitionError calls fn and returns the value it panics with as an error,
+// or nil if it does not panic.
+func definitionError(fn func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	fn()
+	return nil
+}
@@ -0,0 +1,85 @@
+package mainer
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestValidateDefinition(t *testing.T) {
+	c := qt.New(t)
+
+	type Valid struct {
+		V       int           `flag:"v,count"`
+		Tags    []string      `flag:"tag" flagSeparator:"," env:"TAG" envindexed:"true"`
+		TLS     bool          `flag:"tls"`
+		Cert    string        `flag:"cert,requires=tls" validate:"required,oneof=a b,email"`
+		Workers uint8         `flag:"workers" validate:"min=1,max=10,oneof=1 2"`
+		Timeout time.Duration `flag:"timeout" validate:"min=1s"`
+		Src     string        `arg:"0"`
+	}
+	type SepOnScalar struct {
+		Name string `flag:"name" flagSeparator:","`
+	}
+	type CountOnString struct {
+		V string `flag:"v,count"`
+	}
+	type OneofOnBool struct {
+		B bool `validate:"oneof=true false"`
+	}
+	type MinOnBool struct {
+		B bool `flag:"b" validate:"min=1"`
+	}
+	type InvalidMax struct {
+		D time.Duration `validate:"max=x"`
+	}
+	type Many struct {
+		A    string   `flag:"a" flagSeparator:","`
+		B    string   `flag:"b,count,requires=c"`
+		C    []bool   `validate:"oneof=x"`
+		D    bool     `validate:"max=1"`
+		E    int      `env:"E" envindexed:"true"`
+		F    []string `arg:"0..."`
+		G    string   `arg:"1"`
+		H    string   `flag:"h"`
+		I    int      `flag:"h"`
+		Skip string   `validate:"unknown"`
+	}
+
+	cases := []struct {
+		desc string
+		v    interface{}
+		err  string
+	}{
+		{"valid", &Valid{}, ""},
+		{"separator on scalar", &SepOnScalar{}, `ineffective flagSeparator attribute set on field Name`},
+		{"count on string", &CountOnString{}, `count option set on non-integer field V`},
+		{"oneof on bool", &OneofOnBool{}, `unsupported oneof validation rule on field B of kind bool`},
+		{"min on bool", &MinOnBool{}, `unsupported min validation rule on field B of kind bool`},
+		{"invalid max", &InvalidMax{}, `invalid max validation rule on field D: time: invalid duration "x"`},
+		{"many", &Many{}, `ineffective flagSeparator attribute set on field A
+count option set on non-integer field B
+flag redefined: h
+undefined flag c required by field B
+variadic arg of field F must be the last one
+unsupported oneof validation rule on field C of kind slice
+unsupported max validation rule on field D of kind bool
+envindexed set on non-slice field E`},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			err := p.ValidateDefinition(tc.v)
+			if tc.err == "" {
+				c.Assert(err, qt.IsNil)
+				c.Assert(func() { _ = p.Parse([]string{"", "x"}, tc.v) }, qt.Not(qt.PanicMatches), `.*`)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tc.err)
+			// the panic occurs even without args
+			c.Assert(func() { _ = p.Parse(nil, tc.v) }, qt.PanicMatches, tc.err)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package mainer
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Diff compares two instances of the same struct type, field by field, and
+// returns the fields that differ. Only the fields that define flags (as
+// supported by Parser.Parse) are compared, using reflect.DeepEqual. The key
+// of the returned map is the canonical (first) flag name of the field, and
+// the value holds the old and new values of the field, in that order. It
+// returns a nil map if no field differs.
+//
+// The fields of an embedded (or nested) pointer to a struct only define
+// flags if the pointer is not nil, so a field may exist on only one side.
+// Such a field is compared with the zero value of its type, e.g. the
+// old value is the zero value if the pointer is only set in newV.
+//
+// Both values must be structs or pointers to structs of the same type,
+// otherwise an error is returned. This is typically useful to log the
+// changes between configurations, e.g. when reloading.
+func Diff(oldV, newV interface{}) (map[string][2]interface{}, error) {
+	ov, err := addressableStruct(oldV)
+	if err != nil {
+		return nil, err
+	}
+	nv, err := addressableStruct(newV)
+	if err != nil {
+		return nil, err
+	}
+	if ov.Type() != nv.Type() {
+		return nil, fmt.Errorf("mismatched types: %s and %s", ov.Type(), nv.Type())
+	}
+
+	var p Parser
+	oldFields := fieldsByName(p.flagFields(ov.Addr().Interface()))
+	newFields := fieldsByName(p.flagFields(nv.Addr().Interface()))
+
+	var diff map[string][2]interface{}
+	add := func(name string, o, n interface{}) {
+		if reflect.DeepEqual(o, n) {
+			return
+		}
+		if diff == nil {
+			diff = make(map[string][2]interface{})
+		}
+		diff[name] = [2]interface{}{o, n}
+	}
+	for name, of := range oldFields {
+		if nf, ok := newFields[name]; ok {
+			add(name, of.value.Interface(), nf.value.Interface())
+			continue
+		}
+		add(name, of.value.Interface(), reflect.Zero(of.value.Type()).Interface())
+	}
+	for name, nf := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			add(name, reflect.Zero(nf.value.Type()).Interface(), nf.value.Interface())
+		}
+	}
+	return diff, nil
+}
+
+// addressableStruct returns an addressable reflect.Value of the struct v or
+// of the struct pointed to by v.
+func addressableStruct(v interface{}) (reflect.Value, error) {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Pointer && !val.IsNil() {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("expected a struct or a pointer to a struct, got %T", v)
+	}
+	if !val.CanAddr() {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		val = ptr.Elem()
+	}
+	return val, nil
+}
+
+// fieldsByName returns the flag fields keyed by their canonical name.
+func fieldsByName(fields []flagField) map[string]flagField {
+	m := make(map[string]flagField, len(fields))
+	for _, ff := range fields {
+		m[ff.names[0]] = ff
+	}
+	return m
+}
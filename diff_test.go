@@ -0,0 +1,90 @@
+package mainer
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDiff(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Addr    string        `flag:"a,addr"`
+		Timeout time.Duration `flag:"timeout"`
+		Tags    []string      `flag:"tag"`
+		NoFlag  int
+	}
+
+	old := F{Addr: ":80", Timeout: time.Second, Tags: []string{"a"}, NoFlag: 1}
+
+	// unchanged, including the non-flag field
+	diff, err := Diff(old, &F{Addr: ":80", Timeout: time.Second, Tags: []string{"a"}, NoFlag: 2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.IsNil)
+
+	// changed fields
+	diff, err = Diff(&old, F{Addr: ":8080", Timeout: time.Second, Tags: []string{"a", "b"}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.DeepEquals, map[string][2]interface{}{
+		"a":   {":80", ":8080"},
+		"tag": {[]string{"a"}, []string{"a", "b"}},
+	})
+}
+
+type DiffDB struct {
+	Host string `flag:"db-host"`
+	Port int    `flag:"db-port"`
+}
+
+func TestDiffNilEmbedded(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		*DiffDB
+		Addr string `flag:"addr"`
+	}
+
+	// the embedded fields exist only on the new side
+	diff, err := Diff(F{Addr: ":80"}, F{DiffDB: &DiffDB{Host: "db"}, Addr: ":8080"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.DeepEquals, map[string][2]interface{}{
+		"addr":    {":80", ":8080"},
+		"db-host": {"", "db"},
+	})
+
+	// the embedded fields exist only on the old side
+	diff, err = Diff(F{DiffDB: &DiffDB{Port: 5432}, Addr: ":80"}, F{Addr: ":80"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.DeepEquals, map[string][2]interface{}{
+		"db-port": {5432, 0},
+	})
+
+	// both sides set
+	diff, err = Diff(F{DiffDB: &DiffDB{Host: "a", Port: 1}}, F{DiffDB: &DiffDB{Host: "b", Port: 1}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.DeepEquals, map[string][2]interface{}{
+		"db-host": {"a", "b"},
+	})
+}
+
+func TestDiffErrors(t *testing.T) {
+	c := qt.New(t)
+
+	type F1 struct {
+		A string `flag:"a"`
+	}
+	type F2 struct {
+		A string `flag:"a"`
+	}
+
+	_, err := Diff(F1{}, &F2{})
+	c.Assert(err, qt.ErrorMatches, `mismatched types: mainer.F1 and mainer.F2`)
+
+	_, err = Diff(1, F1{})
+	c.Assert(err, qt.ErrorMatches, `expected a struct or a pointer to a struct, got int`)
+
+	_, err = Diff(F1{}, (*F1)(nil))
+	c.Assert(err, qt.ErrorMatches, `expected a struct or a pointer to a struct, got \*mainer.F1`)
+}
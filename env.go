@@ -0,0 +1,643 @@
+package mainer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caarlos0/env/v6"
+)
+
+// parseEnvVars parses the environment variables into v. It returns the set
+// of environment variable names (including the prefix) that were used to set
+// a field's value (i.e. excluding the ones where the default value was
+// used).
+func (p *Parser) parseEnvVars(args []string, v interface{}) (map[string]bool, error) {
+	var (
+		envSet    map[string]bool
+		sensitive map[string]bool
+	)
+	onSet := func(key string, val interface{}, isDefault bool) {
+		shown := val
+		if sensitive[key] {
+			shown = redactedValue
+		}
+		if isDefault {
+			p.debugf("applied env default %s=%q", key, shown)
+			return
+		}
+		if val == "" {
+			return
+		}
+		p.debugf("env %s overrode to %q", key, shown)
+		if envSet == nil {
+			envSet = make(map[string]bool)
+		}
+		envSet[key] = true
+	}
+	prefix := p.envPrefix(args)
+	if p.Debug != nil {
+		sensitive = make(map[string]bool)
+		collectEnvVarNames(reflect.ValueOf(v).Elem(), prefix, sensitive, true)
+	}
+	opts := env.Options{Prefix: prefix, OnSet: onSet}
+	if p.EnvCaseInsensitive {
+		opts.Environment = caseInsensitiveEnv(reflect.ValueOf(v).Elem(), prefix)
+	}
+	opts.Environment = p.applyEnvFallbacks(reflect.ValueOf(v).Elem(), prefix, opts.Environment)
+	if err := env.ParseWithFuncs(v, p.envParsers(v), opts); err != nil {
+		return nil, err
+	}
+	p.parseUnsplitEnvVars(v, prefix)
+	indexed, err := p.parseIndexedEnvVars(v, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for name := range indexed {
+		if envSet == nil {
+			envSet = make(map[string]bool)
+		}
+		envSet[name] = true
+	}
+	if err := p.checkEnvValues(v, prefix, envSet); err != nil {
+		return nil, err
+	}
+
+	if p.OnUnknownEnv != nil && prefix != "" {
+		known := make(map[string]bool)
+		collectEnvVarNames(reflect.ValueOf(v).Elem(), prefix, known, false)
+		for _, names := range indexed {
+			for _, name := range names {
+				known[name] = true
+			}
+		}
+		fold := func(s string) string { return s }
+		if p.EnvCaseInsensitive {
+			fold = strings.ToUpper
+			for name := range known {
+				known[fold(name)] = true
+			}
+		}
+		for _, name := range sortedEnvNames() {
+			if strings.HasPrefix(fold(name), fold(prefix)) && !known[fold(name)] {
+				p.OnUnknownEnv(name)
+			}
+		}
+	}
+	return envSet, nil
+}
+
+// parseUnsplitEnvVars sets the []string fields of v that have the
+// `envsep:"none"` struct tag to a single element holding the whole value of
+// their environment variable, if it is set and not empty, replacing the
+// elements split on commas by the env package. It panics if the tag is set
+// on a field of any other type, or with any other value.
+func (p *Parser) parseUnsplitEnvVars(v interface{}, prefix string) {
+	val := reflect.ValueOf(v).Elem()
+	strct := val.Type()
+
+	for i := 0; i < strct.NumField(); i++ {
+		fld, fldVal := strct.Field(i), val.Field(i)
+		if !isUnsplitEnvField(fld) || !fldVal.CanSet() {
+			continue
+		}
+		for _, name := range envVarNames(prefix, fld) {
+			if s, ok := p.lookupEnv(name); ok {
+				if s != "" {
+					fldVal.Set(reflect.ValueOf([]string{s}))
+				}
+				break
+			}
+		}
+	}
+}
+
+// isUnsplitEnvField returns true if the field has the `envsep:"none"`
+// struct tag. It panics if the tag is set on a field that is not a
+// []string, or with another value.
+func isUnsplitEnvField(fld reflect.StructField) bool {
+	tag, ok := fld.Tag.Lookup("envsep")
+	if !ok {
+		return false
+	}
+	if tag != "none" {
+		panic(fmt.Sprintf("invalid envsep value %q on field %s, must be none", tag, fld.Name))
+	}
+	if fld.Type != reflect.SliceOf(stringType) {
+		panic(fmt.Sprintf("envsep set on non-[]string field %s", fld.Name))
+	}
+	return true
+}
+
+// parseIndexedEnvVars sets the slice fields of v that have the
+// `envindexed:"true"` struct tag from the environment variables named after
+// the field's variable with an index suffix, e.g. PROG_HOST_0, PROG_HOST_1,
+// and so on, stopping at the first missing index. If at least one such
+// variable is set, the slice is replaced by their values, converted the same
+// way as flags, so it takes precedence over the non-indexed variable. It
+// returns the names of the indexed variables used, keyed by the name of the
+// field's non-indexed variable. It panics if the tag is set on a non-slice
+// field.
+func (p *Parser) parseIndexedEnvVars(v interface{}, prefix string) (map[string][]string, error) {
+	val := reflect.ValueOf(v).Elem()
+	strct := val.Type()
+
+	var indexed map[string][]string
+	for i := 0; i < strct.NumField(); i++ {
+		fld, fldVal := strct.Field(i), val.Field(i)
+		if fld.Tag.Get("envindexed") != "true" || !fldVal.CanSet() {
+			continue
+		}
+		name := envVarName(prefix, fld)
+		if name == "" {
+			continue
+		}
+		if fldVal.Kind() != reflect.Slice {
+			panic(fmt.Sprintf("envindexed set on non-slice field %s", fld.Name))
+		}
+
+		// the values are set via a slice flag so that they are converted the
+		// same way as flags, the first one replacing the existing values.
+		sliceFs := flag.NewFlagSet("", flag.ContinueOnError)
+		if !addToFlagSet(sliceFs, "v", createSliceElem(fld.Type.Elem()).Elem(), true, p.converters) {
+			panic(fmt.Sprintf("unsupported env field kind: %s (%s: %s)", fld.Type.Elem().Kind(), fld.Name, fld.Type))
+		}
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		reset := true
+		makeSliceFlag(fs, sliceFs.Lookup("v"), fld.Type.Elem(), fldVal, "", &reset)
+
+		var names []string
+		for ix := 0; ; ix++ {
+			ixName := name + "_" + strconv.Itoa(ix)
+			s, ok := p.lookupEnv(ixName)
+			if !ok {
+				break
+			}
+			if err := fs.Lookup("v").Value.Set(s); err != nil {
+				return nil, fmt.Errorf("env: invalid value %q for %s: %w", s, ixName, numError(err))
+			}
+			names = append(names, ixName)
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		p.debugf("env %s_0..%d overrode to %s", name, len(names)-1, debugValue(fld, fldVal))
+		if indexed == nil {
+			indexed = make(map[string][]string)
+		}
+		indexed[name] = names
+	}
+	return indexed, nil
+}
+
+// lookupEnv returns the value of the environment variable name, matched
+// regardless of case if Parser.EnvCaseInsensitive is set (with the same
+// precedence rules as for the other variables).
+func (p *Parser) lookupEnv(name string) (string, bool) {
+	if s, ok := os.LookupEnv(name); ok || !p.EnvCaseInsensitive {
+		return s, ok
+	}
+	for _, envName := range sortedEnvNames() {
+		if strings.EqualFold(envName, name) {
+			return os.LookupEnv(envName)
+		}
+	}
+	return "", false
+}
+
+// checkEnvValues checks that the values of the flag fields of v that were
+// set by an environment variable in envSet are allowed by their "choices"
+// or "min" and "max" struct tags. The values of the fields with choices are
+// set with the case of the matching choice.
+func (p *Parser) checkEnvValues(v interface{}, prefix string, envSet map[string]bool) error {
+	for _, ff := range p.flagFields(v) {
+		choices, fold := fieldChoices(ff)
+		lo, hi := fieldRange(ff)
+		name := envVarName(prefix+ff.envPrefix, ff.field)
+		if (choices == nil && lo == "" && hi == "") || !envSet[name] {
+			continue
+		}
+
+		vals := []reflect.Value{ff.value}
+		if ff.value.Kind() == reflect.Slice {
+			vals = vals[:0]
+			for i := 0; i < ff.value.Len(); i++ {
+				vals = append(vals, ff.value.Index(i))
+			}
+		}
+		for _, val := range vals {
+			if lo != "" || hi != "" {
+				if err := checkRange(ff.field.Name, val, lo, hi); err != nil {
+					return fmt.Errorf("env: invalid value %q for %s: %w", fmt.Sprint(val.Interface()), name, err)
+				}
+				continue
+			}
+
+			choice, err := matchChoice(val.String(), choices, fold)
+			if err != nil {
+				return fmt.Errorf("env: invalid value %q for %s: %w", val.String(), name, err)
+			}
+			val.SetString(choice)
+		}
+	}
+	return nil
+}
+
+// collectEnvVarNames adds the names of the environment variables associated
+// with the fields of the struct val to names, recursing into nested structs
+// the same way the env package does. If sensitiveOnly is true, only the
+// names associated with sensitive fields are added.
+func collectEnvVarNames(val reflect.Value, prefix string, names map[string]bool, sensitiveOnly bool) {
+	strct := val.Type()
+	for i := 0; i < strct.NumField(); i++ {
+		fld, fldVal := strct.Field(i), val.Field(i)
+		if !fldVal.CanSet() {
+			continue
+		}
+		if !sensitiveOnly || isSensitive(fld) {
+			for _, name := range envVarNames(prefix, fld) {
+				names[name] = true
+			}
+		}
+
+		if fldVal.Kind() == reflect.Pointer && !fldVal.IsNil() {
+			fldVal = fldVal.Elem()
+		}
+		if fldVal.Kind() == reflect.Struct {
+			collectEnvVarNames(fldVal, prefix+fld.Tag.Get("envPrefix"), names, sensitiveOnly)
+		}
+	}
+}
+
+// envOnlyFields returns the fields of the struct val that are associated
+// with an environment variable but define no flag, recursing into nested
+// structs the same way the env package does. The envPrefix of the returned
+// fields is set to the "envPrefix" struct tags of the nested structs.
+func envOnlyFields(val reflect.Value, envPrefix string) []flagField {
+	var fields []flagField
+	strct := val.Type()
+	for i := 0; i < strct.NumField(); i++ {
+		fld, fldVal := strct.Field(i), val.Field(i)
+		if !fldVal.CanSet() {
+			continue
+		}
+		if _, ok := fld.Tag.Lookup("flag"); !ok && envVarName("", fld) != "" {
+			fields = append(fields, flagField{field: fld, value: fldVal, envPrefix: envPrefix})
+			continue
+		}
+
+		if fldVal.Kind() == reflect.Pointer && !fldVal.IsNil() {
+			fldVal = fldVal.Elem()
+		}
+		if fldVal.Kind() == reflect.Struct {
+			fields = append(fields, envOnlyFields(fldVal, envPrefix+fld.Tag.Get("envPrefix"))...)
+		}
+	}
+	return fields
+}
+
+// caseInsensitiveEnv returns the environment of the current process, where
+// each variable associated with a field of the struct val that is only set
+// with a different casing is added under its exact name. If there are many
+// such variables for the same name, the first one in lexical order is used.
+func caseInsensitiveEnv(val reflect.Value, prefix string) map[string]string {
+	environ := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		environ[name] = value
+	}
+
+	known := make(map[string]bool)
+	collectEnvVarNames(val, prefix, known, false)
+	folded := make(map[string]string, len(known))
+	for name := range known {
+		folded[strings.ToUpper(name)] = name
+	}
+
+	for _, name := range sortedEnvNames() {
+		exact, ok := folded[strings.ToUpper(name)]
+		if !ok || name == exact {
+			continue
+		}
+		if _, ok := environ[exact]; !ok {
+			environ[exact] = environ[name]
+		}
+	}
+	return environ
+}
+
+// applyEnvFallbacks returns the environment where, for each field of the
+// struct val with an "envfallback" struct tag whose variable is not set, the
+// value of the first fallback variable that is set is added under the name
+// of the field's variable, recursing into nested structs the same way the
+// env package does. If environ is nil, the environment of the current
+// process is used, and it is returned as-is if no fallback applies.
+func (p *Parser) applyEnvFallbacks(val reflect.Value, prefix string, environ map[string]string) map[string]string {
+	strct := val.Type()
+	for i := 0; i < strct.NumField(); i++ {
+		fld, fldVal := strct.Field(i), val.Field(i)
+		if !fldVal.CanSet() {
+			continue
+		}
+
+		if names := envVarNames(prefix, fld); len(names) > 1 {
+			if environ == nil {
+				environ = make(map[string]string)
+				for _, kv := range os.Environ() {
+					name, value, _ := strings.Cut(kv, "=")
+					environ[name] = value
+				}
+			}
+			if _, ok := environ[names[0]]; !ok {
+				for _, name := range names[1:] {
+					if s, ok := environ[name]; ok {
+						p.debugf("env %s used as fallback for %s", name, names[0])
+						environ[names[0]] = s
+						break
+					}
+				}
+			}
+		}
+
+		if fldVal.Kind() == reflect.Pointer && !fldVal.IsNil() {
+			fldVal = fldVal.Elem()
+		}
+		if fldVal.Kind() == reflect.Struct {
+			environ = p.applyEnvFallbacks(fldVal, prefix+fld.Tag.Get("envPrefix"), environ)
+		}
+	}
+	return environ
+}
+
+// sortedEnvNames returns the sorted names of the environment variables of
+// the current process.
+func sortedEnvNames() []string {
+	environ := os.Environ()
+	names := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// envParsers returns the custom env parsers for the types that have a
+// converter registered with Parser.RegisterConverter (the env package uses
+// them for the slices of those types too), for the slice fields of v, as
+// returned by envSliceParsers, and for the integer types, as returned by
+// envIntParser.
+func (p *Parser) envParsers(v interface{}) map[reflect.Type]env.ParserFunc {
+	parsers := p.envSliceParsers(v)
+	if parsers == nil {
+		parsers = make(map[reflect.Type]env.ParserFunc, len(p.converters)+len(intTypes))
+	}
+	for typ, fn := range p.converters {
+		if _, ok := parsers[typ]; ok {
+			continue
+		}
+		typ, fn := typ, fn
+		parsers[typ] = func(s string) (interface{}, error) {
+			val, err := convertValue(fn, typ, s)
+			if err != nil {
+				return nil, err
+			}
+			return val.Interface(), nil
+		}
+	}
+	for _, typ := range intTypes {
+		if _, ok := parsers[typ]; !ok {
+			parsers[typ] = envIntParser(typ)
+		}
+	}
+	return parsers
+}
+
+// intTypes lists the builtin integer types, which are parsed with
+// envIntParser.
+var intTypes = []reflect.Type{
+	reflect.TypeOf(int(0)), reflect.TypeOf(int8(0)), reflect.TypeOf(int16(0)),
+	reflect.TypeOf(int32(0)), reflect.TypeOf(int64(0)),
+	reflect.TypeOf(uint(0)), reflect.TypeOf(uint8(0)), reflect.TypeOf(uint16(0)),
+	reflect.TypeOf(uint32(0)), reflect.TypeOf(uint64(0)),
+}
+
+// envIntParser returns an env parser for the integer type typ that parses
+// the value in base 10, as the env package does, but that also accepts
+// underscores between digits, e.g. 1_000_000. Floats need no such parser,
+// as strconv.ParseFloat already accepts them.
+func envIntParser(typ reflect.Type) env.ParserFunc {
+	return func(s string) (interface{}, error) {
+		digits := stripDigitSeparators(s)
+		val := reflect.New(typ).Elem()
+		if isUintKind(typ.Kind()) {
+			n, err := strconv.ParseUint(digits, 10, typ.Bits())
+			if err != nil {
+				return nil, numErrorFor(err, s)
+			}
+			val.SetUint(n)
+		} else {
+			n, err := strconv.ParseInt(digits, 10, typ.Bits())
+			if err != nil {
+				return nil, numErrorFor(err, s)
+			}
+			val.SetInt(n)
+		}
+		return val.Interface(), nil
+	}
+}
+
+// stripDigitSeparators returns s without its underscores if each of them is
+// between two decimal digits, otherwise it returns s unchanged.
+func stripDigitSeparators(s string) string {
+	if !strings.Contains(s, "_") {
+		return s
+	}
+	isDigit := func(b byte) bool { return b >= '0' && b <= '9' }
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' && (i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1])) {
+			return s
+		}
+	}
+	return strings.ReplaceAll(s, "_", "")
+}
+
+// numErrorFor returns err with its number set to s if it is a
+// *strconv.NumError, so that the error reports the original value.
+func numErrorFor(err error, s string) error {
+	if ne, ok := err.(*strconv.NumError); ok {
+		ne.Num = s
+	}
+	return err
+}
+
+// envSliceParsers returns the custom env parsers required to split the slice
+// fields of v on Parser.EnvSliceSeparator, including those of the nested and
+// embedded structs. It returns nil if the default separator is used.
+func (p *Parser) envSliceParsers(v interface{}) map[reflect.Type]env.ParserFunc {
+	sep := p.EnvSliceSeparator
+	if sep == "" || sep == "," {
+		return nil
+	}
+
+	// the env package supports custom parsers per type, not per field, so a
+	// field with an explicit envSeparator tag prevents registering a custom
+	// parser for its type.
+	parsers := make(map[reflect.Type]env.ParserFunc)
+	explicit := make(map[reflect.Type]bool)
+	p.collectEnvSliceParsers(reflect.TypeOf(v).Elem(), sep, parsers, explicit, make(map[reflect.Type]bool))
+	for typ := range explicit {
+		delete(parsers, typ)
+	}
+	return parsers
+}
+
+// collectEnvSliceParsers adds to parsers the env parsers for the slice
+// fields of the struct type strct and of its nested and embedded structs,
+// and records in explicit the slice types of the fields that have an
+// envSeparator tag. The visited struct types are recorded in seen so that
+// recursive types are walked only once.
+func (p *Parser) collectEnvSliceParsers(strct reflect.Type, sep string, parsers map[reflect.Type]env.ParserFunc, explicit, seen map[reflect.Type]bool) {
+	if seen[strct] {
+		return
+	}
+	seen[strct] = true
+
+	for i := 0; i < strct.NumField(); i++ {
+		fld := strct.Field(i)
+		if !fld.IsExported() && !fld.Anonymous {
+			continue
+		}
+
+		typ := fld.Type
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		if typ.Kind() == reflect.Struct {
+			p.collectEnvSliceParsers(typ, sep, parsers, explicit, seen)
+			continue
+		}
+		if fld.Type.Kind() != reflect.Slice {
+			continue
+		}
+		if _, ok := fld.Tag.Lookup("envSeparator"); ok {
+			explicit[fld.Type] = true
+			continue
+		}
+		if fn, ok := envSliceParser(fld.Type, sep, p.converters); ok {
+			parsers[fld.Type] = fn
+		}
+	}
+}
+
+// envSliceParser returns an env parser for the slice type typ that splits
+// the value on sep and converts each element as is done for the slice flags.
+// It returns false if the slice's element type is not supported for flags.
+func envSliceParser(typ reflect.Type, sep string, convs converters) (env.ParserFunc, bool) {
+	elemTyp := typ.Elem()
+	if !addToFlagSet(flag.NewFlagSet("", flag.ContinueOnError), "v", createSliceElem(elemTyp).Elem(), true, convs) {
+		return nil, false
+	}
+
+	return func(s string) (interface{}, error) {
+		val := reflect.New(typ).Elem()
+		sliceFs := flag.NewFlagSet("", flag.ContinueOnError)
+		addToFlagSet(sliceFs, "v", createSliceElem(elemTyp).Elem(), true, convs)
+
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		makeSliceFlag(fs, sliceFs.Lookup("v"), elemTyp, val, sep, nil)
+		if err := fs.Lookup("v").Value.Set(s); err != nil {
+			return nil, err
+		}
+		return val.Interface(), nil
+	}, true
+}
+
+// envPrefix returns the prefix to use for the environment variables names.
+func (p *Parser) envPrefix(args []string) string {
+	prefix := p.EnvPrefix
+
+	if prefix == "" {
+		if p.ProgramName != "" {
+			prefix = prefixFromProgramName(p.ProgramName)
+		} else if len(args) > 0 {
+			prefix = prefixFromProgramName(args[0])
+		}
+	}
+	if prefix == "-" {
+		prefix = ""
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "_") {
+		prefix += "_"
+	}
+	return prefix
+}
+
+// envVarName returns the name of the environment variable associated with
+// the field, including the prefix, or an empty string if it has none.
+func envVarName(prefix string, fld reflect.StructField) string {
+	name, _, _ := strings.Cut(fld.Tag.Get("env"), ",")
+	if name == "" {
+		return ""
+	}
+	return prefix + name
+}
+
+// envVarNames returns the name of the environment variable associated with
+// the field followed by its fallback names, all including the prefix, or nil
+// if it has none. It panics if the field has fallback names but no
+// environment variable.
+func envVarNames(prefix string, fld reflect.StructField) []string {
+	name := envVarName(prefix, fld)
+	fallback, ok := fld.Tag.Lookup("envfallback")
+	if ok && name == "" {
+		panic(fmt.Sprintf("envfallback set on field %s without env name", fld.Name))
+	}
+	if name == "" {
+		return nil
+	}
+
+	names := []string{name}
+	for _, fb := range strings.Split(fallback, ",") {
+		if fb = strings.TrimSpace(fb); fb != "" {
+			names = append(names, prefix+fb)
+		}
+	}
+	return names
+}
+
+// prefixFromProgramName returns the environment variables prefix derived
+// from the program name. The base name is used, without the ".exe"
+// extension, all uppercase, and with any character other than ASCII letters,
+// digits and underscores replaced with an underscore (with repeated
+// underscores collapsed into one), so that e.g. "com.example.my-tool" results
+// in "COM_EXAMPLE_MY_TOOL_".
+func prefixFromProgramName(name string) string {
+	name = filepath.Base(name)
+	if ext := filepath.Ext(name); strings.EqualFold(ext, ".exe") {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			r = '_'
+		}
+		if r == '_' && strings.HasSuffix(sb.String(), "_") {
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	prefix := strings.Trim(sb.String(), "_")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "_"
+}
@@ -0,0 +1,465 @@
+package mainer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type Esep struct {
+	Paths  []string `flag:"path" env:"PATHS"`
+	Ports  []int    `env:"PORTS"`
+	Tags   []string `env:"TAGS"`
+	Labels []uint8  `env:"LABELS" envSeparator:"|"`
+}
+
+func TestParseEnvSliceSeparator(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_PATHS", "/a,b;/c")
+	c.Setenv("PROG_PORTS", "80;443")
+	c.Setenv("PROG_LABELS", "1|2")
+
+	// default separator
+	p := Parser{EnvVars: true}
+	var e Esep
+	err := p.Parse([]string{"prog"}, &e)
+	c.Assert(err, qt.ErrorMatches, `env: parse error on field "Ports" of type "\[\]int": .+`)
+
+	c.Setenv("PROG_PORTS", "80,443")
+	e = Esep{}
+	err = p.Parse([]string{"prog"}, &e)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e, qt.DeepEquals, Esep{
+		Paths:  []string{"/a", "b;/c"},
+		Ports:  []int{80, 443},
+		Labels: []uint8{1, 2},
+	})
+
+	// custom separator
+	p.EnvSliceSeparator = ";"
+	c.Setenv("PROG_PORTS", "80;443")
+	c.Setenv("PROG_TAGS", "x")
+	e = Esep{}
+	err = p.Parse([]string{"prog", "-path", "/d,e"}, &e)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e, qt.DeepEquals, Esep{
+		Paths:  []string{"/a,b", "/c", "/d,e"},
+		Ports:  []int{80, 443},
+		Tags:   []string{"x"},
+		Labels: []uint8{1, 2},
+	})
+
+	c.Setenv("PROG_PORTS", "80;x")
+	e = Esep{}
+	err = p.Parse([]string{"prog"}, &e)
+	c.Assert(err, qt.ErrorMatches, `env: parse error on field "Ports" of type "\[\]int": parse error`)
+}
+
+type EsepNested struct {
+	Hosts []string `env:"HOSTS"`
+}
+
+type EsepEmbedded struct {
+	Names []string `flag:"name" env:"NAMES"`
+}
+
+type Esep2 struct {
+	EsepEmbedded
+	DB *EsepNested `envPrefix:"DB_"`
+}
+
+func TestParseEnvSliceSeparatorNested(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_NAMES", "a;b,c")
+	c.Setenv("PROG_DB_HOSTS", "x,y;z")
+
+	p := Parser{EnvVars: true, EnvSliceSeparator: ";"}
+	e := Esep2{DB: &EsepNested{}}
+	err := p.Parse([]string{"prog"}, &e)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e.Names, qt.DeepEquals, []string{"a", "b,c"})
+	c.Assert(e.DB.Hosts, qt.DeepEquals, []string{"x,y", "z"})
+}
+
+func TestParseOnUnknownEnv(t *testing.T) {
+	c := qt.New(t)
+
+	type Nested struct {
+		Host string `env:"HOST"`
+	}
+	type F struct {
+		Addr string `flag:"addr" env:"ADDR"`
+		DB   Nested `envPrefix:"DB_"`
+		Help bool   `flag:"h"`
+	}
+
+	c.Setenv("PROG_ADDR", ":80")
+	c.Setenv("PROG_DB_HOST", "localhost")
+	c.Setenv("PROG_ADRR", ":8080")
+	c.Setenv("PROG_HELP", "1")
+	c.Setenv("PROGRAM", "x")
+	c.Setenv("OTHER_ADDR", "y")
+
+	var unknown []string
+	p := Parser{
+		EnvVars: true,
+		OnUnknownEnv: func(name string) {
+			unknown = append(unknown, name)
+		},
+	}
+
+	var f F
+	err := p.Parse([]string{"prog"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{Addr: ":80", DB: Nested{Host: "localhost"}})
+	c.Assert(unknown, qt.DeepEquals, []string{"PROG_ADRR", "PROG_HELP"})
+
+	// not called without a prefix
+	unknown = nil
+	p.EnvPrefix = "-"
+	err = p.Parse([]string{"prog"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(unknown, qt.IsNil)
+}
+
+func TestParseEnvSliceMergePolicy(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Tags []string `flag:"tag,t" env:"TAG"`
+		Nums []int    `flag:"num" env:"NUM"`
+		Keys []string `flag:"key" env:"KEY" flagSeparator:","`
+	}
+
+	c.Setenv("PROG_TAG", "a,b")
+	c.Setenv("PROG_NUM", "1,2")
+	c.Setenv("PROG_KEY", "x")
+
+	cases := []struct {
+		overwrite bool
+		args      []string
+		want      F
+	}{
+		{false, nil, F{Tags: []string{"a", "b"}, Nums: []int{1, 2}, Keys: []string{"x"}}},
+		{true, nil, F{Tags: []string{"a", "b"}, Nums: []int{1, 2}, Keys: []string{"x"}}},
+		{false, []string{"-tag", "c"}, F{Tags: []string{"a", "b", "c"}, Nums: []int{1, 2}, Keys: []string{"x"}}},
+		{true, []string{"-tag", "c"}, F{Tags: []string{"c"}, Nums: []int{1, 2}, Keys: []string{"x"}}},
+		{false, []string{"-tag", "c", "-t", "d", "-num", "3"}, F{Tags: []string{"a", "b", "c", "d"}, Nums: []int{1, 2, 3}, Keys: []string{"x"}}},
+		{true, []string{"-tag", "c", "-t", "d", "-num", "3"}, F{Tags: []string{"c", "d"}, Nums: []int{3}, Keys: []string{"x"}}},
+		{false, []string{"-key", "y,z"}, F{Tags: []string{"a", "b"}, Nums: []int{1, 2}, Keys: []string{"y", "z"}}},
+		{true, []string{"-key", "y,z"}, F{Tags: []string{"a", "b"}, Nums: []int{1, 2}, Keys: []string{"y", "z"}}},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%t %v", tc.overwrite, tc.args), func(c *qt.C) {
+			p := Parser{EnvVars: true, OverwriteSlices: tc.overwrite}
+			var f F
+			err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+}
+
+func TestParseEnvDigitSeparators(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Max   int           `flag:"max" env:"MAX"`
+		Small int8          `env:"SMALL"`
+		Size  uint64        `flag:"size" env:"SIZE" min:"1000"`
+		Ratio float64       `env:"RATIO"`
+		Nums  []int         `env:"NUMS"`
+		Name  string        `env:"NAME"`
+		Wait  time.Duration `env:"WAIT"`
+	}
+
+	cases := []struct {
+		env  map[string]string
+		want F
+		err  string
+	}{
+		{env: map[string]string{"MAX": "1_000"}, want: F{Max: 1000}},
+		{env: map[string]string{"MAX": "-1_000_000", "SMALL": "1_2", "SIZE": "18_446_744_073_709_551_615"}, want: F{Max: -1000000, Small: 12, Size: 18446744073709551615}},
+		{env: map[string]string{"RATIO": "1_000.5", "NUMS": "1_000,2_0"}, want: F{Ratio: 1000.5, Nums: []int{1000, 20}}},
+		{env: map[string]string{"NAME": "a_b_1_2"}, want: F{Name: "a_b_1_2"}},
+		{env: map[string]string{"MAX": "010"}, want: F{Max: 10}},
+		{env: map[string]string{"MAX": "_1000"}, err: `env: parse error on field "Max" of type "int": strconv.ParseInt: parsing "_1000": invalid syntax`},
+		{env: map[string]string{"MAX": "1__000"}, err: `env: parse error on field "Max" of type "int": strconv.ParseInt: parsing "1__000": invalid syntax`},
+		{env: map[string]string{"MAX": "1000_"}, err: `.*invalid syntax`},
+		{env: map[string]string{"SMALL": "1_000"}, err: `env: parse error on field "Small" of type "int8": strconv.ParseInt: parsing "1_000": value out of range`},
+		{env: map[string]string{"SIZE": "-1_000"}, err: `.*parsing "-1_000": invalid syntax`},
+		{env: map[string]string{"SIZE": "9_99"}, err: `env: invalid value "999" for PROG_SIZE: value out of range: must be at least 1000`},
+		{env: map[string]string{"WAIT": "1_000s"}, err: `env: parse error on field "Wait" .*`},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprint(tc.env), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			p := Parser{EnvVars: true}
+			var f F
+			err := p.Parse([]string{"prog"}, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+}
+
+func TestParseEnvUnsplit(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Filters []string `flag:"filter" env:"FILTER" envsep:"none"`
+		Docs    []string `env:"DOCS" envsep:"none" envindexed:"true"`
+		Tags    []string `env:"TAGS"`
+	}
+
+	cases := []struct {
+		env  map[string]string
+		args []string
+		want F
+	}{
+		{
+			env:  map[string]string{"FILTER": `{"a":1,"b":2}`, "TAGS": "x,y"},
+			want: F{Filters: []string{`{"a":1,"b":2}`}, Tags: []string{"x", "y"}},
+		},
+		{
+			env:  map[string]string{"FILTER": "/a,b/c"},
+			args: []string{"-filter", "d,e"},
+			want: F{Filters: []string{"/a,b/c", "d,e"}},
+		},
+		{
+			env:  map[string]string{"FILTER": ""},
+			want: F{},
+		},
+		{
+			env:  map[string]string{"DOCS": "a,b"},
+			want: F{Docs: []string{"a,b"}},
+		},
+		{
+			env:  map[string]string{"DOCS": "a,b", "DOCS_0": "c,d", "DOCS_1": "e"},
+			want: F{Docs: []string{"c,d", "e"}},
+		},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprint(tc.env, tc.args), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			p := Parser{EnvVars: true}
+			var f F
+			err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	c.Run("case insensitive", func(c *qt.C) {
+		c.Setenv("prog_filter", "a,b")
+		p := Parser{EnvVars: true, EnvCaseInsensitive: true}
+		var f F
+		err := p.Parse([]string{"prog"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.Filters, qt.DeepEquals, []string{"a,b"})
+	})
+
+	type Invalid struct {
+		Ints []int    `env:"INTS" envsep:"none"`
+		S    []string `env:"S" envsep:";"`
+	}
+	var p Parser
+	c.Assert(p.ValidateDefinition(&Invalid{}), qt.ErrorMatches, `envsep set on non-\[\]string field Ints
+invalid envsep value ";" on field S, must be none`)
+}
+
+func TestParseEnvFallback(t *testing.T) {
+	c := qt.New(t)
+
+	type Sub struct {
+		Host string `env:"HOST" envfallback:"ADDR"`
+	}
+	type F struct {
+		DB      string   `flag:"db" env:"DB" envfallback:"OLD_DB, OLDER_DB"`
+		Port    int      `env:"PORT" envfallback:"LEGACY_PORT"`
+		Filters []string `env:"FILTER" envsep:"none" envfallback:"FILTERS"`
+		Sub     Sub      `envPrefix:"SUB_"`
+	}
+
+	cases := []struct {
+		env  map[string]string
+		args []string
+		want F
+	}{
+		{
+			env:  map[string]string{"OLD_DB": "legacy", "LEGACY_PORT": "80"},
+			want: F{DB: "legacy", Port: 80},
+		},
+		{
+			env:  map[string]string{"DB": "new", "OLD_DB": "legacy", "OLDER_DB": "older"},
+			want: F{DB: "new"},
+		},
+		{
+			env:  map[string]string{"OLDER_DB": "older"},
+			want: F{DB: "older"},
+		},
+		{
+			env:  map[string]string{"DB": "", "OLD_DB": "legacy"},
+			want: F{},
+		},
+		{
+			env:  map[string]string{"OLD_DB": "legacy"},
+			args: []string{"-db", "flag"},
+			want: F{DB: "flag"},
+		},
+		{
+			env:  map[string]string{"FILTERS": "a,b", "SUB_ADDR": "localhost"},
+			want: F{Filters: []string{"a,b"}, Sub: Sub{Host: "localhost"}},
+		},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprint(tc.env, tc.args), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			var unknown []string
+			p := Parser{EnvVars: true, OnUnknownEnv: func(name string) { unknown = append(unknown, name) }}
+			var f F
+			err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+			c.Assert(unknown, qt.IsNil)
+		})
+	}
+
+	c.Run("case insensitive", func(c *qt.C) {
+		c.Setenv("prog_old_db", "legacy")
+		p := Parser{EnvVars: true, EnvCaseInsensitive: true}
+		var f F
+		err := p.Parse([]string{"prog"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.DB, qt.Equals, "legacy")
+	})
+
+	c.Run("usage", func(c *qt.C) {
+		p := Parser{EnvVars: true}
+		var buf strings.Builder
+		c.Assert(p.WriteUsage(&buf, "prog", &F{}), qt.IsNil)
+		c.Assert(buf.String(), qt.Contains, "PROG_PORT int")
+		c.Assert(buf.String(), qt.Not(qt.Contains), "LEGACY_PORT")
+	})
+
+	type Invalid struct {
+		S string `envfallback:"OLD_S"`
+	}
+	var p Parser
+	c.Assert(p.ValidateDefinition(&Invalid{}), qt.ErrorMatches, `envfallback set on field S without env name`)
+}
+
+func TestParseEnvCaseInsensitive(t *testing.T) {
+	c := qt.New(t)
+
+	type Nested struct {
+		Host string `env:"HOST"`
+	}
+	type F struct {
+		Addr  string   `flag:"addr" env:"ADDR"`
+		Port  int      `flag:"port" env:"Port"`
+		Tags  []string `flag:"tag" env:"TAGS"`
+		DB    Nested   `envPrefix:"DB_"`
+		Debug bool     `flag:"debug" env:"DEBUG"`
+	}
+
+	c.Setenv("prog_addr", ":80")
+	c.Setenv("PROG_PORT", "8080")
+	c.Setenv("Prog_Tags", "a,b")
+	c.Setenv("prog_db_host", "localhost")
+	c.Setenv("PROG_DEBUG", "true")
+	c.Setenv("prog_debug", "false")
+	c.Setenv("prog_unknown", "x")
+
+	var unknown []string
+	p := Parser{EnvVars: true, OnUnknownEnv: func(name string) {
+		unknown = append(unknown, name)
+	}}
+
+	// case-sensitive by default
+	var f F
+	err := p.Parse([]string{"prog"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{Debug: true})
+
+	p.EnvCaseInsensitive = true
+	unknown = nil
+	f = F{}
+	err = p.Parse([]string{"prog"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{
+		Addr:  ":80",
+		Port:  8080,
+		Tags:  []string{"a", "b"},
+		DB:    Nested{Host: "localhost"},
+		Debug: true,
+	})
+	c.Assert(unknown, qt.DeepEquals, []string{"prog_unknown"})
+
+	// flags still take precedence
+	f = F{}
+	err = p.Parse([]string{"prog", "-addr", ":81"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Addr, qt.Equals, ":81")
+}
+
+func TestParseEnvIndexed(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Hosts []string `flag:"host" env:"HOST" envindexed:"true"`
+		Ports []int    `flag:"port" env:"PORT" envindexed:"true"`
+		Tags  []string `env:"TAG"`
+	}
+
+	c.Setenv("PROG_HOST", "x,y")
+	c.Setenv("PROG_HOST_0", "a")
+	c.Setenv("PROG_HOST_1", "b,c")
+	c.Setenv("PROG_HOST_2", "d")
+	c.Setenv("PROG_PORT_0", "80")
+	c.Setenv("PROG_PORT_2", "443")
+	c.Setenv("PROG_TAG_0", "t")
+
+	var unknown []string
+	p := Parser{EnvVars: true, OnUnknownEnv: func(name string) {
+		unknown = append(unknown, name)
+	}}
+	var f F
+	err := p.Parse([]string{"prog"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Hosts, qt.DeepEquals, []string{"a", "b,c", "d"})
+	c.Assert(f.Ports, qt.DeepEquals, []int{80})
+	c.Assert(f.Tags, qt.IsNil)
+	c.Assert(unknown, qt.DeepEquals, []string{"PROG_PORT_2", "PROG_TAG_0"})
+
+	// flags still append to the env values
+	f = F{}
+	err = p.Parse([]string{"prog", "-port", "8080"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Ports, qt.DeepEquals, []int{80, 8080})
+
+	c.Setenv("PROG_PORT_1", "x")
+	f = F{}
+	err = p.Parse([]string{"prog"}, &f)
+	c.Assert(err, qt.ErrorMatches, `env: invalid value "x" for PROG_PORT_1: parse error`)
+
+	type Invalid struct {
+		Host string `env:"HOST" envindexed:"true"`
+	}
+	c.Assert(func() { _ = p.Parse([]string{"prog"}, &Invalid{}) }, qt.PanicMatches, `envindexed set on non-slice field Host`)
+}
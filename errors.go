@@ -0,0 +1,178 @@
+package mainer
+
+import (
+	"errors"
+	"strings"
+)
+
+// ParseErrorKind identifies the kind of failure reported by a ParseError.
+type ParseErrorKind int
+
+// List of parse error kinds.
+const (
+	// ErrUnknownFlag is the kind of error returned when a flag is provided
+	// but not defined.
+	ErrUnknownFlag ParseErrorKind = iota + 1
+
+	// ErrInvalidValue is the kind of error returned when a flag or
+	// environment variable value cannot be converted to its field's type.
+	ErrInvalidValue
+
+	// ErrMissingValue is the kind of error returned when a non-boolean flag
+	// is provided without a value.
+	ErrMissingValue
+
+	// ErrSyntax is the kind of error returned when an argument has an
+	// invalid flag syntax.
+	ErrSyntax
+
+	// ErrValidation is the kind of error returned when the Validate method
+	// of the parsed value fails.
+	ErrValidation
+
+	// ErrRequired is the kind of error returned when a required value is not
+	// provided.
+	ErrRequired
+
+	// ErrConfig is the kind of error returned when the config file cannot be
+	// read or decoded.
+	ErrConfig
+
+	// ErrUnexpectedArg is the kind of error returned when more positional
+	// arguments are provided than there are fields bound to them.
+	ErrUnexpectedArg
+
+	// ErrExclusive is the kind of error returned when more than one flag of
+	// the same mutually exclusive group is provided.
+	ErrExclusive
+)
+
+func (k ParseErrorKind) String() string {
+	switch k {
+	case ErrUnknownFlag:
+		return "unknown flag"
+	case ErrInvalidValue:
+		return "invalid value"
+	case ErrMissingValue:
+		return "missing value"
+	case ErrSyntax:
+		return "syntax error"
+	case ErrValidation:
+		return "validation failed"
+	case ErrRequired:
+		return "required"
+	case ErrConfig:
+		return "config error"
+	case ErrUnexpectedArg:
+		return "unexpected argument"
+	case ErrExclusive:
+		return "mutually exclusive flags"
+	default:
+		return "unknown error"
+	}
+}
+
+// ParseError is the type of the errors returned by Parser.Parse. Callers can
+// use errors.As to inspect the kind of failure, e.g. to decide on the exit
+// code or messaging.
+type ParseError struct {
+	// Kind is the kind of failure.
+	Kind ParseErrorKind
+
+	// Flag is the name of the flag that caused the failure, without leading
+	// dashes, if the error is associated with a flag.
+	Flag string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the message of the underlying error.
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// flagErrorPrefixes is the list of prefixes of the error messages returned
+// by the stdlib's flag package, along with the corresponding kind and the
+// marker that precedes the flag name in the message.
+var flagErrorPrefixes = []struct {
+	prefix string
+	kind   ParseErrorKind
+	marker string
+}{
+	{"flag provided but not defined: -", ErrUnknownFlag, ": -"},
+	{"invalid value ", ErrInvalidValue, " for flag -"},
+	{"invalid boolean value ", ErrInvalidValue, " for -"},
+	{"invalid boolean flag ", ErrInvalidValue, "flag "},
+	{"flag needs an argument: -", ErrMissingValue, ": -"},
+	{"bad flag syntax: ", ErrSyntax, ""},
+}
+
+// newFlagError wraps an error returned by the stdlib's flag package in a
+// ParseError. The flag package does not export its error types, so the kind
+// and flag name are extracted from the error message.
+func newFlagError(err error) error {
+	msg := err.Error()
+	for _, fp := range flagErrorPrefixes {
+		if !strings.HasPrefix(msg, fp.prefix) {
+			continue
+		}
+
+		var name string
+		if fp.marker != "" {
+			if ix := strings.LastIndex(msg, fp.marker); ix >= 0 {
+				name = msg[ix+len(fp.marker):]
+				if ix := strings.Index(name, ": "); ix >= 0 {
+					name = name[:ix]
+				}
+			}
+		}
+		return &ParseError{Kind: fp.kind, Flag: name, Err: err}
+	}
+	return &ParseError{Kind: ErrSyntax, Err: err}
+}
+
+// newEnvError wraps an error returned by the env package in a ParseError.
+func newEnvError(err error) error {
+	kind := ErrInvalidValue
+	if strings.Contains(err.Error(), "required environment variable") {
+		kind = ErrRequired
+	}
+	return &ParseError{Kind: kind, Err: err}
+}
+
+// newValidationError wraps an error returned by the Validate method in a
+// ParseError.
+func newValidationError(err error) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &ParseError{Kind: ErrValidation, Err: err}
+}
+
+// appendErrors appends err to errs, flattening it if it joins many errors
+// (as returned by joinErrors). It returns errs unchanged if err is nil.
+func appendErrors(errs []error, err error) []error {
+	if err == nil {
+		return errs
+	}
+	if je, ok := err.(interface{ Unwrap() []error }); ok {
+		return append(errs, je.Unwrap()...)
+	}
+	return append(errs, err)
+}
+
+// joinErrors returns nil if errs is empty, the single error if it contains
+// only one, and the errors joined with errors.Join otherwise.
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
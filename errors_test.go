@@ -0,0 +1,342 @@
+package mainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type errF struct {
+	S string `flag:"s"`
+	I int    `flag:"i" env:"I"`
+	B bool   `flag:"b"`
+	R string `env:"R,required"`
+}
+
+func (f *errF) Validate() error {
+	if f.S == "" {
+		return errors.New("s must be set")
+	}
+	return nil
+}
+
+func TestParseErrorKinds(t *testing.T) {
+	c := qt.New(t)
+
+	const progName = "/tmp/mainer-test"
+
+	cases := []struct {
+		env  map[string]string // prefix-less env vars, only set if EnvVars is true
+		args []string
+		kind ParseErrorKind
+		flag string
+		msg  string
+	}{
+		{args: []string{"-z"}, kind: ErrUnknownFlag, flag: "z", msg: "flag provided but not defined: -z"},
+		{args: []string{"-h"}, kind: ErrUnknownFlag, flag: "h", msg: "flag provided but not defined: -h"},
+		{args: []string{"-help"}, kind: ErrUnknownFlag, flag: "help", msg: "flag provided but not defined: -help"},
+		{args: []string{"-i", "x"}, kind: ErrInvalidValue, flag: "i", msg: `invalid value "x" for flag -i: parse error`},
+		{args: []string{"-b=x"}, kind: ErrInvalidValue, flag: "b", msg: `invalid boolean value "x" for -b: parse error`},
+		{args: []string{"-i"}, kind: ErrMissingValue, flag: "i", msg: "flag needs an argument: -i"},
+		{args: []string{"-=x"}, kind: ErrSyntax, msg: "bad flag syntax: -=x"},
+		{args: []string{"-i", "1"}, kind: ErrValidation, msg: "s must be set"},
+		{env: map[string]string{"R": "r", "I": "x"}, kind: ErrInvalidValue, msg: `parse error on field "I"`},
+		{env: map[string]string{"I": "1"}, kind: ErrRequired, msg: `required environment variable "MAINER_TEST_R" is not set`},
+	}
+
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var p Parser
+			if tc.env != nil {
+				p.EnvVars = true
+				for k, v := range tc.env {
+					c.Setenv("MAINER_TEST_"+k, v)
+				}
+			}
+
+			var f errF
+			err := p.Parse(append([]string{progName}, tc.args...), &f)
+			c.Assert(err, qt.IsNotNil)
+			c.Assert(err.Error(), qt.Contains, tc.msg)
+
+			var pe *ParseError
+			c.Assert(errors.As(err, &pe), qt.IsTrue)
+			c.Assert(pe.Kind, qt.Equals, tc.kind)
+			c.Assert(pe.Flag, qt.Equals, tc.flag)
+			c.Assert(errors.Unwrap(err).Error(), qt.Equals, err.Error())
+		})
+	}
+}
+
+type parseErrF struct {
+	X int `flag:"x"`
+}
+
+func (f *parseErrF) Validate() error {
+	return &ParseError{Kind: ErrRequired, Flag: "x", Err: errors.New("x is required")}
+}
+
+func TestParseErrorFromValidate(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		f parseErrF
+		p Parser
+	)
+	err := p.Parse([]string{""}, &f)
+
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrRequired)
+	c.Assert(pe.Flag, qt.Equals, "x")
+	c.Assert(err.Error(), qt.Equals, "x is required")
+}
+
+type collectF struct {
+	N    int    `flag:"n" env:"N"`
+	JSON bool   `flag:"json,group=format"`
+	YAML bool   `flag:"yaml,group=format"`
+	Cert string `flag:"cert,requires=tls"`
+	TLS  bool   `flag:"tls"`
+	Src  string `arg:"0"`
+}
+
+func (f *collectF) ValidateAll() []error {
+	var errs []error
+	if f.N < 0 {
+		errs = append(errs, errors.New("n must be positive"))
+	}
+	if f.Src == "" {
+		errs = append(errs, errors.New("src must be set"))
+	}
+	return errs
+}
+
+func TestParseCollectAllErrors(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_N", "x")
+
+	p := Parser{EnvVars: true, CollectAllErrors: true}
+	var f collectF
+	err := p.Parse([]string{"prog", "-z", "-n", "y", "-json", "-yaml", "-cert", "c", "-=x", "-h"}, &f)
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(err.Error(), qt.Equals, `env: parse error on field "N" of type "int": strconv.ParseInt: parsing "x": invalid syntax
+flag provided but not defined: -z
+invalid value "y" for flag -n: parse error
+bad flag syntax: -=x
+flag provided but not defined: -h
+mutually exclusive flags provided: -json, -yaml
+-cert requires -tls
+missing required argument: Src
+src must be set`)
+
+	var kinds []ParseErrorKind
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var pe *ParseError
+		c.Assert(errors.As(err, &pe), qt.IsTrue)
+		kinds = append(kinds, pe.Kind)
+	}
+	c.Assert(kinds, qt.DeepEquals, []ParseErrorKind{
+		ErrInvalidValue, ErrUnknownFlag, ErrInvalidValue, ErrSyntax, ErrUnknownFlag,
+		ErrExclusive, ErrRequired, ErrRequired, ErrValidation,
+	})
+
+	// only validation errors
+	c.Setenv("PROG_N", "-1")
+	f = collectF{}
+	res, err := p.ParseResult([]string{"prog", "-json"}, &f)
+	c.Assert(err, qt.ErrorMatches, "missing required argument: Src\nn must be positive\nsrc must be set")
+	c.Assert(res, qt.Equals, Result{})
+
+	f = collectF{}
+	res, err = p.ParseResult([]string{"prog", "-json", ""}, &f)
+	c.Assert(err, qt.ErrorMatches, "n must be positive\nsrc must be set")
+	c.Assert(res, qt.Equals, Result{FlagsSet: 1, FlagsCount: 1, ArgsCount: 1})
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrValidation)
+}
+
+func TestParseCollectAllErrorsSingle(t *testing.T) {
+	c := qt.New(t)
+
+	// a single error is returned as-is
+	p := Parser{CollectAllErrors: true}
+	var f errF
+	err := p.Parse([]string{"prog", "-s", "x", "-z"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -z")
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrUnknownFlag)
+	c.Assert(pe.Flag, qt.Equals, "z")
+
+	// Validate is used if ValidateAll is not implemented
+	f = errF{}
+	err = p.Parse([]string{"prog", "-z"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -z\ns must be set")
+}
+
+func TestExitCodeFor(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		err   error
+		usage bool
+		want  ExitCode
+	}{
+		{nil, false, Success},
+		{errors.New("boom"), false, Failure},
+		{&ParseError{Kind: ErrUnknownFlag, Err: errors.New("x")}, true, InvalidArgs},
+		{&ParseError{Kind: ErrInvalidValue, Err: errors.New("x")}, true, InvalidArgs},
+		{&ParseError{Kind: ErrRequired, Err: errors.New("x")}, true, InvalidArgs},
+		{&ParseError{Kind: ErrValidation, Err: errors.New("x")}, true, InvalidArgs},
+		{&ParseError{Kind: ErrConfig, Err: errors.New("x")}, false, Failure},
+		{fmt.Errorf("wrapped: %w", &ParseError{Kind: ErrSyntax, Err: errors.New("x")}), true, InvalidArgs},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprint(tc.err), func(c *qt.C) {
+			c.Assert(IsUsageError(tc.err), qt.Equals, tc.usage)
+			c.Assert(ExitCodeFor(tc.err), qt.Equals, tc.want)
+		})
+	}
+
+	// from an actual parse
+	var (
+		p Parser
+		f errF
+	)
+	c.Assert(ExitCodeFor(p.Parse([]string{"", "-z"}, &f)), qt.Equals, InvalidArgs)
+	c.Assert(ExitCodeFor(p.Parse([]string{"", "-s", "x"}, &f)), qt.Equals, Success)
+}
+
+func TestExitCodeForError(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		err  error
+		want ExitCode
+	}{
+		{nil, Success},
+		{errors.New("boom"), Failure},
+		{&ParseError{Kind: ErrUnknownFlag, Err: errors.New("x")}, InvalidArgs},
+		{&ParseError{Kind: ErrValidation, Err: errors.New("x")}, InvalidArgs},
+		{&ParseError{Kind: ErrConfig, Err: errors.New("x")}, InvalidArgs},
+		{fmt.Errorf("wrapped: %w", &ParseError{Kind: ErrSyntax, Err: errors.New("x")}), InvalidArgs},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprint(tc.err), func(c *qt.C) {
+			c.Assert(ExitCodeForError(tc.err), qt.Equals, tc.want)
+		})
+	}
+
+	var (
+		p Parser
+		f errF
+	)
+	c.Assert(ExitCodeForError(p.Parse([]string{"", "-z"}, &f)), qt.Equals, InvalidArgs)
+	c.Assert(ExitCodeForError(p.Parse([]string{"", "-s", "x"}, &f)), qt.Equals, Success)
+}
+
+type sentinelValidateF struct {
+	S string `flag:"s"`
+}
+
+var errMissingS = errors.New("s must be set")
+
+func (f *sentinelValidateF) Validate() error {
+	if f.S == "" {
+		return fmt.Errorf("invalid config: %w", errMissingS)
+	}
+	return nil
+}
+
+func TestIsValidationError(t *testing.T) {
+	c := qt.New(t)
+
+	var p Parser
+
+	// an invalid flag is a usage error, but not a validation error
+	var f sentinelValidateF
+	err := p.Parse([]string{"", "-z"}, &f)
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrUnknownFlag)
+	c.Assert(IsValidationError(err), qt.IsFalse)
+	c.Assert(ExitCodeFor(err), qt.Equals, InvalidArgs)
+
+	// the error returned by Validate is wrapped and preserved
+	f = sentinelValidateF{}
+	err = p.Parse([]string{""}, &f)
+	c.Assert(err, qt.ErrorMatches, "invalid config: s must be set")
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrValidation)
+	c.Assert(IsValidationError(err), qt.IsTrue)
+	c.Assert(errors.Is(err, errMissingS), qt.IsTrue)
+	c.Assert(errors.Unwrap(err), qt.ErrorMatches, "invalid config: s must be set")
+	c.Assert(ExitCodeFor(err), qt.Equals, InvalidArgs)
+
+	// so does the error returned by the Validator
+	p.Validator = func(v interface{}) error { return errMissingS }
+	f = sentinelValidateF{S: "x"}
+	err = p.Parse([]string{""}, &f)
+	c.Assert(IsValidationError(err), qt.IsTrue)
+	c.Assert(errors.Is(err, errMissingS), qt.IsTrue)
+
+	c.Assert(IsValidationError(nil), qt.IsFalse)
+	c.Assert(IsValidationError(errMissingS), qt.IsFalse)
+	c.Assert(IsValidationError(fmt.Errorf("wrapped: %w", &ParseError{Kind: ErrValidation, Err: errMissingS})), qt.IsTrue)
+}
+
+type timeoutErr struct{ timeout bool }
+
+func (e timeoutErr) Error() string { return "timeout error" }
+func (e timeoutErr) Timeout() bool { return e.timeout }
+
+func TestDetailedExitCodeFor(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		err  error
+		want ExitCode
+	}{
+		{nil, Success},
+		{errors.New("boom"), Failure},
+		{&ParseError{Kind: ErrInvalidValue, Err: errors.New("x")}, InvalidArgs},
+		{&ParseError{Kind: ErrConfig, Err: os.ErrPermission}, NoPermission},
+		{context.DeadlineExceeded, Timeout},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), Timeout},
+		{os.ErrDeadlineExceeded, Timeout},
+		{timeoutErr{timeout: true}, Timeout},
+		{timeoutErr{timeout: false}, Failure},
+		{context.Canceled, Failure},
+		{os.ErrPermission, NoPermission},
+		{&os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}, NoPermission},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprint(tc.err), func(c *qt.C) {
+			c.Assert(DetailedExitCodeFor(tc.err), qt.Equals, tc.want)
+		})
+	}
+
+	// the same errors are still reported as failures by ExitCodeFor
+	c.Assert(ExitCodeFor(context.DeadlineExceeded), qt.Equals, Failure)
+	c.Assert(ExitCodeFor(os.ErrPermission), qt.Equals, Failure)
+}
+
+func TestExitCodeString(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(Success.String(), qt.Equals, "success")
+	c.Assert(Failure.String(), qt.Equals, "failure")
+	c.Assert(InvalidArgs.String(), qt.Equals, "invalid-args")
+	c.Assert(Unavailable.String(), qt.Equals, "unavailable")
+	c.Assert(Timeout.String(), qt.Equals, "timeout")
+	c.Assert(NoPermission.String(), qt.Equals, "no-permission")
+	c.Assert(ExitCode(42).String(), qt.Equals, "exit(42)")
+}
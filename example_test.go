@@ -0,0 +1,98 @@
+package mainer_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mna/mainer"
+)
+
+// keyValueDecoder is a trivial config decoder that decodes lines of
+// "key=value" pairs.
+type keyValueDecoder struct{}
+
+func (keyValueDecoder) Decode(r io.Reader, v interface{}) error {
+	m := make(map[string]interface{})
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		key, val, _ := strings.Cut(line, "=")
+		m[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	*(v.(*map[string]interface{})) = m
+	return nil
+}
+
+func ExampleConfigDecoder() {
+	dir, err := os.MkdirTemp("", "example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.txt")
+	if err := os.WriteFile(file, []byte("addr = :8080\nverbose = true\n"), 0600); err != nil {
+		panic(err)
+	}
+
+	var cmd struct {
+		Addr    string `flag:"addr"`
+		Verbose bool   `flag:"verbose"`
+	}
+	p := mainer.Parser{ConfigFile: file, ConfigDecoder: keyValueDecoder{}}
+	if err := p.Parse([]string{"prog"}, &cmd); err != nil {
+		panic(err)
+	}
+	fmt.Println(cmd.Addr, cmd.Verbose)
+
+	// Output:
+	// :8080 true
+}
+
+// greetCmd is a sample command that greets the name provided as argument.
+type greetCmd struct {
+	Shout bool   `flag:"shout"`
+	Name  string `arg:"0"`
+}
+
+func (c *greetCmd) Main(args []string, stdio mainer.Stdio) mainer.ExitCode {
+	var p mainer.Parser
+	if err := p.Parse(args, c); err != nil {
+		stdio.Errorln(err)
+		return mainer.InvalidArgs
+	}
+
+	msg := "hello, " + c.Name
+	if c.Shout {
+		msg = strings.ToUpper(msg)
+	}
+	stdio.Println(msg)
+	return mainer.Success
+}
+
+func ExampleRunWith() {
+	var stdout, stderr bytes.Buffer
+	stdio := mainer.Stdio{Stdin: strings.NewReader(""), Stdout: &stdout, Stderr: &stderr}
+
+	code := mainer.RunWith(&greetCmd{}, []string{"greet", "-shout", "world"}, stdio)
+	fmt.Printf("%v: %q %q\n", code, stdout.String(), stderr.String())
+
+	stdout.Reset()
+	code = mainer.RunWith(&greetCmd{}, []string{"greet", "-loud", "world"}, stdio)
+	fmt.Printf("%v: %q %q\n", code, stdout.String(), stderr.String())
+
+	// Output:
+	// success: "HELLO, WORLD\n" ""
+	// invalid-args: "" "flag provided but not defined: -loud\n"
+}
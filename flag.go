@@ -1,24 +1,25 @@
 package mainer
 
 import (
+	"context"
 	"encoding"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"path/filepath"
+	"math/bits"
+	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/caarlos0/env/v6"
 )
 
 // Parser implements a command-line flags parser that uses struct tags to
 // configure supported flags and returns any error it encounters, without
-// printing anything automatically. It can optionally read flag values from
-// environment variables first, with the command-line flags used to override
-// them.
+// printing anything automatically (unless PrintUsageOnError is set). It can
+// optionally read flag values from environment variables first, with the
+// command-line flags used to override them.
 //
 // The struct tag to specify flags is `flag`, while the one to specify
 // environment variables is `env`. See the env/v6 package for full details on
@@ -34,153 +35,2372 @@ type Parser struct {
 
 	// EnvPrefix is the prefix to use in front of each flag's environment
 	// variable name. If it is empty, the name of the program (as read from the
-	// args slice at index 0) is used, all uppercase and with dashes replaced
-	// with underscores. Set it to "-" to disable any prefix.
+	// args slice at index 0) is used, without its ".exe" extension, all
+	// uppercase and with dashes, dots and any other character that is not
+	// valid in an environment variable name replaced with underscores (e.g.
+	// "tool.sh" results in TOOL_SH_). Set it to "-" to disable any prefix. An
+	// explicit prefix that does not end with an underscore gets one appended,
+	// so that e.g. "MYAPP" results in MYAPP_FOO for the FOO variable.
 	EnvPrefix string
+
+	// ProgramName, if not empty, is the name of the program used instead of
+	// the one in args[0], both to derive the environment variables prefix
+	// (if EnvPrefix is empty) and in the header of the usage text printed for
+	// PrintUsageOnError. This is useful when the binary may be invoked via a
+	// symlink or a wrapper script with a different name.
+	ProgramName string
+
+	// NormalizeFlagNames indicates if underscores and dashes are considered
+	// equivalent in flag names, so that e.g. -log-level and -log_level refer
+	// to the same flag. Both the flag definitions and the flags provided in
+	// the args are normalized to use dashes, and the canonical names reported
+	// by SetFlags and SetFlagsCount are the normalized ones. It panics if two
+	// distinct flags are defined with names that differ only by those
+	// separators.
+	NormalizeFlagNames bool
+
+	// EnvCaseInsensitive indicates if environment variables are matched
+	// regardless of case, so that e.g. prog_addr sets the field with the
+	// `env:"ADDR"` tag (with the PROG_ prefix). A variable with the exact
+	// name always takes precedence, and if many variables differ only by
+	// case, the first one in lexical order is used. This also applies to the
+	// variables reported by OnUnknownEnv.
+	EnvCaseInsensitive bool
+
+	// EnvSliceSeparator is the separator used to split the values of
+	// environment variables for slice fields. If it is empty, the default
+	// separator of the env package is used (a comma). A field's envSeparator
+	// struct tag takes precedence, but note that due to how the env package
+	// supports custom parsing, this separator is then ignored for all fields
+	// with the same slice type. It has no effect on command-line flags.
+	EnvSliceSeparator string
+
+	// OverwriteSlices sets the merge policy of slice fields without a
+	// flagSeparator struct tag. By default, each occurrence of the flag appends
+	// to the slice, including to the values set by the struct's initial
+	// value, the config file or the environment variables, so that e.g.
+	// PROG_TAG=a,b with -tag c results in [a b c]. If OverwriteSlices is true,
+	// the first occurrence of the flag replaces the existing values instead
+	// (resulting in [c] for the same example) and subsequent occurrences
+	// append to it. The same policy applies to arrays in the config file.
+	OverwriteSlices bool
+
+	// ConfigFile is the path of a config file to read flag values from. If it
+	// is set, the file must exist and contain an object where the keys are the
+	// canonical flag names (a JSON object unless ConfigDecoder is set). The
+	// values are stored in the fields before environment variables and
+	// command-line flags are parsed, so those take precedence. Values are
+	// converted the same way as command-line values (e.g. a time.Duration is a
+	// string such as "10s"), and an array may be used for slice fields.
+	ConfigFile string
+
+	// ConfigFlag, if not empty, is the canonical name of a string flag that
+	// overrides ConfigFile, so that the user can select the config file, e.g.
+	// with `flag:"config" env:"CONFIG"`. The path is resolved before the
+	// config file is read, from the flag if it is set in args, otherwise from
+	// its environment variable if EnvVars is true and it is set and not empty,
+	// otherwise ConfigFile is used (which may be empty, in which case no
+	// config file is read). The values are then parsed as usual. If
+	// AllowFileValues or AllowFDValues is set, the path set by the flag is
+	// resolved the same way as any flag value, e.g. -config fd:3 reads the
+	// path of the config file from file descriptor 3. It panics if the flag
+	// is not defined on a string field.
+	ConfigFlag string
+
+	// ConfigDecoder is the decoder used to decode the ConfigFile. If it is
+	// nil, the config file is decoded as JSON.
+	ConfigDecoder ConfigDecoder
+
+	// IgnoreUnknownConfigKeys indicates if keys of the config file that do not
+	// correspond to a flag are ignored. If false, such a key is an error.
+	IgnoreUnknownConfigKeys bool
+
+	// OnUnknownEnv, if not nil, is called with the name of each environment
+	// variable that starts with the environment variables prefix but does not
+	// correspond to any field, in lexical order. It is only called when EnvVars
+	// is true and the prefix is not empty (otherwise all environment variables
+	// would be candidates), and it is called after the environment variables
+	// were successfully parsed. This can be used to log unexpected (e.g.
+	// misspelled) variables.
+	OnUnknownEnv func(name string)
+
+	// AllowUnknown indicates if flags that are not defined are collected
+	// instead of causing an error. If the flag is not of the form -flag=value
+	// and the next argument does not start with a dash, that argument is
+	// assumed to be the unknown flag's value and is collected too (as there is
+	// no way to know for sure if an unknown flag expects a value). The
+	// collected arguments are reported via the SetUnknown hook.
+	AllowUnknown bool
+
+	// AllowGluedValues indicates if the value of a non-boolean flag may be
+	// glued to the flag's name, as supported by some legacy tools (e.g.
+	// -I/usr/include for the -I flag). When a flag provided in args is not
+	// defined and is not of the form -flag=value, the longest defined
+	// non-boolean flag name that is a prefix of it is used as flag, and the
+	// remainder as its value. Because flag names are unique, the longest
+	// matching name is never ambiguous, e.g. with -I and -Inc defined, -Incx
+	// sets -Inc to "x". Defined flags and boolean clusters take precedence.
+	AllowGluedValues bool
+
+	// AllowPrefixMatch indicates if a flag provided in args may be any
+	// unambiguous prefix of a defined long (multi-character) flag name, e.g.
+	// -ver for -version. A defined flag always takes precedence (so with -v
+	// and -verbose defined, -v is never a prefix), and the prefix matching is
+	// applied before boolean clusters and glued values are expanded. A prefix
+	// that matches many distinct flags is an error of kind ErrUnknownFlag that
+	// lists the candidates.
+	AllowPrefixMatch bool
+
+	// StopAtFirstArg indicates if flag parsing stops at the first non-flag
+	// argument, instead of parsing the flags interspersed with the arguments.
+	// That argument and all the following ones are then returned untouched as
+	// non-flag arguments (e.g. via SetArgs), including any flag or "--" they
+	// contain. This is typically used to dispatch the remaining arguments to
+	// a subcommand with its own flags, e.g. for "app -v server -port 80",
+	// only -v is parsed and the arguments are [server -port 80].
+	StopAtFirstArg bool
+
+	// HelpFlags is the list of names of the help flags, which skip the
+	// mutually exclusive groups check when set so that the help can always be
+	// requested. It defaults to "h" and "help" if it is nil. Note that the
+	// help flags must still be defined on v like any other flag, and that
+	// -h and -help are reported as unknown flags if they are not defined,
+	// regardless of this list.
+	HelpFlags []string
+
+	// StdinArgsSentinel, if not empty, is the positional argument that is
+	// replaced by the lines read from Stdin, e.g. "-" to support xargs-style
+	// piping of the arguments. Empty lines are skipped and only the first
+	// occurrence of the sentinel is replaced (Stdin can only be read once),
+	// the others are left as-is. Stdin is not read if the sentinel is not
+	// provided. A parse that reads Stdin is never cached.
+	StdinArgsSentinel string
+
+	// Stdin is the reader of the lines that replace StdinArgsSentinel. If it
+	// is nil, os.Stdin is used.
+	Stdin io.Reader
+
+	// AllowFileValues indicates if the value of a string or TextUnmarshaler
+	// flag may be read from a file, e.g. -token @/run/secrets/token sets the
+	// flag to the contents of that file, with the leading and trailing white
+	// space trimmed. A value that starts with "@@" is an escaped literal "@",
+	// e.g. -handle @@mna sets the flag to "@mna". A file that cannot be read
+	// is an error of kind ErrInvalidValue. A parse that may read a file is
+	// never cached.
+	AllowFileValues bool
+
+	// AllowFDValues indicates if the value of a string or TextUnmarshaler
+	// flag may be read from an inherited file descriptor, e.g. as passed by a
+	// process supervisor: -token fd:3 sets the flag to the contents read from
+	// file descriptor 3, with the leading and trailing white space trimmed.
+	// Each descriptor is read only once per parse, even if many flags refer
+	// to it. A value that starts with "fd::" is an escaped literal "fd:",
+	// e.g. -label fd::x sets the flag to "fd:x". An invalid descriptor number
+	// or a descriptor that cannot be read is an error of kind
+	// ErrInvalidValue. A parse that may read a descriptor is never cached.
+	AllowFDValues bool
+
+	// AllowArgsFiles indicates if an argument of the form @path (a "response
+	// file") is replaced by the arguments read from that file before parsing,
+	// e.g. to work around command-line length limits. The arguments in the
+	// file are separated by white space, including newlines, and may be
+	// quoted with single or double quotes (where a double-quoted argument may
+	// contain \" and \\ escapes, and outside quotes a backslash escapes the
+	// next character). An args file may contain @path arguments, which are
+	// expanded recursively, relative paths being relative to the working
+	// directory; an args file that includes itself, directly or not, is an
+	// error. An argument that starts with "@@" is an escaped literal "@" and
+	// is not expanded. If AllowFileValues is also set, a standalone @path
+	// argument is always an args file, so a flag value read from a file must
+	// use the -flag=@path form. A file that cannot be read is an error of
+	// kind ErrInvalidValue.
+	AllowArgsFiles bool
+
+	// ReadFile is the function used to read the files of AllowFileValues and
+	// AllowArgsFiles. If it is nil, os.ReadFile is used.
+	ReadFile func(name string) ([]byte, error)
+
+	// OpenFD is the function used to open the file descriptors of
+	// AllowFDValues. The returned reader is closed once it is read. If it
+	// is nil, os.NewFile is used.
+	OpenFD func(fd int) (io.ReadCloser, error)
+
+	// Usage is the writer where the usage text is printed if PrintUsageOnError
+	// is true. If it is nil, nothing is printed.
+	Usage io.Writer
+
+	// CollectAllErrors indicates if parsing continues after an error so that
+	// all errors are reported at once, joined with errors.Join: invalid and
+	// unknown flags, environment variables errors, mutually exclusive and
+	// required flags, positional arguments and validation errors (config file
+	// errors still stop the parsing). If v has a ValidateAll() []error method,
+	// it is called instead of Validate so that it can report many validation
+	// errors. If only one error occurs, it is returned as-is. Note that an
+	// unknown flag's value, if any, is then treated as a positional argument.
+	CollectAllErrors bool
+
+	// Validator, if not nil, is called with the parsed value before its
+	// Validate method, e.g. to validate the fields based on struct tags. The
+	// ValidateTags function provides a minimal implementation, and a wrapper
+	// around a more complete package can be used too. Its error is returned
+	// as a *ParseError of kind ErrValidation, unless it is a *ParseError
+	// already.
+	Validator func(v interface{}) error
+
+	// Cache, if not nil, is used to cache the successful parses, so that
+	// parsing the same args again (with the same environment variables and
+	// config file) copies the cached parsed value instead. See ParseCache for
+	// details. It is not used by ParseEnvOnly.
+	Cache *ParseCache
+
+	// Debug is the writer where a step-by-step trace of the parsing is
+	// written, if it is not nil. This is meant to diagnose the precedence of
+	// the various sources of values: the initial value of each flag field,
+	// the values set by the config file, the environment variables, the
+	// command-line flags and the positional arguments, and the outcome of the
+	// validation. The format of the trace is not guaranteed to be stable. The
+	// values of the fields with a "secret" or "sensitive" struct tag set to
+	// true are displayed as ****.
+	Debug io.Writer
+
+	// Warnings is the writer where a warning line is written for each
+	// deprecated flag (see the "deprecated" struct tag) explicitly set in the
+	// args. If it is nil, the warnings are not written. They are not written
+	// either on a Cache hit.
+	Warnings io.Writer
+
+	// PrintUsageOnError indicates if the usage text, as generated by
+	// WriteUsage, is printed to Usage when Parse fails. It is not printed if
+	// the error is returned by the Validate method.
+	PrintUsageOnError bool
+
+	// converters holds the converters registered with RegisterConverter.
+	converters converters
+
+	// skipValidation is set by ParseNoValidate to skip the validation step.
+	skipValidation bool
+
+	// readFD is the reader of the file descriptors of AllowFDValues, shared
+	// for the duration of a parse so that each descriptor is read only once.
+	readFD func(string) (string, error)
+}
+
+// Parse parses args into v, using struct tags to detect flags. Note that the
+// args slice should start with the program name (as is the case for `os.Args`,
+// which is typically used). The tag must be named "flag" and multiple flags
+// may be set for the same field using a comma-separated list.
+//
+// v must be a pointer to a struct and the flags must be defined on exported
+// fields with one of those types:
+//   - string
+//   - int/int8/int16/int32/int64
+//   - uint/uint8/uint16/uint32/uint64
+//   - float32/float64
+//   - bool
+//   - time.Duration
+//   - a type that directly implements flag.Value, or a type T that
+//     implements it on *T (a pointer to the type), in which case it is used
+//     as-is
+//   - a type that directly implements encoding.TextUnmarshaler, or a type T
+//     that implements it on *T (a pointer to the type); if it also implements
+//     encoding.TextMarshaler, it is used to display the default value in the
+//     usage, otherwise it is formatted with the fmt package (e.g. using its
+//     String method)
+//   - a type that has a converter registered with Parser.RegisterConverter
+//   - a slice of any of those types
+//
+// Integer flag values may use a base prefix, e.g. 0x1f, 0o17 (or 017) and
+// 0b101, as supported by strconv.ParseInt with a base of 0. This does not
+// apply to environment variables, which are parsed in base 10 by the env
+// package.
+//
+// For slices, by default a new value is appended each time the flag is
+// encountered. This behaviour can be altered by adding a "flagSeparator"
+// struct tag to the field, in addition to the "flag" one, e.g.:
+//
+//	type S struct {
+//	  Name []string `flag:"name" flagSeparator:","`
+//	}
+//
+// This causes the field to be filled with a single flag value being set, and
+// that value is split on the provided separator. See Parser.OverwriteSlices
+// for how slice values are combined with those set by the environment
+// variables or the config file.
+//
+// If Parser.ConfigFile is set (or a path is provided via the flag or
+// environment variable of Parser.ConfigFlag), flag values are initialized
+// from that file first. Then if Parser.EnvVars is true, flag values are
+// initialized from corresponding environment variables, as defined by the
+// github.com/caarlos0/env/v6 package (which is used for environment
+// parsing). The command-line flags are parsed last, so they take precedence.
+//
+// The values of environment variables for integer and float fields (or
+// their slices) may use underscores between digits for readability, e.g.
+// PROG_MAX=1_000_000. Other fields, such as strings, are left untouched.
+//
+// A field with an "env" struct tag but no "flag" tag can only be set by its
+// environment variable, which is useful for secrets that should not be
+// visible in the process listing, e.g.:
+//
+//	type S struct {
+//	  Token string `env:"TOKEN,required" usage:"API token"`
+//	}
+//
+// If such a variable is marked as required and is not set, an error of kind
+// ErrRequired is returned, as for any required environment variable, and
+// the field is listed in the usage text as "(env only)".
+//
+// A slice field can also be read from indexed environment variables, as
+// some orchestrators expose lists, by adding the `envindexed:"true"` struct
+// tag, e.g.:
+//
+//	type S struct {
+//	  Hosts []string `flag:"host" env:"HOST" envindexed:"true"`
+//	}
+//
+// The values of PROG_HOST_0, PROG_HOST_1 and so on are collected up to the
+// first missing index, and if there is at least one, they replace the value
+// set by PROG_HOST, if any. This only applies to the top-level fields of v.
+//
+// The value of the environment variable of a []string field is split on
+// commas (or on its "envSeparator" struct tag or Parser.EnvSliceSeparator),
+// which is not suitable for values such as JSON documents or paths that may
+// contain commas. Adding the `envsep:"none"` struct tag to such a field sets
+// it to a single element holding the whole value instead, e.g.:
+//
+//	type S struct {
+//	  Filters []string `flag:"filter" env:"FILTER" envsep:"none"`
+//	}
+//
+// This only applies to the top-level fields of v, and indexed environment
+// variables still take precedence. It panics if the tag is set on a field
+// of another type, or with a value other than "none".
+//
+// A field can list fallback names for its environment variable in the
+// "envfallback" struct tag, separated by commas, e.g. to keep accepting the
+// legacy name of a renamed variable:
+//
+//	type S struct {
+//	  DB string `flag:"db" env:"DB" envfallback:"OLD_DB"`
+//	}
+//
+// If PROG_DB is not set, the first of the fallback variables that is set
+// (with the prefix applied, i.e. PROG_OLD_DB) is used instead. The name in
+// the "env" struct tag remains the canonical one, e.g. in the usage text.
+// The fallbacks are not a list of names in the "env" struct tag because the
+// env package reserves the comma for its options. They do not apply to the
+// indexed environment variables. It panics if the tag is set on a field
+// without an environment variable.
+//
+// A bool field can define a negated form of its flag by adding the same flag
+// name prefixed with "no-" to its list of flags, e.g.:
+//
+//	type S struct {
+//	  Verbose bool `flag:"v,verbose,no-verbose"`
+//	}
+//
+// The -no-verbose flag sets the field to false (and -no-verbose=false sets it
+// to true). As for any alias, it is reported under the canonical name by
+// SetFlags and SetFlagsCount, and the last flag provided wins.
+//
+// An integer field can be defined as a counter by adding the "count" option
+// to its list of flags, e.g.:
+//
+//	type S struct {
+//	  Verbosity int `flag:"v,count"`
+//	}
+//
+// Such a flag does not take a value (like a bool flag) and each occurrence of
+// the flag increments the field by one. Note that as a consequence, "count"
+// cannot be used as a flag name. It panics if the option is set on a
+// non-integer field.
+//
+// Flags can be declared mutually exclusive by adding the same "group=NAME"
+// option to their list of flags, e.g.:
+//
+//	type S struct {
+//	  JSON bool `flag:"json,group=format"`
+//	  YAML bool `flag:"yaml,group=format"`
+//	}
+//
+// If more than one distinct flag of the same group is explicitly set by args
+// (as reported by SetFlags, so aliases and repeated flags count as one), an
+// error of kind ErrExclusive is returned. The check is skipped if a help
+// flag (see Parser.HelpFlags) or a flag named "version" is set, so that the
+// help or version can still be requested.
+//
+// A flag can require other flags by adding a "requires=NAME" option to its
+// list of flags for each prerequisite, e.g.:
+//
+//	type S struct {
+//	  TLS     bool   `flag:"tls"`
+//	  TLSCert string `flag:"tls-cert,requires=tls"`
+//	}
+//
+// If the flag has a value from any source (args, environment variables or
+// config file, as reported by SetFlagSources) but one of its prerequisites
+// does not, an error of kind ErrRequired is returned. It panics if a
+// prerequisite is not a defined flag.
+//
+// Boolean flags (including counters) with single-character names can be
+// combined after a single dash, e.g. -abc is the same as -a -b -c if a, b and
+// c are all defined as boolean flags and abc is not a defined flag.
+//
+// If the type of a field implements a SkipOnPlatform() bool method (on the
+// type or on a pointer to the type) that returns true, the flags of that
+// field are not defined, as if the field had no "flag" struct tag. This
+// can be used for platform-specific configuration, where the method's
+// implementation is guarded by build tags. Note that this does not apply to
+// environment variables parsing.
+//
+// The fields of an exported embedded struct (or non-nil pointer to a
+// struct) that has no "flag" struct tag define flags too, so that flags can
+// be grouped in reusable structs, e.g.:
+//
+//	type TLSConfig struct {
+//	  Cert string `flag:"tls-cert" env:"TLS_CERT"`
+//	  Key  string `flag:"tls-key" env:"TLS_KEY"`
+//	}
+//
+//	type S struct {
+//	  TLSConfig
+//	  Addr string `flag:"addr"`
+//	}
+//
+// Embedded structs are recursed into, as is done by the env package for the
+// environment variables, and the same flag name defined more than once
+// panics, wherever the fields are defined.
+//
+// A named struct field (or non-nil pointer to a struct) with a "flagprefix"
+// struct tag and no "flag" tag is recursed into too, with that prefix added
+// to the names of its flags (after the "no-" of a negated name) and of the
+// flags required by its fields. This allows using the same struct more than
+// once, e.g.:
+//
+//	type S struct {
+//	  Primary DBConfig `flagprefix:"primary-" envPrefix:"PRIMARY_"`
+//	  Replica DBConfig `flagprefix:"replica-" envPrefix:"REPLICA_"`
+//	}
+//
+// The prefix is part of the canonical name of the flags, as passed to the
+// SetFlags method. The names of the environment variables of nested structs
+// are prefixed by the env package's "envPrefix" struct tag, so it should
+// usually be set along with "flagprefix".
+//
+// Flags and arguments can be interspersed (unless Parser.StopAtFirstArg is
+// set), but flag parsing stops if it encounters the "--" value; all
+// subsequent values are treated as arguments. That first "--" is removed,
+// while any subsequent one is kept as an argument. A "--" that is the value
+// of a non-boolean flag (e.g. -s --) is not a terminator.
+//
+// Positional arguments can be bound to fields with the "arg" struct tag,
+// which specifies the index of the argument, e.g.:
+//
+//	type S struct {
+//	  Src  string   `arg:"0"`
+//	  Dst  string   `arg:"1"`
+//	  Rest []string `arg:"2..."`
+//	}
+//
+// The values are converted the same way as flags. The indices must start at
+// 0 and be contiguous, and the last field may be a variadic slice that
+// collects all remaining arguments (possibly none). Every other field is
+// required, and if no field is variadic, it is an error to provide more
+// arguments than there are fields. The SetArgs hook still receives all
+// arguments. It panics if the tags are invalid.
+//
+// After parsing, if Parser.Validator is set it is called, and then if v
+// implements a Validate method that returns an error, it is called and any
+// non-nil error is returned as error. See ParseContext for the
+// ValidateContext alternative.
+//
+// Errors are returned as *ParseError values (unless the Validate method
+// already returned a *ParseError), so that callers can use errors.As to
+// inspect the kind of failure. The error message is the same as the one of
+// the wrapped error.
+//
+// The allowed values of a string or slice of strings field can be set with
+// the "choices" struct tag, as a comma-separated list, e.g.:
+//
+//	type S struct {
+//	  Level string `flag:"level" choices:"debug,info,warn,error"`
+//	}
+//
+// Any other value (or element, for a slice) set by args, the config file or
+// the environment variables is an error of kind ErrInvalidValue, e.g.
+// "invalid value "foo" for flag -level: must be one of debug, info, warn,
+// error". If the `choicesIgnoreCase:"true"` struct tag is set too, the case
+// of the value is ignored and the field is set with the case of the matching
+// choice. The choices are listed in the usage text. It panics if the tag is
+// set on a field of any other type.
+//
+// The inclusive bounds of a numeric field (or of each element of a slice of
+// numbers) can be set with the "min" and "max" struct tags, e.g.:
+//
+//	type S struct {
+//	  Port    int           `flag:"port" min:"1" max:"65535"`
+//	  Timeout time.Duration `flag:"timeout" max:"1m"`
+//	}
+//
+// A value out of bounds set by args, the config file or the environment
+// variables is an error of kind ErrInvalidValue, e.g. "invalid value "0"
+// for flag -port: value out of range: must be between 1 and 65535". The
+// bounds are listed in the usage text. It panics if the tags are set on a
+// non-numeric field or if a bound is invalid.
+//
+// An integer field (or slice of integers) that holds a number of bytes can
+// accept a size suffix by adding the `size:"true"` struct tag, e.g.:
+//
+//	type S struct {
+//	  MaxSize int64 `flag:"max-size" size:"true"`
+//	}
+//
+// The value is then a decimal integer optionally followed by a
+// case-insensitive suffix: B, KB, MB, GB and TB are powers of 1000 (as
+// for SI units), while KiB, MiB, GiB and TiB are powers of 1024, so that
+// -max-size 10MB sets 10000000 and -max-size 2GiB sets 2147483648. A value
+// without a suffix is parsed as any integer, and an invalid value is an
+// error of kind ErrInvalidValue. The min and max struct tags, if any, are
+// in bytes. This applies to args and the config file, but not to
+// environment variables, which are parsed by the env package. It panics if
+// the tag is set on a non-integer field.
+//
+// Similarly, a float field (or slice of floats) that holds a ratio can be
+// set as a percentage by adding the `percent:"true"` struct tag, e.g.:
+//
+//	type S struct {
+//	  SampleRate float64 `flag:"sample-rate" percent:"true"`
+//	}
+//
+// A value with a trailing "%" is divided by 100, so that -sample-rate 25%
+// and -sample-rate 0.25 both set 0.25. The convention is indicated in the
+// usage text. As for sizes, this does not apply to environment variables,
+// and it panics if the tag is set on a non-float field.
+//
+// A flag can be marked as deprecated with the "deprecated" struct tag, which
+// holds the migration hint, e.g.:
+//
+//	type S struct {
+//	  OldName string `flag:"old-name" deprecated:"use -new-name"`
+//	}
+//
+// The flag still sets the field, but if it is explicitly set in the args, a
+// warning such as "flag -old-name is deprecated: use -new-name" is written
+// to Parser.Warnings, under the name used in the args.
+//
+// If v has a SetArgs([]string) method, it is called with the list of non-flag
+// arguments (a slice of strings) that respects the provided order.
+//
+// If v has a SetUnknown([]string) method, it is called with the list of
+// unknown flags (and their values) that were collected when
+// Parser.AllowUnknown is true, in the provided order.
+//
+// If v has a SetFlags(map[string]bool) method, it is called with the set of
+// flags that were explicitly set by args (a map[string]bool). Note that if a
+// field can be set with multiple flags, the key is canonicalized to the first
+// flag defined on the field.
+//
+// If v has a SetFlagsCount(map[string]int) method, it is called with the map
+// of flags that were explicitly set by args, and the associated value is the
+// number of times the flag was provided. As for SetFlags, the key is
+// canonicalized to the first flag defined on the field.
+//
+// If v has a SetFlagsCountByName(map[string]int) method, it is called with
+// the same counts as SetFlagsCount, but keyed by the name of the flag that
+// was actually used instead of the canonical one, so that e.g. -v and
+// -verbose are reported separately. The name is the one of the defined flag,
+// e.g. after prefix matching or normalization. Both methods can be
+// implemented.
+//
+// Config file and environment variables parsing have no effect on the values
+// reported by SetFlags, SetFlagsCount and SetFlagsCountByName, only the
+// actual flags parsed from the args.
+//
+// If v has a SetDefaultsForFlags(map[string]bool) method, it is called first,
+// with the set of flags that are explicitly set by args (as reported by
+// SetFlags, but determined without altering v). At that point, no value has
+// been stored in v yet, so the method can adjust the default values of the
+// fields based on the provided flags, e.g. a -production flag could change
+// the default log level. The config file, environment variables (including
+// the "envDefault" struct tags) and command-line flags are then applied, in
+// that order, so they take precedence over the adjusted defaults. If the
+// args contain errors, the set holds the flags that could be parsed, and the
+// errors are reported as usual by the actual parsing.
+//
+// If v has a SetVersionRequested(string) method and the field that defines
+// the "version" flag (e.g. `flag:"v,version"`) is explicitly set by args (to
+// true, for a bool field), it is called with the version returned by the
+// Version() string method of v, or an empty string if v has no such method.
+// This standardizes the handling of the version flag, so that the command
+// can print the version and exit.
+//
+// If v has a SetFlagSources(map[string]FlagSource) method, it is called with
+// the source of the value of each flag, keyed by the canonical flag name. A
+// flag explicitly set by args has the SourceFlag source even if it was also
+// set by an environment variable. A flag's field set via the "envDefault"
+// struct tag has the SourceDefault source.
+//
+// If v has a SetRequiredSources(map[string]string) method, it is called with
+// the source of each required flag that is satisfied, keyed by the canonical
+// flag name: "flag", "env" or "config", as returned by FlagSource.String. A
+// flag is required if its environment variable is marked as required (e.g.
+// `flag:"addr" env:"ADDR,required"`), or if it is a prerequisite (see the
+// "requires=" option) of a flag that has a value. Like SetFlagSources, it is
+// not called if the flags cannot be parsed or a requirement is not met.
+//
+// It panics if v is not a pointer to a struct or if its definition is
+// invalid, as reported by ValidateDefinition (e.g. if a flag is defined with
+// an unsupported type), regardless of the args.
+func (p *Parser) Parse(args []string, v interface{}) error {
+	return p.ParseContext(context.Background(), args, v)
+}
+
+// MustParse is like Parse, but it panics with the error instead of returning
+// it. This is meant for quick scripts and tests, where a parse error is
+// fatal anyway.
+func (p *Parser) MustParse(args []string, v interface{}) {
+	if err := p.Parse(args, v); err != nil {
+		panic(err)
+	}
+}
+
+// ParseNoValidate is like Parse, but it skips the validation step: neither
+// Parser.Validator nor the Validate (or ValidateContext, or ValidateAll)
+// method of v is called. Everything else is done as for Parse, including
+// the Set hooks of v and the checks of required and mutually exclusive
+// flags. This allows to inspect the parsed values before validation, e.g.
+// to print the help when a help flag is set even if other flags are
+// invalid. Parse is equivalent to ParseNoValidate followed by the
+// validation. The Parser.Cache is not used, so that a parse that was not
+// validated is never returned by Parse.
+func (p *Parser) ParseNoValidate(args []string, v interface{}) error {
+	np := *p
+	np.Cache = nil
+	np.skipValidation = true
+	return np.Parse(args, v)
+}
+
+// ParseContext is like Parse, but if v has a ValidateContext(context.Context)
+// error method, it is called with ctx instead of the Validate method, so that
+// a validation that does I/O (e.g. to check that a service is reachable) can
+// respect the cancellation and deadline of ctx. If v has both methods, only
+// ValidateContext is called, by Parse and ParseContext alike (Parse calls it
+// with context.Background()). If Parser.CollectAllErrors is true and v has a
+// ValidateAll method, it takes precedence over both.
+func (p *Parser) ParseContext(ctx context.Context, args []string, v interface{}) error {
+	_, _, err := p.parseWithUsage(ctx, args, v)
+	return err
+}
+
+// Result holds aggregate information about the flags and arguments parsed by
+// ParseResult, e.g. for metrics purposes. As for SetFlags and
+// SetFlagsCount, only the flags parsed from the args are considered.
+type Result struct {
+	// FlagsSet is the number of distinct flags explicitly set by args. As for
+	// SetFlags, aliases of the same flag are counted only once.
+	FlagsSet int
+
+	// FlagsCount is the total number of flag occurrences in args.
+	FlagsCount int
+
+	// ArgsCount is the number of non-flag arguments.
+	ArgsCount int
+}
+
+// ParseResult is like Parse, but it also returns a Result that holds
+// aggregate counts of the parsed flags and arguments. The Result is valid
+// even if an error is returned by the Validate method of v, but it is the
+// zero value for any other error.
+func (p *Parser) ParseResult(args []string, v interface{}) (Result, error) {
+	res, _, err := p.parseWithUsage(context.Background(), args, v)
+	return res, err
+}
+
+// ParseArgs is like Parse, but it also returns the non-flag arguments, in
+// the order they appear in args. This avoids having to implement SetArgs on
+// v for simple commands, although SetArgs is still called if v implements
+// it. As for ParseResult, the arguments are returned even if an error is
+// returned by the Validate method of v, but they are nil for any other
+// error.
+func (p *Parser) ParseArgs(args []string, v interface{}) (positional []string, err error) {
+	_, positional, err = p.parseWithUsage(context.Background(), args, v)
+	return positional, err
+}
+
+func (p *Parser) parseWithUsage(ctx context.Context, args []string, v interface{}) (Result, []string, error) {
+	if !p.PrintUsageOnError || p.Usage == nil {
+		return p.parse(ctx, args, v)
+	}
+
+	// generate the usage before parsing, so that the defaults are not
+	// altered by the parsed values.
+	usage := p.usage(p.programName(args), v)
+
+	res, nonFlags, err := p.parse(ctx, args, v)
+	var pe *ParseError
+	if err != nil && !(errors.As(err, &pe) && pe.Kind == ErrValidation) {
+		_, _ = io.WriteString(p.Usage, usage)
+	}
+	return res, nonFlags, err
+}
+
+func (p *Parser) parse(ctx context.Context, args []string, v interface{}) (Result, []string, error) {
+	if err := p.ValidateDefinition(v); err != nil {
+		panic(err.Error())
+	}
+
+	if p.AllowArgsFiles {
+		var err error
+		if args, err = p.expandArgsFiles(args); err != nil {
+			return Result{}, nil, err
+		}
+	}
+
+	if p.Cache == nil {
+		return p.parseValues(ctx, args, v)
+	}
+
+	key, ok := p.cacheKey(args, v)
+	if !ok {
+		return p.parseValues(ctx, args, v)
+	}
+	if res, nonFlags, ok := p.Cache.get(key, v); ok {
+		p.debugf("parse cache hit")
+		return res, nonFlags, nil
+	}
+
+	initial := copyStruct(reflect.ValueOf(v).Elem())
+	res, nonFlags, err := p.parseValues(ctx, args, v)
+	if err == nil {
+		p.Cache.add(key, initial, v, res, nonFlags)
+	}
+	return res, nonFlags, err
+}
+
+func (p *Parser) parseValues(ctx context.Context, args []string, v interface{}) (Result, []string, error) {
+	if p.AllowFDValues && p.readFD == nil {
+		// the descriptors are read once per parse, by the config flag or the
+		// flags, so the reader is shared for the rest of the parse.
+		pp := *p
+		pp.readFD = p.fdReader()
+		p = &pp
+	}
+
+	if sdf, ok := v.(interface{ SetDefaultsForFlags(map[string]bool) }); ok {
+		sdf.SetDefaultsForFlags(p.flagsSetBy(args, v))
+	}
+	p.debugDefaults(v)
+
+	// errs collects the errors if CollectAllErrors is set, fatal is true if
+	// any of them is not a validation error.
+	var (
+		errs  []error
+		fatal bool
+	)
+	fail := func(err error) bool {
+		errs = appendErrors(errs, err)
+		fatal = true
+		return !p.CollectAllErrors
+	}
+
+	var configSet map[string]bool
+	path, err := p.configFilePath(args, v)
+	if err != nil {
+		return Result{}, nil, err
+	}
+	if path != "" {
+		if configSet, err = p.parseConfigFile(path, v); err != nil {
+			return Result{}, nil, err
+		}
+	}
+
+	var envSet map[string]bool
+	if p.EnvVars {
+		var err error
+		if envSet, err = p.parseEnvVars(args, v); err != nil && fail(newEnvError(err)) {
+			return Result{}, nil, errs[0]
+		}
+	}
+
+	res, nonFlags, flagSet, err := p.parseFlags(args, v)
+	if err != nil && fail(err) {
+		return Result{}, nil, err
+	}
+	if err := p.checkGroups(v, flagSet); err != nil && fail(err) {
+		return Result{}, nil, err
+	}
+	sources := p.flagSources(args, v, configSet, envSet, flagSet)
+	if err := p.checkRequires(v, sources); err != nil && fail(err) {
+		return Result{}, nil, err
+	}
+	if err := p.setArgValues(nonFlags, v); err != nil && fail(err) {
+		return Result{}, nil, err
+	}
+
+	if !fatal {
+		if sfs, ok := v.(interface{ SetFlagSources(map[string]FlagSource) }); ok {
+			sfs.SetFlagSources(sources)
+		}
+		if srs, ok := v.(interface{ SetRequiredSources(map[string]string) }); ok {
+			srs.SetRequiredSources(p.requiredSources(v, sources))
+		}
+	}
+
+	if !p.skipValidation {
+		errs = appendErrors(errs, p.debugValidation(p.runValidation(ctx, v)))
+	}
+	if fatal {
+		return Result{}, nil, joinErrors(errs)
+	}
+	return res, nonFlags, joinErrors(errs)
+}
+
+// ParseEnvOnly parses the environment variables into v and calls its
+// Validate method if it has one, without parsing any command-line arguments.
+// The progName is used to derive the environment variables prefix if
+// Parser.EnvPrefix and Parser.ProgramName are empty, as is done by Parse
+// with the program name in args[0]. Environment variables are parsed
+// regardless of the value of Parser.EnvVars. None of the Set hooks of v are
+// called.
+//
+// This is useful for services that are configured only via the environment.
+// Errors are returned as *ParseError values, as for Parse.
+func (p *Parser) ParseEnvOnly(progName string, v interface{}) error {
+	if _, err := p.parseEnvVars([]string{progName}, v); err != nil {
+		return newEnvError(err)
+	}
+	return p.debugValidation(p.runValidation(context.Background(), v))
+}
+
+// Register registers the flags defined by v on fs, without parsing anything,
+// so that they can be combined with flags added manually to fs. The caller
+// is then responsible for calling fs.Parse. v must be a pointer to a struct
+// with the same requirements as for Parse; the flags set the fields of v
+// directly, with the same conversions, slice handling (including
+// Parser.OverwriteSlices and flagSeparator), converters and choices and
+// range checks as Parse. The usage of each flag is set from its "usage"
+// struct tag.
+//
+// Only the flags are handled: environment variables, config files,
+// positional args and the hooks of v (e.g. Validate or SetFlags) are not.
+// It returns a map where the key is a flag name and the value is its
+// canonical name (the first name defined on the field). It returns the
+// definition errors of v as reported by ValidateDefinition, or an error if
+// a flag is already defined in fs, in which case fs is left unchanged.
+func (p *Parser) Register(fs *flag.FlagSet, v interface{}) (map[string]string, error) {
+	if err := p.ValidateDefinition(v); err != nil {
+		return nil, err
+	}
+
+	fields := p.flagFields(v)
+	for _, ff := range fields {
+		for _, nm := range ff.names {
+			if fs.Lookup(nm) != nil {
+				return nil, fmt.Errorf("flag redefined: %s", nm)
+			}
+		}
+	}
+
+	canonLookup := registerFlags(fs, fields, p.OverwriteSlices, p.converters)
+	for _, ff := range fields {
+		usage := ff.field.Tag.Get("usage")
+		for _, nm := range ff.names {
+			fs.Lookup(nm).Usage = usage
+		}
+	}
+	return canonLookup, nil
+}
+
+// runValidation calls Parser.Validator if it is set and then the
+// ValidateContext or Validate method of v, if it has one. If
+// Parser.CollectAllErrors is true, the ValidateAll method is used if v has
+// one, and the errors of both steps are joined, otherwise the first error is
+// returned.
+func (p *Parser) runValidation(ctx context.Context, v interface{}) error {
+	var errs []error
+	if p.Validator != nil {
+		if err := p.Validator(v); err != nil {
+			if !p.CollectAllErrors {
+				return newValidationError(err)
+			}
+			errs = append(errs, newValidationError(err))
+		}
+	}
+
+	if p.CollectAllErrors {
+		errs = appendErrors(errs, validateAll(ctx, v))
+	} else {
+		errs = appendErrors(errs, validate(ctx, v))
+	}
+	return joinErrors(errs)
+}
+
+// validate calls the ValidateContext method of v if it has one, otherwise
+// its Validate method if it has one.
+func validate(ctx context.Context, v interface{}) error {
+	if val, ok := v.(interface{ ValidateContext(context.Context) error }); ok {
+		if err := val.ValidateContext(ctx); err != nil {
+			return newValidationError(err)
+		}
+		return nil
+	}
+	if val, ok := v.(interface{ Validate() error }); ok {
+		if err := val.Validate(); err != nil {
+			return newValidationError(err)
+		}
+	}
+	return nil
+}
+
+// validateAll is like validate, but if v has a ValidateAll() []error method,
+// it is called instead of ValidateContext and Validate and all its errors
+// are returned, joined.
+func validateAll(ctx context.Context, v interface{}) error {
+	val, ok := v.(interface{ ValidateAll() []error })
+	if !ok {
+		return validate(ctx, v)
+	}
+
+	var errs []error
+	for _, err := range val.ValidateAll() {
+		if err != nil {
+			errs = append(errs, newValidationError(err))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// FlagSource indicates where the value of a flag comes from.
+type FlagSource int
+
+// List of flag sources.
+const (
+	// SourceDefault indicates that the flag's field was left untouched by the
+	// parser, so it has its default value.
+	SourceDefault FlagSource = iota
+
+	// SourceEnv indicates that the flag's value was set by an environment
+	// variable.
+	SourceEnv
+
+	// SourceFlag indicates that the flag's value was set by a command-line
+	// flag.
+	SourceFlag
+
+	// SourceConfig indicates that the flag's value was set by the config
+	// file.
+	SourceConfig
+)
+
+func (s FlagSource) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceEnv:
+		return "env"
+	case SourceFlag:
+		return "flag"
+	case SourceConfig:
+		return "config"
+	default:
+		return fmt.Sprintf("FlagSource(%d)", int(s))
+	}
+}
+
+// flagSources returns the source of each flag defined by v, keyed by the
+// canonical flag name.
+func (p *Parser) flagSources(args []string, v interface{}, configSet, envSet, flagSet map[string]bool) map[string]FlagSource {
+	prefix := p.envPrefix(args)
+	fields := p.flagFields(v)
+	sources := make(map[string]FlagSource, len(fields))
+	for _, ff := range fields {
+		src := SourceDefault
+		switch canon := ff.names[0]; {
+		case flagSet[canon]:
+			src = SourceFlag
+		case envSet[envVarName(prefix+ff.envPrefix, ff.field)]:
+			src = SourceEnv
+		case configSet[canon]:
+			src = SourceConfig
+		}
+		sources[ff.names[0]] = src
+	}
+	return sources
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+type nopValue struct{}
+
+func (nopValue) Set(s string) error { return nil }
+func (nopValue) String() string     { return "" }
+
+// valueSetter wraps a flag's Value with one that calls a setter func when the
+// flag is set. Other flag.Value methods are the same as the wrapped Value.
+type valueSetter struct {
+	flag.Value
+	setter func(string) error
+	isBool bool
+}
+
+func (v valueSetter) Set(s string) error {
+	return v.setter(s)
+}
+
+func (v valueSetter) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// errParse and errRange are the same errors as those returned by the stdlib's
+// flag package for numeric values, so that the sized numeric types behave
+// consistently with the natively supported ones.
+var (
+	errParse = errors.New("parse error")
+	errRange = errors.New("value out of range")
+)
+
+func numError(err error) error {
+	ne, ok := err.(*strconv.NumError)
+	if !ok {
+		return err
+	}
+	switch ne.Err {
+	case strconv.ErrSyntax:
+		return errParse
+	case strconv.ErrRange:
+		return errRange
+	}
+	return err
+}
+
+// converters maps the types that have a converter registered with
+// Parser.RegisterConverter to that converter.
+type converters map[reflect.Type]func(string) (interface{}, error)
+
+// RegisterConverter registers fn as the function that converts the string
+// value of a flag (or environment variable, config file value or positional
+// argument) to a value of type t, for project-specific types that do not
+// implement flag.Value nor encoding.TextUnmarshaler. The value returned by
+// fn must be assignable to t, and any error it returns is reported as an
+// invalid value. The converter is used for fields of type t and for the
+// elements of slices of t, and it takes precedence over any other
+// conversion of t (including if t is a defined type of a basic kind, e.g. an
+// enum type based on int). Registering a nil fn removes the converter of t.
+//
+// RegisterConverter must not be called concurrently with other methods of
+// the Parser.
+func (p *Parser) RegisterConverter(t reflect.Type, fn func(string) (interface{}, error)) {
+	if fn == nil {
+		delete(p.converters, t)
+		return
+	}
+	if p.converters == nil {
+		p.converters = make(converters)
+	}
+	p.converters[t] = fn
+}
+
+// convertedValue is a flag.Getter for the types that have a converter
+// registered with Parser.RegisterConverter.
+type convertedValue struct {
+	v  reflect.Value
+	fn func(string) (interface{}, error)
+}
+
+func (c convertedValue) Set(s string) error {
+	x, err := convertValue(c.fn, c.v.Type(), s)
+	if err != nil {
+		return err
+	}
+	c.v.Set(x)
+	return nil
+}
+
+func (c convertedValue) Get() interface{} { return c.v.Interface() }
+
+func (c convertedValue) String() string {
+	if !c.v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(c.v.Interface())
+}
+
+// convertValue converts s to a value of type typ using fn, and returns an
+// error if fn fails or if its result is not assignable to typ.
+func convertValue(fn func(string) (interface{}, error), typ reflect.Type, s string) (reflect.Value, error) {
+	x, err := fn(s)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	val := reflect.ValueOf(x)
+	if !val.IsValid() || !val.Type().AssignableTo(typ) {
+		return reflect.Value{}, fmt.Errorf("converter returned %T, want %s", x, typ)
+	}
+	return val, nil
+}
+
+// fieldChoices returns the list of allowed values of the field, as set by
+// its "choices" struct tag, and true if the "choicesIgnoreCase" struct tag
+// is set to "true". It returns nil if the field has no choices, and panics
+// if the field is not a string or a slice of strings.
+func fieldChoices(ff flagField) ([]string, bool) {
+	tag := ff.field.Tag.Get("choices")
+	if tag == "" {
+		return nil, false
+	}
+	if typ := ff.field.Type; typ != stringType && typ != reflect.SliceOf(stringType) {
+		panic(fmt.Sprintf("choices set on non-string field %s", ff.field.Name))
+	}
+
+	choices := strings.Split(tag, ",")
+	for i, c := range choices {
+		choices[i] = strings.TrimSpace(c)
+	}
+	return choices, ff.field.Tag.Get("choicesIgnoreCase") == "true"
+}
+
+var stringType = reflect.TypeOf("")
+
+// matchChoice returns the choice that matches s, possibly ignoring the case
+// if fold is true, and an error if there is none.
+func matchChoice(s string, choices []string, fold bool) (string, error) {
+	for _, c := range choices {
+		if s == c || (fold && strings.EqualFold(s, c)) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("must be one of %s", strings.Join(choices, ", "))
+}
+
+// choicesValue is a flag.Getter that only accepts the values in choices,
+// and sets the matching choice (so that with fold, the value is set with
+// the case of the choice).
+type choicesValue struct {
+	flag.Getter
+	choices []string
+	fold    bool
+}
+
+func (c choicesValue) Set(s string) error {
+	choice, err := matchChoice(s, c.choices, c.fold)
+	if err != nil {
+		return err
+	}
+	return c.Getter.Set(choice)
+}
+
+// fieldSize returns true if the field's value (or its elements, for a
+// slice) is a size in bytes, as set by its `size:"true"` struct tag. It
+// panics if the tag is set on a field that is not an integer (or slice of
+// integers).
+func fieldSize(ff flagField) bool {
+	if ff.field.Tag.Get("size") != "true" {
+		return false
+	}
+	typ := ff.field.Type
+	if typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if !isIntKind(typ.Kind()) || typ == durationType {
+		panic(fmt.Sprintf("size set on non-integer field %s", ff.field.Name))
+	}
+	return true
+}
+
+// sizeUnits lists the supported size suffixes (in lowercase), with their
+// multiplier. The suffixes are checked in order, so that the longest ones are
+// tried first.
+var sizeUnits = []struct {
+	suffix string
+	mult   uint64
+}{
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"tib", 1 << 40},
+	{"kb", 1e3},
+	{"mb", 1e6},
+	{"gb", 1e9},
+	{"tb", 1e12},
+	{"b", 1},
+}
+
+// parseSize converts s, a decimal integer followed by a size suffix, to the
+// corresponding number of bytes. It returns false if s does not have a
+// supported suffix or if the number is not a decimal integer, in which case
+// s should be parsed as a plain integer.
+func parseSize(s string) (string, bool, error) {
+	lower := strings.ToLower(s)
+	for _, u := range sizeUnits {
+		if !strings.HasSuffix(lower, u.suffix) {
+			continue
+		}
+
+		num := strings.TrimSpace(s[:len(s)-len(u.suffix)])
+		var sign string
+		if strings.HasPrefix(num, "-") || strings.HasPrefix(num, "+") {
+			sign, num = num[:1], num[1:]
+		}
+		if num == "" || strings.TrimLeft(num, "0123456789") != "" {
+			return "", false, nil
+		}
+		n, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			return "", false, numError(err)
+		}
+		hi, lo := bits.Mul64(n, u.mult)
+		if hi != 0 {
+			return "", false, errRange
+		}
+		return sign + strconv.FormatUint(lo, 10), true, nil
+	}
+	return "", false, nil
+}
+
+// sizeValue is a flag.Getter that accepts a size suffix (e.g. 10MB or 2GiB)
+// and sets the corresponding number of bytes.
+type sizeValue struct {
+	flag.Getter
+}
+
+func (sv sizeValue) Set(s string) error {
+	n, ok, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s = n
+	}
+	return sv.Getter.Set(s)
+}
+
+// fieldPercent returns true if the field's value (or its elements, for a
+// slice) may be set as a percentage, as set by its `percent:"true"` struct
+// tag. It panics if the tag is set on a field that is not a float (or slice
+// of floats).
+func fieldPercent(ff flagField) bool {
+	if ff.field.Tag.Get("percent") != "true" {
+		return false
+	}
+	typ := ff.field.Type
+	if typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if k := typ.Kind(); k != reflect.Float32 && k != reflect.Float64 {
+		panic(fmt.Sprintf("percent set on non-float field %s", ff.field.Name))
+	}
+	return true
+}
+
+// percentValue is a flag.Getter that accepts a percentage (e.g. 25%) and
+// sets the corresponding ratio (e.g. 0.25).
+type percentValue struct {
+	flag.Getter
+}
+
+func (pv percentValue) Set(s string) error {
+	if num, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+		if err != nil {
+			return numError(err)
+		}
+		s = strconv.FormatFloat(f/100, 'g', -1, 64)
+	}
+	return pv.Getter.Set(s)
+}
+
+// setupFileValues wraps the flags of the string and TextUnmarshaler fields
+// so that their values may be read from a file or a file descriptor, as
+// described by Parser.AllowFileValues and Parser.AllowFDValues.
+func (p *Parser) setupFileValues(fs *flag.FlagSet, fields []flagField) {
+	resolver := p.fileValueResolver()
+	for _, ff := range fields {
+		if ff.count {
+			continue
+		}
+		if _, ok := textUnmarshaler(ff.value); !ok && ff.value.Kind() != reflect.String {
+			continue
+		}
+		for _, nm := range ff.names {
+			fl := fs.Lookup(nm)
+			fv := resolver
+			fv.Value = fl.Value
+			fl.Value = fv
+		}
+	}
+}
+
+// fileValueResolver returns a fileValue without an underlying flag.Value
+// that resolves the values as enabled by Parser.AllowFileValues and
+// Parser.AllowFDValues.
+func (p *Parser) fileValueResolver() fileValue {
+	var fv fileValue
+	if p.AllowFileValues {
+		fv.readFile = p.readFile
+	}
+	if p.AllowFDValues {
+		if fv.readFD = p.readFD; fv.readFD == nil {
+			fv.readFD = p.fdReader()
+		}
+	}
+	return fv
+}
+
+// fdReader returns a function that reads the file descriptor opened by
+// Parser.OpenFD (or os.NewFile), at most once per descriptor.
+func (p *Parser) fdReader() func(string) (string, error) {
+	read := make(map[int]string)
+	return func(num string) (string, error) {
+		fd, err := strconv.Atoi(num)
+		if err != nil || fd < 0 {
+			return "", fmt.Errorf("invalid file descriptor: %q", num)
+		}
+		if s, ok := read[fd]; ok {
+			return s, nil
+		}
+
+		var rc io.ReadCloser
+		if p.OpenFD != nil {
+			if rc, err = p.OpenFD(fd); err != nil {
+				return "", fmt.Errorf("open file descriptor %d: %w", fd, err)
+			}
+		} else {
+			rc = os.NewFile(uintptr(fd), "fd:"+num)
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return "", fmt.Errorf("read file descriptor %d: %w", fd, err)
+		}
+		read[fd] = strings.TrimSpace(string(b))
+		return read[fd], nil
+	}
+}
+
+// readFile reads the file using Parser.ReadFile, or os.ReadFile if it is
+// nil.
+func (p *Parser) readFile(name string) ([]byte, error) {
+	if p.ReadFile != nil {
+		return p.ReadFile(name)
+	}
+	return os.ReadFile(name)
+}
+
+// fileValue is a flag.Value that resolves its value before setting it. If
+// readFile is not nil, a value that starts with "@" is replaced by the
+// trimmed contents of the file it names and a value that starts with "@@"
+// by the same value without the first "@". If readFD is not nil, a value of
+// the form fd:N is replaced by the trimmed contents of the file descriptor
+// N and a value that starts with "fd::" by the same value without the
+// second ":".
+type fileValue struct {
+	flag.Value
+	readFile func(string) ([]byte, error)
+	readFD   func(string) (string, error)
+}
+
+func (fv fileValue) Set(s string) error {
+	s, err := fv.resolve(s)
+	if err != nil {
+		return err
+	}
+	return fv.Value.Set(s)
+}
+
+// resolve returns the value that s stands for.
+func (fv fileValue) resolve(s string) (string, error) {
+	if fv.readFile != nil {
+		if strings.HasPrefix(s, "@@") {
+			return s[1:], nil
+		}
+		if name, ok := strings.CutPrefix(s, "@"); ok {
+			b, err := fv.readFile(name)
+			if err != nil {
+				return "", fmt.Errorf("read value from file: %w", err)
+			}
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	if fv.readFD != nil {
+		if strings.HasPrefix(s, "fd::") {
+			return s[:3] + s[4:], nil
+		}
+		if num, ok := strings.CutPrefix(s, "fd:"); ok {
+			return fv.readFD(num)
+		}
+	}
+	return s, nil
+}
+
+func (fv fileValue) Get() interface{} {
+	if g, ok := fv.Value.(flag.Getter); ok {
+		return g.Get()
+	}
+	return nil
+}
+
+// fieldRange returns the inclusive bounds of the field's value (or of its
+// elements, for a slice), as set by its "min" and "max" struct tags, or
+// empty strings if it has none. It panics if a bound is set on a
+// non-numeric field or if it is invalid.
+func fieldRange(ff flagField) (lo, hi string) {
+	lo, hi = ff.field.Tag.Get("min"), ff.field.Tag.Get("max")
+	if lo == "" && hi == "" {
+		return "", ""
+	}
+
+	typ := ff.field.Type
+	if typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if k := typ.Kind(); !isIntKind(k) && k != reflect.Float32 && k != reflect.Float64 {
+		panic(fmt.Sprintf("min or max set on non-numeric field %s", ff.field.Name))
+	}
+	// compare with the zero value to validate the bounds
+	zero := reflect.New(typ).Elem()
+	if lo != "" {
+		compareRuleValue(ff.field.Name, zero, "min", lo)
+	}
+	if hi != "" {
+		compareRuleValue(ff.field.Name, zero, "max", hi)
+	}
+	return lo, hi
+}
+
+// checkRange returns an error if val is not within the inclusive bounds lo
+// and hi, each of which is ignored if empty.
+func checkRange(name string, val reflect.Value, lo, hi string) error {
+	if lo != "" {
+		if cmp, _ := compareRuleValue(name, val, "min", lo); cmp < 0 {
+			return fmt.Errorf("%w: must be %s", errRange, rangeDescription(lo, hi))
+		}
+	}
+	if hi != "" {
+		if cmp, _ := compareRuleValue(name, val, "max", hi); cmp > 0 {
+			return fmt.Errorf("%w: must be %s", errRange, rangeDescription(lo, hi))
+		}
+	}
+	return nil
+}
+
+// rangeDescription describes the inclusive bounds lo and hi, e.g. "between
+// 1 and 10" or "at least 1".
+func rangeDescription(lo, hi string) string {
+	switch {
+	case lo == "":
+		return "at most " + hi
+	case hi == "":
+		return "at least " + lo
+	default:
+		return "between " + lo + " and " + hi
+	}
+}
+
+// rangeValue is a flag.Getter that wraps the flag.Value that sets v and
+// fails if the resulting value is out of the bounds lo and hi (as returned
+// by fieldRange), in which case v is restored to its previous value.
+type rangeValue struct {
+	flag.Value
+	v      reflect.Value
+	name   string
+	lo, hi string
+}
+
+func (r rangeValue) Set(s string) error {
+	prev := reflect.New(r.v.Type()).Elem()
+	prev.Set(r.v)
+	if err := r.Value.Set(s); err != nil {
+		return err
+	}
+	if err := checkRange(r.name, r.v, r.lo, r.hi); err != nil {
+		r.v.Set(prev)
+		return err
+	}
+	return nil
+}
+
+func (r rangeValue) Get() interface{} { return r.v.Interface() }
+
+func (r rangeValue) IsBoolFlag() bool {
+	bo, ok := r.Value.(interface{ IsBoolFlag() bool })
+	return ok && bo.IsBoolFlag()
+}
+
+// intValue is a flag.Getter for the sized signed integer kinds not supported
+// by the stdlib's flag package (int8, int16 and int32).
+type intValue struct {
+	v    reflect.Value
+	bits int
+}
+
+func (i intValue) Set(s string) error {
+	n, err := strconv.ParseInt(s, 0, i.bits)
+	if err != nil {
+		return numError(err)
+	}
+	i.v.SetInt(n)
+	return nil
+}
+
+func (i intValue) Get() interface{} { return i.v.Interface() }
+
+func (i intValue) String() string {
+	if !i.v.IsValid() {
+		return "0"
+	}
+	return strconv.FormatInt(i.v.Int(), 10)
+}
+
+// uintValue is a flag.Getter for the sized unsigned integer kinds not
+// supported by the stdlib's flag package (uint8, uint16 and uint32).
+type uintValue struct {
+	v    reflect.Value
+	bits int
+}
+
+func (u uintValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 0, u.bits)
+	if err != nil {
+		return numError(err)
+	}
+	u.v.SetUint(n)
+	return nil
+}
+
+func (u uintValue) Get() interface{} { return u.v.Interface() }
+
+func (u uintValue) String() string {
+	if !u.v.IsValid() {
+		return "0"
+	}
+	return strconv.FormatUint(u.v.Uint(), 10)
+}
+
+// floatValue is a flag.Getter for the float32 kind, which is not supported by
+// the stdlib's flag package.
+type floatValue struct {
+	v    reflect.Value
+	bits int
+}
+
+func (f floatValue) Set(s string) error {
+	n, err := strconv.ParseFloat(s, f.bits)
+	if err != nil {
+		return numError(err)
+	}
+	f.v.SetFloat(n)
+	return nil
+}
+
+func (f floatValue) Get() interface{} { return f.v.Interface() }
+
+func (f floatValue) String() string {
+	if !f.v.IsValid() {
+		return "0"
+	}
+	return strconv.FormatFloat(f.v.Float(), 'g', -1, f.bits)
+}
+
+// countValue is a boolean-like flag.Value that increments an integer field
+// each time the flag is set, regardless of the value.
+type countValue struct {
+	v reflect.Value
+}
+
+func (c countValue) Set(s string) error {
+	if isUintKind(c.v.Kind()) {
+		c.v.SetUint(c.v.Uint() + 1)
+	} else {
+		c.v.SetInt(c.v.Int() + 1)
+	}
+	return nil
+}
+
+func (c countValue) String() string {
+	if !c.v.IsValid() {
+		return "0"
+	}
+	return fmt.Sprint(c.v.Interface())
+}
+
+func (c countValue) IsBoolFlag() bool { return true }
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return isUintKind(k)
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// negatedBoolValue is a boolean flag.Value that stores the negation of the
+// parsed value in a bool field, for the "no-" form of negatable flags.
+type negatedBoolValue struct {
+	v reflect.Value
+}
+
+func (n negatedBoolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errParse
+	}
+	n.v.SetBool(!b)
+	return nil
+}
+
+func (n negatedBoolValue) String() string {
+	if !n.v.IsValid() {
+		return "false"
+	}
+	return strconv.FormatBool(!n.v.Bool())
+}
+
+func (n negatedBoolValue) IsBoolFlag() bool { return true }
+
+// flagValueGetter wraps a flag.Value implemented by a field's type so that
+// Get returns that flag.Value, as required for the elements of a slice flag.
+type flagValueGetter struct {
+	flag.Value
+}
+
+func (f flagValueGetter) Get() interface{} { return f.Value }
+
+// unmarshalTextValue is a flag.Value for a type that implements
+// encoding.TextUnmarshaler but not encoding.TextMarshaler. As the value
+// cannot be marshaled, String uses the fmt.Stringer implementation if there
+// is one, and returns an empty string otherwise.
+type unmarshalTextValue struct {
+	t encoding.TextUnmarshaler
+}
+
+func (u unmarshalTextValue) Set(s string) error {
+	return u.t.UnmarshalText([]byte(s))
+}
+
+func (u unmarshalTextValue) Get() interface{} { return u.t }
+
+func (u unmarshalTextValue) String() string {
+	if st, ok := u.t.(fmt.Stringer); ok {
+		return st.String()
+	}
+	return ""
+}
+
+// parseFlags parses the command-line flags in args into v and calls the
+// related hooks of v. In addition to the Result, it returns the non-flag
+// arguments and the set of canonical flag names that were explicitly set by
+// args.
+func (p *Parser) parseFlags(args []string, v interface{}) (Result, []string, map[string]bool, error) {
+	var res Result
+	scan, err := p.scanFlags(args, v)
+	if scan == nil {
+		return res, nil, nil, err
+	}
+	nonFlags, flagSet, flagsCount := scan.nonFlags, scan.flagSet, scan.flagsCount
+	if p.StdinArgsSentinel != "" {
+		var serr error
+		if nonFlags, serr = p.expandStdinArgs(nonFlags); serr != nil {
+			return res, nil, nil, serr
+		}
+	}
+
+	p.warnDeprecated(v, scan.setNames)
+
+	if sa, ok := v.(interface{ SetArgs([]string) }); ok {
+		sa.SetArgs(nonFlags)
+	}
+
+	if su, ok := v.(interface{ SetUnknown([]string) }); ok {
+		su.SetUnknown(scan.unknown)
+	}
+
+	if p.Debug != nil {
+		for _, ff := range p.flagFields(v) {
+			if flagSet[ff.names[0]] {
+				p.debugf("flag -%s overrode to %s", ff.names[0], debugValue(ff.field, ff.value))
+			}
+		}
+	}
+
+	if sf, ok := v.(interface{ SetFlags(map[string]bool) }); ok {
+		sf.SetFlags(flagSet)
+	}
+
+	if sfc, ok := v.(interface{ SetFlagsCount(map[string]int) }); ok {
+		sfc.SetFlagsCount(flagsCount)
+	}
+
+	if sfcn, ok := v.(interface{ SetFlagsCountByName(map[string]int) }); ok {
+		sfcn.SetFlagsCountByName(scan.flagsCountByName)
+	}
+
+	if svr, ok := v.(interface{ SetVersionRequested(string) }); ok && p.versionRequested(v, flagSet) {
+		var version string
+		if vr, ok := v.(interface{ Version() string }); ok {
+			version = vr.Version()
+		}
+		svr.SetVersionRequested(version)
+	}
+
+	res.FlagsSet = len(flagSet)
+	for _, n := range flagsCount {
+		res.FlagsCount += n
+	}
+	res.ArgsCount = len(nonFlags)
+	return res, nonFlags, flagSet, err
+}
+
+// flagsSetBy returns the set of canonical flag names that are explicitly
+// set by args, without altering v. Parsing errors are skipped as much as
+// possible (as for Parser.CollectAllErrors), they are reported by the actual
+// parsing.
+func (p *Parser) flagsSetBy(args []string, v interface{}) map[string]bool {
+	dry := *p
+	dry.CollectAllErrors = true
+	// only the names matter, not the values
+	dry.AllowFileValues, dry.AllowFDValues = false, false
+
+	// the args are parsed into a fresh value, as a copy of v would share the
+	// storage of its maps, pointers and custom flag.Value fields with v.
+	tmp := reflect.New(reflect.TypeOf(v).Elem())
+	tmp.Elem().Set(freshStruct(reflect.ValueOf(v).Elem()))
+	scan, _ := dry.scanFlags(args, tmp.Interface())
+	if scan == nil {
+		return nil
+	}
+	return scan.flagSet
+}
+
+// freshStruct returns a zero value of the type of the struct val, where the
+// exported fields that are non-nil pointers or maps in val are set to new
+// (zero) pointers and empty maps, recursively for structs, so that it
+// defines the same flags as val without sharing any storage with it.
+func freshStruct(val reflect.Value) reflect.Value {
+	fresh := reflect.New(val.Type()).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		src, dst := val.Field(i), fresh.Field(i)
+		if !dst.CanSet() {
+			continue
+		}
+
+		switch src.Kind() {
+		case reflect.Pointer:
+			if src.IsNil() {
+				continue
+			}
+			ptr := reflect.New(src.Type().Elem())
+			if src.Elem().Kind() == reflect.Struct {
+				ptr.Elem().Set(freshStruct(src.Elem()))
+			}
+			dst.Set(ptr)
+		case reflect.Map:
+			if !src.IsNil() {
+				dst.Set(reflect.MakeMap(src.Type()))
+			}
+		case reflect.Struct:
+			dst.Set(freshStruct(src))
+		}
+	}
+	return fresh
+}
+
+// flagScan is the outcome of parsing the command-line flags.
+type flagScan struct {
+	nonFlags   []string
+	unknown    []string
+	flagSet    map[string]bool
+	flagsCount map[string]int
+
+	// flagsCountByName is the same as flagsCount, but keyed by the flag names
+	// instead of the canonical names.
+	flagsCountByName map[string]int
+
+	// setNames is the list of flag names (not canonical) set in the args, in
+	// lexical order.
+	setNames []string
+}
+
+// warnDeprecated writes a warning to Parser.Warnings, if it is set, for each
+// of the flag names set in the args that is defined on a field with a
+// "deprecated" struct tag.
+func (p *Parser) warnDeprecated(v interface{}, setNames []string) {
+	if p.Warnings == nil || len(setNames) == 0 {
+		return
+	}
+
+	hints := make(map[string]string)
+	for _, ff := range p.flagFields(v) {
+		hint, ok := ff.field.Tag.Lookup("deprecated")
+		if !ok {
+			continue
+		}
+		for _, nm := range ff.names {
+			hints[nm] = hint
+		}
+	}
+	for _, nm := range setNames {
+		hint, ok := hints[nm]
+		if !ok {
+			continue
+		}
+		if hint == "" {
+			fmt.Fprintf(p.Warnings, "flag -%s is deprecated\n", nm)
+			continue
+		}
+		fmt.Fprintf(p.Warnings, "flag -%s is deprecated: %s\n", nm, hint)
+	}
+}
+
+// scanFlags parses the command-line flags in args into v, without calling
+// any hook. It returns a nil flagScan if parsing failed, otherwise the error
+// holds the errors collected if Parser.CollectAllErrors is set.
+func (p *Parser) scanFlags(args []string, v interface{}) (*flagScan, error) {
+	if len(args) == 0 {
+		return &flagScan{}, nil
+	}
+
+	// create a FlagSet that is silent and only returns any error
+	// it encounters.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = nil
+
+	fields := p.flagFields(v)
+	canonLookup := registerFlags(fs, fields, p.OverwriteSlices, p.converters)
+	if p.AllowFileValues || p.AllowFDValues {
+		p.setupFileValues(fs, fields)
+	}
+
+	// wrap each flag in a func that will count and report the number of times
+	// it was set (under the canonical - first defined - flag name).
+	flagsCount, flagsCountByName := setupFlagsCount(fs, canonLookup)
+
+	var (
+		nonFlags, unknown []string
+		flagErrs          []error
+	)
+	args = args[1:] // skip the program name
+
+	// with StopAtFirstArg, the arguments starting at the first non-flag are
+	// returned untouched, so they must not be rewritten.
+	var untouched []string
+	if p.StopAtFirstArg {
+		end := p.firstArgIndex(fs, canonLookup, args)
+		args, untouched = args[:end], args[end:]
+	}
+
+	args, errs := p.rewriteFlagArgs(fs, canonLookup, args)
+	if len(errs) > 0 && !p.CollectAllErrors {
+		return nil, errs[0]
+	}
+	flagErrs = append(flagErrs, errs...)
+
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			if p.AllowUnknown && isUnknownFlagError(err) {
+				// the flagset consumed the unknown flag, record it and resume parsing
+				// after it.
+				rest := fs.Args()
+				tok, _ := parseFlagToken(args[len(args)-len(rest)-1])
+				unknown = append(unknown, tok.String())
+				if !tok.hasValue && len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+					// best-effort: assume the next argument is the flag's value
+					unknown = append(unknown, rest[0])
+					rest = rest[1:]
+				}
+				args = rest
+				continue
+			}
+
+			if err == flag.ErrHelp {
+				// the stdlib returns ErrHelp for -h and -help when they are not
+				// defined, report it as any other unknown flag (the flagset consumed
+				// the flag, so it is the last consumed argument).
+				tok, _ := parseFlagToken(args[len(args)-len(fs.Args())-1])
+				err = &ParseError{
+					Kind: ErrUnknownFlag,
+					Flag: tok.name,
+					Err:  errors.New("flag provided but not defined: -" + tok.name),
+				}
+			} else {
+				err = newFlagError(err)
+			}
+			if !p.CollectAllErrors {
+				return nil, err
+			}
+
+			// collect the error and resume parsing after the failing argument.
+			flagErrs = append(flagErrs, err)
+			rest := fs.Args()
+			var pe *ParseError
+			if errors.As(err, &pe) && pe.Kind == ErrSyntax && len(rest) > 0 {
+				// the argument with a bad syntax is not consumed by the flagset
+				rest = rest[1:]
+			}
+			args = rest
+			continue
+		}
+
+		if consumedTerminator(fs, args[:len(args)-len(fs.Args())]) {
+			// the flagset stopped at the "--" terminator (and removed it), so all
+			// remaining args are non-flags, including any subsequent "--".
+			nonFlags = append(nonFlags, fs.Args()...)
+			break
+		}
+
+		if p.StopAtFirstArg {
+			nonFlags = append(nonFlags, fs.Args()...)
+			break
+		}
+
+		args = nil
+		curNonFlags := fs.Args()
+		for i, nf := range curNonFlags {
+			if nf == "--" {
+				// ignore this one, but treat all subsequent as non-flags
+				nonFlags = append(nonFlags, curNonFlags[i+1:]...)
+				break
+			}
+			if ((strings.HasPrefix(nf, "-") && len(nf) > 1) ||
+				(strings.HasPrefix(nf, "--") && len(nf) > 2)) &&
+				!strings.HasPrefix(nf, "---") {
+
+				// this is a flag, stop non-flags here
+				args = curNonFlags[i:]
+				break
+			}
+			nonFlags = append(nonFlags, nf)
+		}
+	}
+
+	nonFlags = append(nonFlags, untouched...)
+
+	var (
+		flagSet  map[string]bool
+		setNames []string
+	)
+	fs.Visit(func(fl *flag.Flag) {
+		if flagSet == nil {
+			flagSet = make(map[string]bool)
+		}
+		flagSet[canonLookup[fl.Name]] = true
+		setNames = append(setNames, fl.Name)
+	})
+	if len(flagsCount) == 0 {
+		flagsCount = nil
+		flagsCountByName = nil
+	}
+
+	scan := &flagScan{
+		nonFlags:         nonFlags,
+		unknown:          unknown,
+		flagSet:          flagSet,
+		flagsCount:       flagsCount,
+		flagsCountByName: flagsCountByName,
+		setNames:         setNames,
+	}
+	return scan, joinErrors(flagErrs)
+}
+
+// rewriteFlagArgs returns a copy of args where the flags are rewritten as
+// configured by the Parser: normalized names, prefix matches, boolean
+// clusters and glued values. It returns the errors of the prefix matching,
+// if any.
+func (p *Parser) rewriteFlagArgs(fs *flag.FlagSet, canonLookup map[string]string, args []string) ([]string, []error) {
+	var errs []error
+	if p.NormalizeFlagNames {
+		args = normalizeArgs(fs, args)
+	}
+	if p.AllowPrefixMatch {
+		args, errs = expandPrefixes(fs, canonLookup, args)
+	}
+	args = expandBoolClusters(fs, args)
+	if p.AllowGluedValues {
+		args = expandGluedValues(fs, args)
+	}
+	return args, errs
+}
+
+// firstArgIndex returns the index in args of the first non-flag argument,
+// or the index following the first "--" terminator, or len(args) if there
+// is none. The values of non-boolean flags are skipped, as determined by
+// rewriting each flag the same way as for parsing (e.g. the last flag of a
+// boolean cluster may take a value). As for Parser.AllowUnknown, the value of
+// an unknown flag is assumed to be the next argument if it is not a flag.
+func (p *Parser) firstArgIndex(fs *flag.FlagSet, canonLookup map[string]string, args []string) int {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return i + 1
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return i
+		}
+
+		toks, _ := p.rewriteFlagArgs(fs, canonLookup, []string{arg})
+		if len(toks) == 0 {
+			continue
+		}
+		last, ok := parseFlagToken(toks[len(toks)-1])
+		if !ok || last.hasValue || i+1 >= len(args) {
+			continue
+		}
+		fl := fs.Lookup(last.name)
+		switch {
+		case fl != nil && !isBoolFlag(fl):
+			i++
+		case fl == nil && p.AllowUnknown && !strings.HasPrefix(args[i+1], "-"):
+			i++
+		}
+	}
+	return len(args)
+}
+
+// flagField is a struct field that defines one or more flags.
+type flagField struct {
+	// names is the list of flag names defined on the field, the first one
+	// being the canonical name.
+	names []string
+	field reflect.StructField
+	value reflect.Value
+
+	// count is true if the "count" option is set in the flag tag.
+	count bool
+
+	// group is the name of the mutually exclusive group of the field, as set
+	// by the "group=" option in the flag tag.
+	group string
+
+	// requires is the list of flag names that must be set if this field's
+	// flag is set, as set by the "requires=" options in the flag tag.
+	requires []string
+
+	// envPrefix is the concatenation of the "envPrefix" struct tags of the
+	// nested structs that contain the field, as used by the env package.
+	envPrefix string
+}
+
+// flagFields returns the fields of the struct pointed to by v that define at
+// least one flag, including the fields of embedded structs. It panics if v
+// is not a pointer to a struct.
+func (p *Parser) flagFields(v interface{}) []flagField {
+	// v must be a pointer, so dereference it here and let reflect panic if it
+	// isn't
+	val := reflect.ValueOf(v).Elem()
+
+	var normalizedFrom map[string]string // key is normalized name, value is original name
+	if p.NormalizeFlagNames {
+		normalizedFrom = make(map[string]string)
+	}
+	return p.appendFlagFields(nil, val, "", "", normalizedFrom)
+}
+
+// appendFlagFields appends the flag fields of the struct val to fields and
+// returns the resulting slice, with prefix prepended to the flag names and
+// envPrefix recorded as the fields' environment variables prefix. An
+// exported embedded struct (or non-nil pointer to a struct) without a "flag"
+// struct tag is recursed into, so that its fields define flags as if they
+// were fields of val, and so is a named struct field with a "flagprefix"
+// struct tag, with that prefix added to the names of its flags.
+func (p *Parser) appendFlagFields(fields []flagField, val reflect.Value, prefix, envPrefix string, normalizedFrom map[string]string) []flagField {
+	strct := val.Type()
+	for i := 0; i < val.NumField(); i++ {
+		ff := flagField{
+			field:     strct.Field(i),
+			value:     val.Field(i),
+			envPrefix: envPrefix,
+		}
+		if skipOnPlatform(ff.value) {
+			continue
+		}
+		tag, hasTag := ff.field.Tag.Lookup("flag")
+		fieldPrefix, hasPrefix := ff.field.Tag.Lookup("flagprefix")
+		if !hasTag && (ff.field.Anonymous || hasPrefix) {
+			if !ff.field.IsExported() {
+				// as for the env package, only exported nested structs are
+				// recursed into.
+				continue
+			}
+			nested := ff.value
+			if nested.Kind() == reflect.Pointer && !nested.IsNil() {
+				nested = nested.Elem()
+			}
+			if nested.Kind() == reflect.Struct {
+				fields = p.appendFlagFields(fields, nested, prefix+fieldPrefix,
+					envPrefix+ff.field.Tag.Get("envPrefix"), normalizedFrom)
+			}
+			continue
+		}
+
+		var names []string
+		for _, nm := range strings.Split(tag, ",") {
+			switch {
+			case nm == "":
+			case nm == "count":
+				ff.count = true
+			case strings.HasPrefix(nm, "group="):
+				ff.group = strings.TrimPrefix(nm, "group=")
+			case strings.HasPrefix(nm, "requires="):
+				ff.requires = append(ff.requires, prefix+strings.TrimPrefix(nm, "requires="))
+			default:
+				names = append(names, nm)
+			}
+		}
+
+		for _, nm := range names {
+			// the prefix goes after the "no-" of a negated name
+			if isNegatedName(nm, names) {
+				nm = "no-" + prefix + strings.TrimPrefix(nm, "no-")
+			} else {
+				nm = prefix + nm
+			}
+			if normalizedFrom != nil {
+				orig := nm
+				nm = normalizeFlagName(nm)
+				if prev, ok := normalizedFrom[nm]; ok && prev != orig {
+					panic(fmt.Sprintf("flag redefined after normalization: %s (%s and %s)", nm, prev, orig))
+				}
+				normalizedFrom[nm] = orig
+			}
+			ff.names = append(ff.names, nm)
+		}
+		if normalizedFrom != nil {
+			// the required flags must match the normalized names
+			for i, req := range ff.requires {
+				ff.requires[i] = normalizeFlagName(req)
+			}
+		}
+		if len(ff.names) > 0 {
+			fields = append(fields, ff)
+		}
+	}
+	return fields
 }
 
-// Parse parses args into v, using struct tags to detect flags. Note that the
-// args slice should start with the program name (as is the case for `os.Args`,
-// which is typically used). The tag must be named "flag" and multiple flags
-// may be set for the same field using a comma-separated list.
-//
-// v must be a pointer to a struct and the flags must be defined on exported
-// fields with one of those types:
-//   - string
-//   - int/int64
-//   - uint/uint64
-//   - float64
-//   - bool
-//   - time.Duration
-//   - a type that directly implements encoding.TextMarshaler/TextUnmarshaler
-//     (both interfaces must be satisfied), or a type T that implements those
-//     interfaces on *T (a pointer to the type)
-//   - a slice of any of those types
-//
-// For slices, by default a new value is appended each time the flag is
-// encountered. This behaviour can be altered by adding a "flagSeparator"
-// struct tag to the field, in addition to the "flag" one, e.g.:
-//
-//	type S struct {
-//	  Name []string `flag:"name" flagSeparator:","`
-//	}
-//
-// This causes the field to be filled with a single flag value being set, and
-// that value is split on the provided separator.
-//
-// If Parser.EnvVars is true, flag values are initialized from corresponding
-// environment variables first, as defined by the github.com/caarlos0/env/v6
-// package (which is used for environment parsing).
-//
-// Flags and arguments can be interspersed, but flag parsing stops if it
-// encounters the "--" value; all subsequent values are treated as arguments.
-//
-// After parsing, if v implements a Validate method that returns an error, it
-// is called and any non-nil error is returned as error.
-//
-// If v has a SetArgs([]string) method, it is called with the list of non-flag
-// arguments (a slice of strings) that respects the provided order.
-//
-// If v has a SetFlags(map[string]bool) method, it is called with the set of
-// flags that were explicitly set by args (a map[string]bool). Note that if a
-// field can be set with multiple flags, the key is canonicalized to the first
-// flag defined on the field.
-//
-// If v has a SetFlagsCount(map[string]int) method, it is called with the map
-// of flags that were explicitly set by args, and the associated value is the
-// number of times the flag was provided. As for SetFlags, the key is
-// canonicalized to the first flag defined on the field.
-//
-// Environment variables parsing has no effect on the values reported by
-// SetFlags and SetFlagsCount, only the actual flags parsed from the args.
-//
-// It panics if v is not a pointer to a struct or if a flag is defined with an
-// unsupported type.
-func (p *Parser) Parse(args []string, v interface{}) error {
-	if p.EnvVars {
-		if err := p.parseEnvVars(args, v); err != nil {
-			return err
+// versionRequested returns true if the flag field that defines the
+// "version" flag is in flagSet, and is true if it is a bool.
+func (p *Parser) versionRequested(v interface{}, flagSet map[string]bool) bool {
+	for _, ff := range p.flagFields(v) {
+		if flagSet[ff.names[0]] && sliceContains(ff.names, "version") {
+			return ff.value.Kind() != reflect.Bool || ff.value.Bool()
 		}
 	}
+	return false
+}
 
-	if err := p.parseFlags(args, v); err != nil {
-		return err
+// checkRequires returns an error if a flag with a value from any source has
+// a prerequisite flag that does not. It panics if a prerequisite is not a
+// defined flag.
+func (p *Parser) checkRequires(v interface{}, sources map[string]FlagSource) error {
+	fields := p.flagFields(v)
+	canonLookup := make(map[string]string, len(fields))
+	for _, ff := range fields {
+		for _, nm := range ff.names {
+			canonLookup[nm] = ff.names[0]
+		}
 	}
 
-	if val, ok := v.(interface{ Validate() error }); ok {
-		return val.Validate()
+	for _, ff := range fields {
+		for _, req := range ff.requires {
+			canon, ok := canonLookup[req]
+			if !ok {
+				panic(fmt.Sprintf("undefined flag %s required by field %s", req, ff.field.Name))
+			}
+			if sources[ff.names[0]] != SourceDefault && sources[canon] == SourceDefault {
+				return &ParseError{
+					Kind: ErrRequired,
+					Flag: ff.names[0],
+					Err:  fmt.Errorf("-%s requires -%s", ff.names[0], req),
+				}
+			}
+		}
 	}
 	return nil
 }
 
-var durationType = reflect.TypeOf(time.Duration(0))
-
-type nopValue struct{}
+// requiredSources returns the source of each required flag of v that has a
+// value, as described for SetRequiredSources in Parser.Parse. It must be
+// called once checkRequires succeeded.
+func (p *Parser) requiredSources(v interface{}, sources map[string]FlagSource) map[string]string {
+	fields := p.flagFields(v)
+	canonLookup := make(map[string]string, len(fields))
+	for _, ff := range fields {
+		for _, nm := range ff.names {
+			canonLookup[nm] = ff.names[0]
+		}
+	}
 
-func (nopValue) Set(s string) error { return nil }
-func (nopValue) String() string     { return "" }
+	required := make(map[string]string)
+	add := func(canon string) {
+		if src := sources[canon]; src != SourceDefault {
+			required[canon] = src.String()
+		}
+	}
+	for _, ff := range fields {
+		if _, opts, _ := strings.Cut(ff.field.Tag.Get("env"), ","); sliceContains(strings.Split(opts, ","), "required") {
+			add(ff.names[0])
+		}
+		if sources[ff.names[0]] == SourceDefault {
+			continue
+		}
+		for _, req := range ff.requires {
+			add(canonLookup[req])
+		}
+	}
+	return required
+}
 
-// valueSetter wraps a flag's Value with one that calls a setter func when the
-// flag is set. Other flag.Value methods are the same as the wrapped Value.
-type valueSetter struct {
-	flag.Value
-	setter func(string) error
-	isBool bool
+// helpFlags returns the names of the help flags, which are Parser.HelpFlags
+// or the default ones if it is nil.
+func (p *Parser) helpFlags() []string {
+	if p.HelpFlags == nil {
+		return []string{"h", "help"}
+	}
+	return p.HelpFlags
 }
 
-func (v valueSetter) Set(s string) error {
-	return v.setter(s)
+// checkGroups returns an error if more than one flag of the same mutually
+// exclusive group is in flagSet, unless a help or version flag is set.
+func (p *Parser) checkGroups(v interface{}, flagSet map[string]bool) error {
+	if len(flagSet) < 2 {
+		return nil
+	}
+
+	fields := p.flagFields(v)
+	for _, ff := range fields {
+		if !flagSet[ff.names[0]] {
+			continue
+		}
+		for _, nm := range ff.names {
+			if nm == "version" || sliceContains(p.helpFlags(), nm) {
+				return nil
+			}
+		}
+	}
+
+	var (
+		groups   []string
+		setFlags = make(map[string][]string)
+	)
+	for _, ff := range fields {
+		if ff.group == "" || !flagSet[ff.names[0]] {
+			continue
+		}
+		if _, ok := setFlags[ff.group]; !ok {
+			groups = append(groups, ff.group)
+		}
+		setFlags[ff.group] = append(setFlags[ff.group], "-"+ff.names[0])
+	}
+	for _, g := range groups {
+		if names := setFlags[g]; len(names) > 1 {
+			return &ParseError{
+				Kind: ErrExclusive,
+				Flag: names[1][1:],
+				Err:  fmt.Errorf("mutually exclusive flags provided: %s", strings.Join(names, ", ")),
+			}
+		}
+	}
+	return nil
 }
 
-func (v valueSetter) IsBoolFlag() bool {
-	return v.isBool
+// isNegatedName returns true if nm is the negated form of another name in
+// names, i.e. if it is "no-X" and X is in names.
+func isNegatedName(nm string, names []string) bool {
+	if !strings.HasPrefix(nm, "no-") {
+		return false
+	}
+	return sliceContains(names, strings.TrimPrefix(nm, "no-"))
 }
 
-func (p *Parser) parseFlags(args []string, v interface{}) error {
-	if len(args) == 0 {
-		return nil
+// skipOnPlatform returns true if the field's value implements the
+// SkipOnPlatform method and it returns true.
+func skipOnPlatform(val reflect.Value) bool {
+	if !val.CanAddr() || !val.Addr().CanInterface() {
+		return false
 	}
+	sk, ok := val.Addr().Interface().(interface{ SkipOnPlatform() bool })
+	return ok && sk.SkipOnPlatform()
+}
+
+// registerFlags registers the flags defined by fields in fs. If overwrite is
+// true, the first value set for a slice flag replaces the existing values. It
+// returns a map where the key is the flag name and the value is its canonical
+// name.
+func registerFlags(fs *flag.FlagSet, fields []flagField, overwrite bool, convs converters) map[string]string {
+	canonLookup := make(map[string]string, len(fields))
 
 	// sliceFs is an internal flagset used only if slices are present
 	var sliceFs *flag.FlagSet
 
-	// create a FlagSet that is silent and only returns any error
-	// it encounters.
-	fs := flag.NewFlagSet("", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-	fs.Usage = nil
+	for _, ff := range fields {
+		fld, typ := ff.value, ff.field
+		sliceSep, sliceSepSet := typ.Tag.Lookup("flagSeparator")
 
-	// extract the flags from the struct (v must be a pointer, so dereference it
-	// here and let reflect panic if it isn't)
-	val := reflect.ValueOf(v).Elem()
-	strct := val.Type()
-	count := val.NumField()
-	canonLookup := make(map[string]string, count) // key is flag name, value is canonical name
+		if ff.count && !isIntKind(fld.Kind()) {
+			panic(fmt.Sprintf("count option set on non-integer field %s", typ.Name))
+		}
+		choices, fold := fieldChoices(ff)
+		size := fieldSize(ff)
+		percent := fieldPercent(ff)
+		lo, hi := fieldRange(ff)
 
-	for i := 0; i < count; i++ {
-		fld := val.Field(i)
-		typ := strct.Field(i)
-		names := strings.Split(typ.Tag.Get("flag"), ",")
-		sliceSep, sliceSepSet := typ.Tag.Lookup("flagSeparator")
+		// reset is shared by all names of the field, so that only the first
+		// value set replaces the existing values.
+		var reset *bool
+		if overwrite && !sliceSepSet {
+			reset = new(bool)
+			*reset = true
+		}
 
-		var canonFlag string
-		for _, nm := range names {
-			if nm == "" {
+		for _, nm := range ff.names {
+			canonLookup[nm] = ff.names[0]
+
+			if ff.count {
+				fs.Var(countValue{v: fld}, nm, "")
+				continue
+			}
+
+			if fld.Kind() == reflect.Bool && isNegatedName(nm, ff.names) {
+				fs.Var(negatedBoolValue{v: fld}, nm, "")
+				continue
+			}
+
+			// a registered converter takes precedence over any other conversion.
+			if _, ok := convs[fld.Type()]; ok {
+				if sliceSepSet {
+					panic(fmt.Sprintf("ineffective flagSeparator attribute set on field %s", typ.Name))
+				}
+				addToFlagSet(fs, nm, fld, false, convs)
 				continue
 			}
-			if canonFlag == "" {
-				canonFlag = nm
+
+			// if the field implements flag.Value, it is used as-is, regardless of
+			// whether it is a slice or not.
+			if fv, ok := flagValue(fld); ok {
+				if sliceSepSet {
+					panic(fmt.Sprintf("ineffective flagSeparator attribute set on field %s", typ.Name))
+				}
+				fs.Var(fv, nm, "")
+				continue
 			}
-			canonLookup[nm] = canonFlag
 
 			// if the field implements text (un)marshaler, then we're done,
 			// regardless of whether it is a slice or not (it's up to the unmarshaler
 			// to handle the values).
-			if t, ok := textMarshalerUnmarshaler(fld); ok {
+			if _, ok := textUnmarshaler(fld); ok {
 				if sliceSepSet {
 					panic(fmt.Sprintf("ineffective flagSeparator attribute set on field %s", typ.Name))
 				}
-				fs.TextVar(t, nm, t, "")
+				addTextToFlagSet(fs, nm, fld)
 				continue
 			}
 
@@ -194,92 +2414,65 @@ func (p *Parser) parseFlags(args []string, v interface{}) error {
 				// add the slice's single-element flag value to sliceFs, will be used
 				// internally by the slice's flag on the real flagset. If it returns
 				// false, then the slice's element type is unsupported.
-				if !addToFlagSet(sliceFs, nm, ptr.Elem(), true) {
+				if !addToFlagSet(sliceFs, nm, ptr.Elem(), true, convs) {
 					panic(fmt.Sprintf("unsupported flag field kind: %s (%s: []%s)", elemTyp.Kind(), typ.Name, elemTyp))
 				}
 				elemFlag := sliceFs.Lookup(nm)
-				makeSliceFlag(fs, elemFlag, elemTyp, fld, sliceSep)
+				if size {
+					elemFlag.Value = sizeValue{Getter: elemFlag.Value.(flag.Getter)}
+				}
+				if percent {
+					elemFlag.Value = percentValue{Getter: elemFlag.Value.(flag.Getter)}
+				}
+				if choices != nil {
+					// check each element, even if the slice flag's value is split
+					elemFlag.Value = choicesValue{Getter: elemFlag.Value.(flag.Getter), choices: choices, fold: fold}
+				}
+				if lo != "" || hi != "" {
+					elemFlag.Value = rangeValue{Value: elemFlag.Value, v: ptr.Elem(), name: typ.Name, lo: lo, hi: hi}
+				}
+				makeSliceFlag(fs, elemFlag, elemTyp, fld, sliceSep, reset)
 				continue
 			}
 
 			if sliceSepSet {
 				panic(fmt.Sprintf("ineffective flagSeparator attribute set on field %s", typ.Name))
 			}
-			if !addToFlagSet(fs, nm, fld, false) {
+			if !addToFlagSet(fs, nm, fld, false, convs) {
 				panic(fmt.Sprintf("unsupported flag field kind: %s (%s: %s)", fld.Kind(), typ.Name, typ.Type))
 			}
-		}
-	}
-
-	var flagsCount map[string]int
-	if _, ok := v.(interface{ SetFlagsCount(map[string]int) }); ok {
-		// v implements SetFlagsCount, so wrap each flag in a func that will count
-		// and report the number of times it was set (under the canonical - first
-		// defined - flag name).
-		flagsCount = setupFlagsCount(fs, canonLookup)
-	}
-
-	var nonFlags []string
-	args = args[1:] // skip the program name
-	for len(args) > 0 {
-		if err := fs.Parse(args); err != nil {
-			if err == flag.ErrHelp {
-				// required to bypass the stdlib's default handling of -h/-help
-				if fs.Lookup("help") == nil && sliceContains(args, "-help") {
-					return errors.New("flag provided but not defined: -help")
-				}
-				return errors.New("flag provided but not defined: -h")
+			if size {
+				fl := fs.Lookup(nm)
+				fl.Value = sizeValue{Getter: fl.Value.(flag.Getter)}
 			}
-			return err
-		}
-
-		args = nil
-		curNonFlags := fs.Args()
-		for i, nf := range curNonFlags {
-			if nf == "--" {
-				// ignore this one, but treat all subsequent as non-flags
-				nonFlags = append(nonFlags, curNonFlags[i+1:]...)
-				break
+			if percent {
+				fl := fs.Lookup(nm)
+				fl.Value = percentValue{Getter: fl.Value.(flag.Getter)}
 			}
-			if ((strings.HasPrefix(nf, "-") && len(nf) > 1) ||
-				(strings.HasPrefix(nf, "--") && len(nf) > 2)) &&
-				!strings.HasPrefix(nf, "---") {
-
-				// this is a flag, stop non-flags here
-				args = curNonFlags[i:]
-				break
+			if choices != nil {
+				fl := fs.Lookup(nm)
+				fl.Value = choicesValue{Getter: fl.Value.(flag.Getter), choices: choices, fold: fold}
 			}
-			nonFlags = append(nonFlags, nf)
 		}
-	}
-
-	if sa, ok := v.(interface{ SetArgs([]string) }); ok {
-		sa.SetArgs(nonFlags)
-	}
 
-	if sf, ok := v.(interface{ SetFlags(map[string]bool) }); ok {
-		var flagSet map[string]bool
-		fs.Visit(func(fl *flag.Flag) {
-			if flagSet == nil {
-				flagSet = make(map[string]bool)
+		// the range of slices is checked on each element, other fields are
+		// checked once set, whatever the kind of flag.Value used to set them.
+		if (lo != "" || hi != "") && fld.Kind() != reflect.Slice {
+			for _, nm := range ff.names {
+				fl := fs.Lookup(nm)
+				fl.Value = rangeValue{Value: fl.Value, v: fld, name: typ.Name, lo: lo, hi: hi}
 			}
-			flagSet[canonLookup[fl.Name]] = true
-		})
-		sf.SetFlags(flagSet)
-	}
-
-	if sfc, ok := v.(interface{ SetFlagsCount(map[string]int) }); ok {
-		if len(flagsCount) == 0 {
-			sfc.SetFlagsCount(nil)
-		} else {
-			sfc.SetFlagsCount(flagsCount)
 		}
 	}
-
-	return nil
+	return canonLookup
 }
 
-func addToFlagSet(fs *flag.FlagSet, nm string, val reflect.Value, canBeText bool) bool {
+func addToFlagSet(fs *flag.FlagSet, nm string, val reflect.Value, canBeText bool, convs converters) bool {
+	if fn, ok := convs[val.Type()]; ok {
+		fs.Var(convertedValue{v: val, fn: fn}, nm, "")
+		return true
+	}
+
 	// check for well-known types first, as their underlying type might be a
 	// basic kind (so it must be checked before the basic kinds are
 	// processed).
@@ -287,11 +2480,12 @@ func addToFlagSet(fs *flag.FlagSet, nm string, val reflect.Value, canBeText bool
 	case durationType:
 		fs.DurationVar(val.Addr().Interface().(*time.Duration), nm, val.Interface().(time.Duration), "")
 	default:
-		if canBeText {
-			if t, ok := textMarshalerUnmarshaler(val); ok {
-				fs.TextVar(t, nm, t, "")
-				break
-			}
+		if fv, ok := flagValue(val); ok {
+			fs.Var(flagValueGetter{Value: fv}, nm, "")
+			break
+		}
+		if canBeText && addTextToFlagSet(fs, nm, val) {
+			break
 		}
 
 		switch val.Kind() {
@@ -303,12 +2497,18 @@ func addToFlagSet(fs *flag.FlagSet, nm string, val reflect.Value, canBeText bool
 			fs.IntVar(val.Addr().Interface().(*int), nm, int(val.Int()), "")
 		case reflect.Int64:
 			fs.Int64Var(val.Addr().Interface().(*int64), nm, val.Int(), "")
+		case reflect.Int8, reflect.Int16, reflect.Int32:
+			fs.Var(intValue{v: val, bits: val.Type().Bits()}, nm, "")
 		case reflect.Uint:
 			fs.UintVar(val.Addr().Interface().(*uint), nm, uint(val.Uint()), "")
 		case reflect.Uint64:
 			fs.Uint64Var(val.Addr().Interface().(*uint64), nm, val.Uint(), "")
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+			fs.Var(uintValue{v: val, bits: val.Type().Bits()}, nm, "")
 		case reflect.Float64:
 			fs.Float64Var(val.Addr().Interface().(*float64), nm, val.Float(), "")
+		case reflect.Float32:
+			fs.Var(floatValue{v: val, bits: 32}, nm, "")
 		default:
 			return false
 		}
@@ -316,6 +2516,23 @@ func addToFlagSet(fs *flag.FlagSet, nm string, val reflect.Value, canBeText bool
 	return true
 }
 
+// addTextToFlagSet adds the flag nm for val to fs if its type (or a pointer
+// to it) implements encoding.TextUnmarshaler. If it also implements
+// encoding.TextMarshaler, fs.TextVar is used, otherwise the flag uses an
+// unmarshalTextValue. It returns false if val does not implement
+// encoding.TextUnmarshaler.
+func addTextToFlagSet(fs *flag.FlagSet, nm string, val reflect.Value) bool {
+	if t, ok := textMarshalerUnmarshaler(val); ok {
+		fs.TextVar(t, nm, t, "")
+		return true
+	}
+	if t, ok := textUnmarshaler(val); ok {
+		fs.Var(unmarshalTextValue{t: t}, nm, "")
+		return true
+	}
+	return false
+}
+
 func createSliceElem(typ reflect.Type) reflect.Value {
 	if typ.Kind() == reflect.Pointer {
 		// the only valid way to be a pointer is if the value implements
@@ -326,7 +2543,10 @@ func createSliceElem(typ reflect.Type) reflect.Value {
 	return reflect.New(typ)
 }
 
-func makeSliceFlag(fs *flag.FlagSet, elemFlag *flag.Flag, elemTyp reflect.Type, fldVal reflect.Value, sep string) {
+// makeSliceFlag registers the slice flag in fs. If reset is not nil and is
+// true, the slice is emptied before the next value is appended, and reset is
+// set to false. It is ignored if sep is not empty.
+func makeSliceFlag(fs *flag.FlagSet, elemFlag *flag.Flag, elemTyp reflect.Type, fldVal reflect.Value, sep string, reset *bool) {
 	// all flags' values are getters too, except for func which isn't used by addToFlagSet.
 	valGet := elemFlag.Value.(flag.Getter)
 
@@ -350,6 +2570,10 @@ func makeSliceFlag(fs *flag.FlagSet, elemFlag *flag.Flag, elemTyp reflect.Type,
 				}
 			}
 
+			if reset != nil && *reset {
+				fldVal.Set(reflect.MakeSlice(fldVal.Type(), 0, 1))
+				*reset = false
+			}
 			fldVal.Set(reflect.Append(fldVal, newVal))
 			return nil
 		}
@@ -391,8 +2615,12 @@ func makeSliceFlag(fs *flag.FlagSet, elemFlag *flag.Flag, elemTyp reflect.Type,
 	fs.Var(flagVal, elemFlag.Name, "")
 }
 
-func setupFlagsCount(fs *flag.FlagSet, canonLookup map[string]string) map[string]int {
+// setupFlagsCount wraps each flag of fs so that the number of times it is
+// set is counted. It returns the counts keyed by canonical name and by flag
+// name.
+func setupFlagsCount(fs *flag.FlagSet, canonLookup map[string]string) (map[string]int, map[string]int) {
 	flagsCount := make(map[string]int)
+	byName := make(map[string]int)
 
 	fs.VisitAll(func(fl *flag.Flag) {
 		inner := fl.Value
@@ -400,16 +2628,15 @@ func setupFlagsCount(fs *flag.FlagSet, canonLookup map[string]string) map[string
 			Value: inner,
 			setter: func(s string) error {
 				flagsCount[canonLookup[fl.Name]]++
+				byName[fl.Name]++
 				return inner.Set(s)
 			},
 		}
-		if bo, ok := inner.(interface{ IsBoolFlag() bool }); ok && bo.IsBoolFlag() {
-			setter.isBool = true
-		}
+		setter.isBool = isBoolFlag(fl)
 		fl.Value = setter
 	})
 
-	return flagsCount
+	return flagsCount, byName
 }
 
 type texter interface {
@@ -429,25 +2656,232 @@ func textMarshalerUnmarshaler(v reflect.Value) (texter, bool) {
 	return asp, okp
 }
 
-func (p *Parser) parseEnvVars(args []string, v interface{}) error {
-	prefix := p.EnvPrefix
+// flagValue returns the flag.Value implemented by v or by a pointer to v.
+func flagValue(v reflect.Value) (flag.Value, bool) {
+	asv, okv := v.Interface().(flag.Value)
+	asp, okp := v.Addr().Interface().(flag.Value)
+	if okv {
+		return asv, true
+	}
+	return asp, okp
+}
+
+// textUnmarshaler is like textMarshalerUnmarshaler, but only requires the
+// type (or a pointer to the type) to implement encoding.TextUnmarshaler.
+func textUnmarshaler(v reflect.Value) (encoding.TextUnmarshaler, bool) {
+	asv, okv := v.Interface().(encoding.TextUnmarshaler)
+	asp, okp := v.Addr().Interface().(encoding.TextUnmarshaler)
+	if okv {
+		return asv, true
+	}
+	return asp, okp
+}
+
+func normalizeFlagName(name string) string {
+	return strings.ReplaceAll(name, "_", "-")
+}
+
+// rewriteArgs returns a copy of args where each flag is replaced by the
+// list of flags returned by fn for that flag. The values of defined
+// non-boolean flags (as determined by the last flag returned by fn) and the
+// arguments after "--" are left untouched.
+func rewriteArgs(fs *flag.FlagSet, args []string, fn func(flagToken) []flagToken) []string {
+	res := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			res = append(res, args[i:]...)
+			break
+		}
+
+		tok, ok := parseFlagToken(arg)
+		if !ok {
+			res = append(res, arg)
+			continue
+		}
+
+		toks := fn(tok)
+		for _, t := range toks {
+			res = append(res, t.String())
+		}
+		if len(toks) == 0 {
+			continue
+		}
+
+		last := toks[len(toks)-1]
+		if fl := fs.Lookup(last.name); fl != nil && !last.hasValue && i+1 < len(args) && !isBoolFlag(fl) {
+			// the next argument is the value of this flag, keep it as-is
+			i++
+			res = append(res, args[i])
+		}
+	}
+	return res
+}
+
+// normalizeArgs returns a copy of args where the name of each flag is
+// normalized.
+func normalizeArgs(fs *flag.FlagSet, args []string) []string {
+	return rewriteArgs(fs, args, func(tok flagToken) []flagToken {
+		tok.name = normalizeFlagName(tok.name)
+		return []flagToken{tok}
+	})
+}
+
+// expandBoolClusters returns a copy of args where each single-dash flag that
+// is not defined but where every character is a defined boolean flag is
+// expanded into distinct flags, e.g. -abc is expanded to -a -b -c.
+func expandBoolClusters(fs *flag.FlagSet, args []string) []string {
+	return rewriteArgs(fs, args, func(tok flagToken) []flagToken {
+		if tok.dashes != "-" || tok.hasValue || len(tok.name) < 2 || fs.Lookup(tok.name) != nil {
+			return []flagToken{tok}
+		}
+
+		toks := make([]flagToken, 0, len(tok.name))
+		for _, r := range tok.name {
+			nm := string(r)
+			if !isBoolFlag(fs.Lookup(nm)) {
+				return []flagToken{tok}
+			}
+			toks = append(toks, flagToken{dashes: "-", name: nm})
+		}
+		return toks
+	})
+}
+
+// expandGluedValues returns a copy of args where each flag that is not
+// defined and has no explicit value but starts with the name of a defined
+// non-boolean flag is split into that flag and its value, e.g. -I/usr/include
+// is rewritten as -I=/usr/include. The longest matching flag name is used.
+func expandGluedValues(fs *flag.FlagSet, args []string) []string {
+	return rewriteArgs(fs, args, func(tok flagToken) []flagToken {
+		if tok.hasValue || fs.Lookup(tok.name) != nil {
+			return []flagToken{tok}
+		}
+
+		for i := len(tok.name) - 1; i > 0; i-- {
+			if fl := fs.Lookup(tok.name[:i]); fl != nil && !isBoolFlag(fl) {
+				tok.name, tok.value, tok.hasValue = tok.name[:i], tok.name[i:], true
+				break
+			}
+		}
+		return []flagToken{tok}
+	})
+}
+
+// expandPrefixes returns a copy of args where each flag that is not defined
+// but is a prefix of a single defined long (multi-character) flag name is
+// replaced with that flag, e.g. -ver is rewritten as -version. Names that
+// are aliases of the same flag (as per canonLookup) count as one. A flag that
+// is a prefix of many distinct flags is removed from the returned args, and
+// an error is returned for it.
+func expandPrefixes(fs *flag.FlagSet, canonLookup map[string]string, args []string) ([]string, []error) {
+	var errs []error
+	args = rewriteArgs(fs, args, func(tok flagToken) []flagToken {
+		if fs.Lookup(tok.name) != nil {
+			return []flagToken{tok}
+		}
+
+		var (
+			candidates []string
+			canons     = make(map[string]bool)
+		)
+		fs.VisitAll(func(fl *flag.Flag) {
+			if len(fl.Name) > 1 && strings.HasPrefix(fl.Name, tok.name) {
+				candidates = append(candidates, "-"+fl.Name)
+				canons[canonLookup[fl.Name]] = true
+			}
+		})
+
+		switch {
+		case len(candidates) == 0:
+			return []flagToken{tok}
+		case len(canons) == 1:
+			tok.name = candidates[0][1:]
+			return []flagToken{tok}
+		default:
+			errs = append(errs, &ParseError{
+				Kind: ErrUnknownFlag,
+				Flag: tok.name,
+				Err:  fmt.Errorf("ambiguous flag -%s: could be %s", tok.name, strings.Join(candidates, ", ")),
+			})
+			return nil
+		}
+	})
+	return args, errs
+}
+
+// flagToken is a command-line argument that has the form of a flag.
+type flagToken struct {
+	dashes   string
+	name     string
+	value    string
+	hasValue bool
+}
+
+func (t flagToken) String() string {
+	if t.hasValue {
+		return t.dashes + t.name + "=" + t.value
+	}
+	return t.dashes + t.name
+}
 
-	if prefix == "" && len(args) > 0 {
-		prefix = prefixFromProgramName(args[0])
+// parseFlagToken parses arg as a flag token, using the same rules as the
+// stdlib's flag package. It returns false if arg is not a flag.
+func parseFlagToken(arg string) (flagToken, bool) {
+	var tok flagToken
+	if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+		return tok, false
 	}
-	if prefix == "-" {
-		prefix = ""
+	tok.dashes = "-"
+	if arg[1] == '-' {
+		tok.dashes = "--"
+	}
+	name := arg[len(tok.dashes):]
+	if name == "" || name[0] == '-' || name[0] == '=' {
+		return tok, false
+	}
+	if ix := strings.Index(name, "="); ix >= 0 {
+		tok.value = name[ix+1:]
+		tok.hasValue = true
+		name = name[:ix]
+	}
+	tok.name = name
+	return tok, true
+}
+
+// consumedTerminator returns true if the args consumed by a successful
+// fs.Parse end with the "--" flags terminator, as opposed to a "--" value of
+// a non-boolean flag.
+func consumedTerminator(fs *flag.FlagSet, consumed []string) bool {
+	for i := 0; i < len(consumed); i++ {
+		if consumed[i] == "--" {
+			return i == len(consumed)-1
+		}
+		tok, ok := parseFlagToken(consumed[i])
+		if !ok {
+			return false
+		}
+		if !tok.hasValue && !isBoolFlag(fs.Lookup(tok.name)) {
+			// skip the flag's value
+			i++
+		}
 	}
-	return env.Parse(v, env.Options{Prefix: prefix})
+	return false
+}
+
+// isUnknownFlagError returns true if err is the error returned by the
+// stdlib's flag package for a flag that is not defined.
+func isUnknownFlagError(err error) bool {
+	// the flagset returns ErrHelp if -h or -help is provided but not defined
+	return err == flag.ErrHelp || strings.HasPrefix(err.Error(), "flag provided but not defined: ")
 }
 
-func prefixFromProgramName(name string) string {
-	name = filepath.Base(name)
-	ext := filepath.Ext(name)
-	if ext != "" {
-		name = strings.TrimSuffix(name, ext)
+func isBoolFlag(fl *flag.Flag) bool {
+	if fl == nil {
+		return false
 	}
-	return strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	bo, ok := fl.Value.(interface{ IsBoolFlag() bool })
+	return ok && bo.IsBoolFlag()
 }
 
 func sliceContains(sl []string, s string) bool {
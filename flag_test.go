@@ -1,8 +1,16 @@
 package mainer
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -138,6 +146,43 @@ func TestParseFlags(t *testing.T) {
 				args: []string{"arg1", "-i", "2"},
 			},
 		},
+		{
+			args: []string{"arg1", "--", "-x", "--", "arg2"},
+			want: &F{
+				args: []string{"arg1", "-x", "--", "arg2"},
+			},
+		},
+		{
+			args: []string{"--", "-x", "--", "arg2"},
+			want: &F{
+				args: []string{"-x", "--", "arg2"},
+			},
+		},
+		{
+			args: []string{"-b", "--", "-i", "2", "--"},
+			want: &F{
+				B:     true,
+				args:  []string{"-i", "2", "--"},
+				flags: map[string]bool{"b": true},
+			},
+		},
+		{
+			args: []string{"-s", "--", "-i", "2", "--", "-b"},
+			want: &F{
+				S:     "--",
+				I:     2,
+				args:  []string{"-b"},
+				flags: map[string]bool{"s": true, "i": true},
+			},
+		},
+		{
+			args: []string{"-s", "-s", "--", "-i", "2"},
+			want: &F{
+				S:     "-s",
+				args:  []string{"-i", "2"},
+				flags: map[string]bool{"s": true},
+			},
+		},
 		{
 			args: []string{"- sp ", "hello"},
 			want: &F{
@@ -180,6 +225,34 @@ func TestParseFlags(t *testing.T) {
 				flags: map[string]bool{"b": true},
 			},
 		},
+		{
+			args: []string{"arg1", "--int=5", "arg2", "-b=true"},
+			want: &F{
+				I:     5,
+				B:     true,
+				args:  []string{"arg1", "arg2"},
+				flags: map[string]bool{"i": true, "b": true},
+			},
+		},
+		{
+			args: []string{"arg1", "-i=5", "arg2", "--b=false", "arg3", "--s=-x=y", "arg4", "-"},
+			want: &F{
+				I:     5,
+				S:     "-x=y",
+				args:  []string{"arg1", "arg2", "arg3", "arg4", "-"},
+				flags: map[string]bool{"i": true, "b": true, "s": true},
+			},
+		},
+		{
+			args: []string{"arg1", "--int=x", "arg2"},
+			want: &F{},
+			err:  `invalid value "x" for flag -int`,
+		},
+		{
+			args: []string{"arg1", "--=x", "arg2"},
+			want: &F{},
+			err:  `bad flag syntax: --=x`,
+		},
 	}
 
 	var p Parser
@@ -263,6 +336,22 @@ func TestParseFlagsCount(t *testing.T) {
 				counts: map[string]int{"b": 1, "int": 3, "string": 2},
 			},
 		},
+		{
+			args: []string{"-i", "1", "-i=2"},
+			want: &Fc{
+				I:      2,
+				counts: map[string]int{"int": 2},
+			},
+		},
+		{
+			args: []string{"--int=1", "x", "-i", "2", "--s=a", "--string", "b", "-b=true", "-b"},
+			want: &Fc{
+				I:      2,
+				S:      "b",
+				B:      true,
+				counts: map[string]int{"int": 2, "string": 2, "b": 2},
+			},
+		},
 	}
 
 	var p Parser
@@ -284,6 +373,79 @@ func TestParseFlagsCount(t *testing.T) {
 	}
 }
 
+func TestParseResult(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want Result
+	}{
+		{
+			want: Result{},
+		},
+		{
+			args: []string{"a", "b"},
+			want: Result{ArgsCount: 2},
+		},
+		{
+			args: []string{"-b", "-b", "-s", "x"},
+			want: Result{FlagsSet: 2, FlagsCount: 3},
+		},
+		{
+			args: []string{"-b", "-i", "1", "--int", "2", "a", "-s", "x", "b", "-i", "3", "c", "--", "-b"},
+			want: Result{FlagsSet: 3, FlagsCount: 5, ArgsCount: 4},
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var fc Fc
+			args := append([]string{""}, tc.args...)
+			res, err := p.ParseResult(args, &fc)
+			c.Assert(err, qt.IsNil)
+			c.Assert(res, qt.Equals, tc.want)
+		})
+	}
+
+	// the result is also available for a struct that doesn't implement any
+	// of the Set hooks.
+	type F struct {
+		V bool `flag:"v,verbose"`
+	}
+	var f F
+	res, err := p.ParseResult([]string{"", "-v", "x", "-verbose"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(res, qt.Equals, Result{FlagsSet: 1, FlagsCount: 2, ArgsCount: 1})
+}
+
+func TestParseArgs(t *testing.T) {
+	c := qt.New(t)
+
+	var p Parser
+	var f F
+	args, err := p.ParseArgs([]string{"", "a", "-b", "b", "-s", "x", "c", "--", "-i", "d"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(args, qt.DeepEquals, []string{"a", "b", "c", "-i", "d"})
+	c.Assert(f.args, qt.DeepEquals, args)
+	c.Assert(f.B, qt.IsTrue)
+	c.Assert(f.S, qt.Equals, "x")
+
+	// no positional args
+	type V struct {
+		V bool `flag:"v"`
+	}
+	var v V
+	args, err = p.ParseArgs([]string{"", "-v"}, &v)
+	c.Assert(err, qt.IsNil)
+	c.Assert(args, qt.IsNil)
+
+	// error
+	args, err = p.ParseArgs([]string{"", "a", "-z"}, &v)
+	c.Assert(err, qt.ErrorMatches, `flag provided but not defined: -z`)
+	c.Assert(args, qt.IsNil)
+}
+
 func TestParseDefaultsSet(t *testing.T) {
 	c := qt.New(t)
 
@@ -354,184 +516,2491 @@ func TestParseArgsError(t *testing.T) {
 	c.Assert(err.Error(), qt.Contains, "not defined: -zz")
 }
 
-func TestParseDuplicateFlagName(t *testing.T) {
-	c := qt.New(t)
+func TestParseDuplicateFlagName(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		X bool `flag:"x"`
+		Y int  `flag:"x"`
+	}
+	var p Parser
+	f := F{}
+	c.Assert(func() {
+		_ = p.Parse([]string{"-x", "1"}, &f)
+	}, qt.PanicMatches, `flag redefined: x`)
+}
+
+func TestParseDuplicateAltFlagName(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		X bool `flag:"x,long-x"`
+		Y bool `flag:"y,long-x"`
+	}
+	var p Parser
+	f := F{}
+	c.Assert(func() {
+		_ = p.Parse([]string{"-x", "1"}, &f)
+	}, qt.PanicMatches, `flag redefined: long-x`)
+}
+
+func TestParseNotStructPointer(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		i int
+		p Parser
+	)
+	c.Assert(func() {
+		_ = p.Parse([]string{"-h"}, i)
+	}, qt.PanicMatches, `reflect:.+`)
+}
+
+func TestParseUnsupportedFlagType(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		C *bool `flag:"c"`
+	}
+	var (
+		f F
+		p Parser
+	)
+	c.Assert(func() {
+		_ = p.Parse([]string{"", "-h"}, &f)
+	}, qt.PanicMatches, `unsupported flag field kind: ptr \(C: \*bool\)`)
+}
+
+type Fsized struct {
+	I8  int8    `flag:"i8"`
+	I16 int16   `flag:"i16"`
+	I32 int32   `flag:"i32"`
+	U8  uint8   `flag:"u8"`
+	U16 uint16  `flag:"u16"`
+	U32 uint32  `flag:"u32"`
+	F32 float32 `flag:"f32"`
+
+	U16s []uint16 `flag:"u16s"`
+	I8s  []int8   `flag:"i8s" flagSeparator:","`
+}
+
+func TestParseSizedNumbers(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want *Fsized
+		err  string
+	}{
+		{
+			args: []string{"-i8", "-128", "-i16", "-32768", "-i32", "-2147483648"},
+			want: &Fsized{I8: -128, I16: -32768, I32: -2147483648},
+		},
+		{
+			args: []string{"-i8", "127", "-i16", "32767", "-i32", "2147483647"},
+			want: &Fsized{I8: 127, I16: 32767, I32: 2147483647},
+		},
+		{
+			args: []string{"-u8", "255", "-u16", "65535", "-u32", "4294967295"},
+			want: &Fsized{U8: 255, U16: 65535, U32: 4294967295},
+		},
+		{
+			args: []string{"-u8", "0", "-u16", "0", "-u32", "0", "-f32", "1.5"},
+			want: &Fsized{F32: 1.5},
+		},
+		{
+			args: []string{"-i8", "128"},
+			err:  `invalid value "128" for flag -i8: value out of range`,
+		},
+		{
+			args: []string{"-i16", "-32769"},
+			err:  `invalid value "-32769" for flag -i16: value out of range`,
+		},
+		{
+			args: []string{"-i32", "2147483648"},
+			err:  `invalid value "2147483648" for flag -i32: value out of range`,
+		},
+		{
+			args: []string{"-u16", "70000"},
+			err:  `invalid value "70000" for flag -u16: value out of range`,
+		},
+		{
+			args: []string{"-u8", "-1"},
+			err:  `invalid value "-1" for flag -u8: parse error`,
+		},
+		{
+			args: []string{"-u32", "4294967296"},
+			err:  `invalid value "4294967296" for flag -u32: value out of range`,
+		},
+		{
+			args: []string{"-f32", "1e39"},
+			err:  `invalid value "1e39" for flag -f32: value out of range`,
+		},
+		{
+			args: []string{"-i8", "x"},
+			err:  `invalid value "x" for flag -i8: parse error`,
+		},
+		{
+			args: []string{"-u16s", "1", "-u16s", "65535", "-i8s", "-128,0,127"},
+			want: &Fsized{U16s: []uint16{1, 65535}, I8s: []int8{-128, 0, 127}},
+		},
+		{
+			args: []string{"-u16s", "1", "-u16s", "65536"},
+			err:  `invalid value "65536" for flag -u16s: value out of range`,
+		},
+		{
+			args: []string{"-i8s", "1,128"},
+			err:  `invalid value "1,128" for flag -i8s: value out of range`,
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f Fsized
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+
+			if tc.err != "" {
+				c.Assert(err, qt.IsNotNil)
+				c.Assert(err.Error(), qt.Contains, tc.err)
+				return
+			}
+
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.DeepEquals, tc.want)
+		})
+	}
+}
+
+type Fnorm struct {
+	LogLevel string `flag:"log-level"`
+	MaxConn  int    `flag:"max_conn"`
+	DryRun   bool   `flag:"dry_run,n"`
+
+	args  []string
+	flags map[string]bool
+}
+
+func (f *Fnorm) SetArgs(args []string) {
+	f.args = args
+}
+
+func (f *Fnorm) SetFlags(flags map[string]bool) {
+	f.flags = flags
+}
+
+func TestParseNormalizeFlagNames(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want *Fnorm
+		err  string
+	}{
+		{
+			args: []string{"-log-level", "debug", "-max-conn", "1"},
+			want: &Fnorm{LogLevel: "debug", MaxConn: 1, flags: map[string]bool{"log-level": true, "max-conn": true}},
+		},
+		{
+			args: []string{"-log_level", "debug", "--max_conn=1"},
+			want: &Fnorm{LogLevel: "debug", MaxConn: 1, flags: map[string]bool{"log-level": true, "max-conn": true}},
+		},
+		{
+			args: []string{"-dry_run", "-log_level", "-a_b", "c_d"},
+			want: &Fnorm{LogLevel: "-a_b", DryRun: true, args: []string{"c_d"}, flags: map[string]bool{"dry-run": true, "log-level": true}},
+		},
+		{
+			args: []string{"-n", "a_b", "--", "-log_level", "x"},
+			want: &Fnorm{DryRun: true, args: []string{"a_b", "-log_level", "x"}, flags: map[string]bool{"dry-run": true}},
+		},
+		{
+			args: []string{"-log__level", "x"},
+			err:  "not defined: -log--level",
+		},
+	}
+
+	p := Parser{NormalizeFlagNames: true}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f Fnorm
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+
+			if tc.err != "" {
+				c.Assert(err, qt.IsNotNil)
+				c.Assert(err.Error(), qt.Contains, tc.err)
+				return
+			}
+
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(Fnorm{})), tc.want)
+		})
+	}
+}
+
+func TestParseNormalizeFlagNamesCollision(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		A string `flag:"log-level"`
+		B string `flag:"log_level"`
+	}
+	var f F
+
+	// without normalization, the flags are distinct
+	var p Parser
+	err := p.Parse([]string{"", "-log-level", "a", "-log_level", "b"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.A, qt.Equals, "a")
+	c.Assert(f.B, qt.Equals, "b")
+
+	p.NormalizeFlagNames = true
+	c.Assert(func() {
+		_ = p.Parse([]string{"", "-log-level", "a"}, &f)
+	}, qt.PanicMatches, `flag redefined after normalization: log-level \(log-level and log_level\)`)
+}
+
+type Fneg struct {
+	Verbose bool   `flag:"v,verbose,no-verbose"`
+	Color   bool   `flag:"no-color,color"`
+	Nope    bool   `flag:"no-op"`
+	Bs      []bool `flag:"b,no-b"`
+
+	flags  map[string]bool
+	counts map[string]int
+}
+
+func (f *Fneg) SetFlags(flags map[string]bool) {
+	f.flags = flags
+}
+
+func (f *Fneg) SetFlagsCount(counts map[string]int) {
+	f.counts = counts
+}
+
+func TestParseNegatableFlags(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		init Fneg
+		want *Fneg
+	}{
+		{
+			args: []string{"-verbose"},
+			want: &Fneg{Verbose: true, flags: map[string]bool{"v": true}, counts: map[string]int{"v": 1}},
+		},
+		{
+			args: []string{"-no-verbose"},
+			init: Fneg{Verbose: true},
+			want: &Fneg{flags: map[string]bool{"v": true}, counts: map[string]int{"v": 1}},
+		},
+		{
+			args: []string{"-verbose", "-no-verbose"},
+			want: &Fneg{flags: map[string]bool{"v": true}, counts: map[string]int{"v": 2}},
+		},
+		{
+			args: []string{"-no-verbose", "x", "-v"},
+			want: &Fneg{Verbose: true, flags: map[string]bool{"v": true}, counts: map[string]int{"v": 2}},
+		},
+		{
+			args: []string{"-no-verbose=false"},
+			want: &Fneg{Verbose: true, flags: map[string]bool{"v": true}, counts: map[string]int{"v": 1}},
+		},
+		{
+			args: []string{"-color", "-no-color"},
+			want: &Fneg{flags: map[string]bool{"no-color": true}, counts: map[string]int{"no-color": 2}},
+		},
+		{
+			// not a negated form, as there is no "op" flag
+			args: []string{"-no-op"},
+			want: &Fneg{Nope: true, flags: map[string]bool{"no-op": true}, counts: map[string]int{"no-op": 1}},
+		},
+		{
+			// not supported on slices, it is a plain alias
+			args: []string{"-b", "-no-b"},
+			want: &Fneg{Bs: []bool{true, true}, flags: map[string]bool{"b": true}, counts: map[string]int{"b": 2}},
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			f := tc.init
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(Fneg{})), tc.want)
+		})
+	}
+}
+
+type Fcount struct {
+	Verbosity int   `flag:"v,verbose,count"`
+	Debug     uint8 `flag:"count,d"`
+	Quiet     bool  `flag:"q"`
+
+	args   []string
+	counts map[string]int
+}
+
+func (f *Fcount) SetArgs(args []string) {
+	f.args = args
+}
+
+func (f *Fcount) SetFlagsCount(counts map[string]int) {
+	f.counts = counts
+}
+
+func TestParseCountFlags(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		init Fcount
+		want *Fcount
+		err  string
+	}{
+		{
+			want: &Fcount{},
+		},
+		{
+			args: []string{"-v", "-v", "-v"},
+			want: &Fcount{Verbosity: 3, counts: map[string]int{"v": 3}},
+		},
+		{
+			args: []string{"-v", "a", "--verbose", "-d", "b", "-v=false"},
+			want: &Fcount{Verbosity: 3, Debug: 1, args: []string{"a", "b"}, counts: map[string]int{"v": 3, "d": 1}},
+		},
+		{
+			args: []string{"-v", "-q", "-v"},
+			init: Fcount{Verbosity: 10},
+			want: &Fcount{Verbosity: 12, Quiet: true, counts: map[string]int{"v": 2, "q": 1}},
+		},
+		{
+			args: []string{"-count"},
+			err:  "flag provided but not defined: -count",
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			f := tc.init
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(Fcount{})), tc.want)
+		})
+	}
+}
+
+func TestParseIntBases(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		I   int      `flag:"i"`
+		I8  int8     `flag:"i8"`
+		I64 int64    `flag:"i64"`
+		U   uint     `flag:"u"`
+		U16 uint16   `flag:"u16"`
+		U64 uint64   `flag:"u64"`
+		Is  []int32  `flag:"is"`
+		Us  []uint64 `flag:"us" flagSeparator:","`
+	}
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want F
+		err  string
+	}{
+		{args: []string{"-i", "31", "-i8", "-12", "-u", "7"}, want: F{I: 31, I8: -12, U: 7}},
+		{args: []string{"-i", "0x1f", "-i8", "-0x7f", "-i64", "0X1F", "-u", "0xff", "-u16", "0xFFFF", "-u64", "0x10"}, want: F{I: 31, I8: -127, I64: 31, U: 255, U16: 65535, U64: 16}},
+		{args: []string{"-i", "0o17", "-i8", "017", "-i64", "-0o17", "-u", "0O17", "-u16", "010", "-u64", "0o0"}, want: F{I: 15, I8: 15, I64: -15, U: 15, U16: 8, U64: 0}},
+		{args: []string{"-i", "0b101", "-i8", "-0b1", "-i64", "0B11", "-u", "0b1", "-u16", "0b1111", "-u64", "0b10"}, want: F{I: 5, I8: -1, I64: 3, U: 1, U16: 15, U64: 2}},
+		{args: []string{"-i", "1_000"}, want: F{I: 1000}},
+		{args: []string{"-is", "0x10", "-is", "0b10", "-us", "0o10,10,0x10"}, want: F{Is: []int32{16, 2}, Us: []uint64{8, 10, 16}}},
+		{args: []string{"-u", "-0x1"}, err: `invalid value "-0x1" for flag -u: .*`},
+		{args: []string{"-u16", "-1"}, err: `invalid value "-1" for flag -u16: .*`},
+		{args: []string{"-i8", "0x80"}, err: `invalid value "0x80" for flag -i8: value out of range`},
+		{args: []string{"-i", "0b102"}, err: `invalid value "0b102" for flag -i: .*`},
+		{args: []string{"-i", "0x"}, err: `invalid value "0x" for flag -i: .*`},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f F
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Max   int64    `flag:"max-size" size:"true"`
+		Small uint16   `flag:"small" size:"true" max:"4096"`
+		Plain int64    `flag:"plain"`
+		Sizes []uint32 `flag:"sizes" size:"true" flagSeparator:","`
+	}
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want F
+		err  string
+	}{
+		{args: []string{"-max-size", "1024"}, want: F{Max: 1024}},
+		{args: []string{"-max-size", "0x10"}, want: F{Max: 16}},
+		{args: []string{"-max-size", "0xB"}, want: F{Max: 11}},
+		{args: []string{"-max-size", "10B"}, want: F{Max: 10}},
+		{args: []string{"-max-size", "10KB"}, want: F{Max: 10000}},
+		{args: []string{"-max-size", "10MB"}, want: F{Max: 10000000}},
+		{args: []string{"-max-size", "2GB"}, want: F{Max: 2000000000}},
+		{args: []string{"-max-size", "3TB"}, want: F{Max: 3000000000000}},
+		{args: []string{"-max-size", "10KiB"}, want: F{Max: 10240}},
+		{args: []string{"-max-size", "10MiB"}, want: F{Max: 10485760}},
+		{args: []string{"-max-size", "2GiB"}, want: F{Max: 2147483648}},
+		{args: []string{"-max-size", "1TiB"}, want: F{Max: 1099511627776}},
+		{args: []string{"-max-size", "5 mb"}, want: F{Max: 5000000}},
+		{args: []string{"-max-size", "-1kib"}, want: F{Max: -1024}},
+		{args: []string{"-small", "4KiB"}, want: F{Small: 4096}},
+		{args: []string{"-sizes", "1kb,1KiB,1"}, want: F{Sizes: []uint32{1000, 1024, 1}}},
+		{args: []string{"-small", "4KB", "-small", "5KB"}, err: `invalid value "5KB" for flag -small: value out of range: must be at most 4096`},
+		{args: []string{"-small", "64KiB"}, err: `invalid value "64KiB" for flag -small: value out of range`},
+		{args: []string{"-max-size", "10XB"}, err: `invalid value "10XB" for flag -max-size: parse error`},
+		{args: []string{"-max-size", "1.5GB"}, err: `invalid value "1.5GB" for flag -max-size: parse error`},
+		{args: []string{"-max-size", "MB"}, err: `invalid value "MB" for flag -max-size: parse error`},
+		{args: []string{"-max-size", "20000000TB"}, err: `invalid value "20000000TB" for flag -max-size: value out of range`},
+		{args: []string{"-sizes", "1,5GB"}, err: `invalid value "1,5GB" for flag -sizes: value out of range`},
+		{args: []string{"-plain", "10MB"}, err: `invalid value "10MB" for flag -plain: parse error`},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f F
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	type Invalid struct {
+		D time.Duration `flag:"d" size:"true"`
+	}
+	c.Assert(p.ValidateDefinition(&Invalid{}), qt.ErrorMatches, `size set on non-integer field D`)
+}
+
+func TestParsePercent(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Rate   float64   `flag:"sample-rate" percent:"true" max:"1" usage:"sampling rate"`
+		Small  float32   `flag:"small" percent:"true"`
+		Plain  float64   `flag:"plain"`
+		Ratios []float64 `flag:"r" percent:"true"`
+	}
+
+	cases := []struct {
+		args string // space-separated, index 0 added automatically
+		want F
+		err  string
+	}{
+		{args: "-sample-rate 0.25", want: F{Rate: 0.25}},
+		{args: "-sample-rate 25%", want: F{Rate: 0.25}},
+		{args: "-sample-rate 100%", want: F{Rate: 1}},
+		{args: "-sample-rate 0%", want: F{Rate: 0}},
+		{args: "-sample-rate 12.5%", want: F{Rate: 0.125}},
+		{args: "-sample-rate -10%", want: F{Rate: -0.1}},
+		{args: "-small 50%", want: F{Small: 0.5}},
+		{args: "-r 1% -r 0.5 -r 200%", want: F{Ratios: []float64{0.01, 0.5, 2}}},
+		{args: "-sample-rate 150%", err: `invalid value "150%" for flag -sample-rate: value out of range: must be at most 1`},
+		{args: "-sample-rate 25%%", err: `invalid value "25%%" for flag -sample-rate: parse error`},
+		{args: "-sample-rate %", err: `invalid value "%" for flag -sample-rate: parse error`},
+		{args: "-sample-rate abc%", err: `invalid value "abc%" for flag -sample-rate: parse error`},
+		{args: "-sample-rate 25%x", err: `invalid value "25%x" for flag -sample-rate: parse error`},
+		{args: "-r 1% -r 2%%", err: `invalid value "2%%" for flag -r: parse error`},
+		{args: "-plain 25%", err: `invalid value "25%" for flag -plain: parse error`},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(tc.args, func(c *qt.C) {
+			var f F
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	c.Assert(p.usage("prog", &F{Rate: 0.1}), qt.Equals, `Usage of prog:
+  -sample-rate float
+    	sampling rate (ratio or percentage, e.g. 0.25 or 25%) (at most 1) (default 0.1)
+  -small float
+    	(ratio or percentage, e.g. 0.25 or 25%)
+  -plain float
+  -r float
+    	(ratio or percentage, e.g. 0.25 or 25%)
+`)
+
+	type NonFloat struct {
+		N int `flag:"n" percent:"true"`
+	}
+	c.Assert(p.ValidateDefinition(&NonFloat{}), qt.ErrorMatches, `percent set on non-float field N`)
+}
+
+type Fbool struct {
+	A     bool `flag:"a"`
+	B     bool `flag:"b,bee"`
+	Cache bool `flag:"cache,no-cache"`
+
+	args   []string
+	flags  map[string]bool
+	counts map[string]int
+}
+
+func (f *Fbool) SetArgs(args []string) {
+	f.args = args
+}
+
+func (f *Fbool) SetFlags(flags map[string]bool) {
+	f.flags = flags
+}
+
+func (f *Fbool) SetFlagsCount(counts map[string]int) {
+	f.counts = counts
+}
+
+func TestParseBoolExplicitValues(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args string // space-separated, index 0 added automatically
+		init Fbool
+		want Fbool
+	}{
+		{
+			args: "-b=true -b=false",
+			want: Fbool{flags: map[string]bool{"b": true}, counts: map[string]int{"b": 2}},
+		},
+		{
+			args: "-b=false -b=true",
+			want: Fbool{B: true, flags: map[string]bool{"b": true}, counts: map[string]int{"b": 2}},
+		},
+		{
+			args: "x -b=false y",
+			init: Fbool{B: true},
+			want: Fbool{args: []string{"x", "y"}, flags: map[string]bool{"b": true}, counts: map[string]int{"b": 1}},
+		},
+		{
+			args: "x --bee=false y -b=true z",
+			want: Fbool{B: true, args: []string{"x", "y", "z"}, flags: map[string]bool{"b": true}, counts: map[string]int{"b": 2}},
+		},
+		{
+			args: "-a x -b=0 y",
+			init: Fbool{B: true},
+			want: Fbool{A: true, args: []string{"x", "y"}, flags: map[string]bool{"a": true, "b": true}, counts: map[string]int{"a": 1, "b": 1}},
+		},
+		{
+			// the value must be glued with "=", so false is an argument
+			args: "-b false",
+			want: Fbool{B: true, args: []string{"false"}, flags: map[string]bool{"b": true}, counts: map[string]int{"b": 1}},
+		},
+		{
+			args: "x -no-cache=false",
+			want: Fbool{Cache: true, args: []string{"x"}, flags: map[string]bool{"cache": true}, counts: map[string]int{"cache": 1}},
+		},
+		{
+			args: "-cache=true x -no-cache=true",
+			want: Fbool{args: []string{"x"}, flags: map[string]bool{"cache": true}, counts: map[string]int{"cache": 2}},
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(tc.args, func(c *qt.C) {
+			f := tc.init
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.CmpEquals(cmp.AllowUnexported(Fbool{})), tc.want)
+		})
+	}
+}
+
+type FcountByName struct {
+	Verbose int    `flag:"v,verbose,count"`
+	Name    string `flag:"n,name"`
+
+	counts       map[string]int
+	countsByName map[string]int
+}
+
+func (f *FcountByName) SetFlagsCount(counts map[string]int) {
+	f.counts = counts
+}
+
+func (f *FcountByName) SetFlagsCountByName(counts map[string]int) {
+	f.countsByName = counts
+}
+
+func TestParseFlagsCountByName(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want *FcountByName
+	}{
+		{
+			want: &FcountByName{},
+		},
+		{
+			args: []string{"-v", "--verbose", "-v", "-name", "a"},
+			want: &FcountByName{
+				Verbose:      3,
+				Name:         "a",
+				counts:       map[string]int{"v": 3, "n": 1},
+				countsByName: map[string]int{"v": 2, "verbose": 1, "name": 1},
+			},
+		},
+		{
+			args: []string{"-n", "a", "--name=b", "-n", "c"},
+			want: &FcountByName{
+				Name:         "c",
+				counts:       map[string]int{"n": 3},
+				countsByName: map[string]int{"n": 2, "name": 1},
+			},
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f FcountByName
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(FcountByName{})), tc.want)
+		})
+	}
+}
+
+type Fcluster struct {
+	A bool   `flag:"a"`
+	B bool   `flag:"b,bee"`
+	C bool   `flag:"c"`
+	V int    `flag:"v,count"`
+	S string `flag:"s"`
+	X bool   `flag:"ab"`
+
+	args   []string
+	counts map[string]int
+}
+
+func (f *Fcluster) SetArgs(args []string) {
+	f.args = args
+}
+
+func (f *Fcluster) SetFlagsCount(counts map[string]int) {
+	f.counts = counts
+}
+
+func TestParseBoolClusters(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want *Fcluster
+		err  string
+	}{
+		{
+			args: []string{"-bc"},
+			want: &Fcluster{B: true, C: true, counts: map[string]int{"b": 1, "c": 1}},
+		},
+		{
+			args: []string{"-vvv"},
+			want: &Fcluster{V: 3, counts: map[string]int{"v": 3}},
+		},
+		{
+			args: []string{"x", "-cva", "y", "-vv"},
+			want: &Fcluster{A: true, C: true, V: 3, args: []string{"x", "y"}, counts: map[string]int{"a": 1, "c": 1, "v": 3}},
+		},
+		{
+			// ab is a defined flag, not a cluster
+			args: []string{"-ab"},
+			want: &Fcluster{X: true, counts: map[string]int{"ab": 1}},
+		},
+		{
+			// value of a non-bool flag is not expanded
+			args: []string{"-s", "-abc"},
+			want: &Fcluster{S: "-abc", counts: map[string]int{"s": 1}},
+		},
+		{
+			// double-dash flags are not expanded
+			args: []string{"--bc"},
+			err:  "flag provided but not defined: -bc",
+		},
+		{
+			// s is not a boolean flag
+			args: []string{"-as"},
+			err:  "flag provided but not defined: -as",
+		},
+		{
+			args: []string{"-abz"},
+			err:  "flag provided but not defined: -abz",
+		},
+		{
+			args: []string{"-bc=true"},
+			err:  "flag provided but not defined: -bc",
+		},
+		{
+			args: []string{"x", "--", "-bc"},
+			want: &Fcluster{args: []string{"x", "-bc"}},
+		},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f Fcluster
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(Fcluster{})), tc.want)
+		})
+	}
+}
+
+func TestParseCountNonInteger(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		V bool `flag:"v,count"`
+	}
+	var (
+		f F
+		p Parser
+	)
+	c.Assert(func() {
+		_ = p.Parse([]string{"", "-v"}, &f)
+	}, qt.PanicMatches, `count option set on non-integer field V`)
+}
+
+type Funknown struct {
+	B bool   `flag:"b"`
+	S string `flag:"s"`
+
+	args    []string
+	unknown []string
+}
+
+func (f *Funknown) SetArgs(args []string) {
+	f.args = args
+}
+
+func (f *Funknown) SetUnknown(unknown []string) {
+	f.unknown = unknown
+}
+
+func TestParseAllowUnknown(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want *Funknown
+	}{
+		{
+			args: []string{"-b", "a"},
+			want: &Funknown{B: true, args: []string{"a"}},
+		},
+		{
+			args: []string{"-x", "-b", "a"},
+			want: &Funknown{B: true, args: []string{"a"}, unknown: []string{"-x"}},
+		},
+		{
+			args: []string{"-x", "1", "-b", "a"},
+			want: &Funknown{B: true, args: []string{"a"}, unknown: []string{"-x", "1"}},
+		},
+		{
+			args: []string{"a", "--x=1", "b", "-s", "v", "-h", "--help", "-y"},
+			want: &Funknown{S: "v", args: []string{"a", "b"}, unknown: []string{"--x=1", "-h", "--help", "-y"}},
+		},
+		{
+			args: []string{"-bz", "-z", "a", "b", "--", "-y"},
+			want: &Funknown{args: []string{"b", "-y"}, unknown: []string{"-bz", "-z", "a"}},
+		},
+	}
+
+	p := Parser{AllowUnknown: true}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f Funknown
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, qt.CmpEquals(cmp.AllowUnexported(Funknown{})), tc.want)
+		})
+	}
+
+	// strict by default
+	p.AllowUnknown = false
+	var f Funknown
+	err := p.Parse([]string{"", "-x"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -x")
+}
+
+func TestParseAllowGluedValues(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Include []string `flag:"I"`
+		Inc     string   `flag:"Inc"`
+		Level   int      `flag:"level"`
+		Verbose bool     `flag:"v"`
+		Debug   bool     `flag:"d"`
+	}
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want F
+		err  string
+	}{
+		{
+			args: []string{"-I/usr/include", "-I", "/opt", "--level3"},
+			want: F{Include: []string{"/usr/include", "/opt"}, Level: 3},
+		},
+		{
+			// ambiguous prefix, resolved with the longest match
+			args: []string{"-Incx", "-Ix"},
+			want: F{Inc: "x", Include: []string{"x"}},
+		},
+		{
+			// defined flags and explicit values are not split
+			args: []string{"-Inc", "a", "-Inc=b", "-I=nc"},
+			want: F{Inc: "b", Include: []string{"nc"}},
+		},
+		{
+			// boolean flags cannot have glued values
+			args: []string{"-vd", "-vx"},
+			err:  "flag provided but not defined: -vx",
+		},
+		{
+			args: []string{"-levelx"},
+			err:  `invalid value "x" for flag -level: parse error`,
+		},
+	}
+
+	p := Parser{AllowGluedValues: true}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f F
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	// disabled by default
+	p.AllowGluedValues = false
+	var f F
+	err := p.Parse([]string{"", "-I/usr/include"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -I/usr/include")
+}
+
+func TestParseAllowPrefixMatch(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Version bool   `flag:"version"`
+		Verbose bool   `flag:"verbose,verb"`
+		Level   int    `flag:"level,lvl"`
+		Name    string `flag:"n,name"`
+		Quiet   bool   `flag:"q"`
+	}
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		want F
+		err  string
+	}{
+		{
+			// unique prefixes
+			args: []string{"-vers", "--le", "2", "-na=x"},
+			want: F{Version: true, Level: 2, Name: "x"},
+		},
+		{
+			// aliases of the same flag are not ambiguous
+			args: []string{"-verb", "-l=3"},
+			want: F{Verbose: true, Level: 3},
+		},
+		{
+			// exact match wins
+			args: []string{"-n", "y"},
+			want: F{Name: "y"},
+		},
+		{
+			args: []string{"-ver"},
+			err:  `ambiguous flag -ver: could be -verb, -verbose, -version`,
+		},
+		{
+			// single-character names are not candidates
+			args: []string{"-qx"},
+			err:  `flag provided but not defined: -qx`,
+		},
+	}
+
+	p := Parser{AllowPrefixMatch: true}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f F
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrUnknownFlag)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	// ambiguous flags are collected and removed
+	p.CollectAllErrors = true
+	var f F
+	err := p.Parse([]string{"", "-ver", "-x", "-lev", "4"}, &f)
+	c.Assert(err, qt.ErrorMatches, "ambiguous flag -ver: could be -verb, -verbose, -version\nflag provided but not defined: -x")
+	c.Assert(f, qt.DeepEquals, F{Level: 4})
+
+	// disabled by default
+	p = Parser{}
+	err = p.Parse([]string{"", "-vers"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -vers")
+}
+
+type TLSFlags struct {
+	Cert string `flag:"tls-cert" env:"TLS_CERT" usage:"certificate file"`
+	Key  string `flag:"tls-key"`
+}
+
+type ServerFlags struct {
+	TLSFlags
+	Addr string `flag:"addr"`
+}
+
+type Fembed struct {
+	*ServerFlags
+	Verbose bool `flag:"v"`
+
+	flags map[string]bool
+}
+
+func (f *Fembed) SetFlags(flags map[string]bool) {
+	f.flags = flags
+}
+
+func TestParseEmbeddedStructs(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_TLS_CERT", "env.pem")
+
+	p := Parser{EnvVars: true}
+	f := Fembed{ServerFlags: &ServerFlags{}}
+	err := p.Parse([]string{"prog", "-tls-key", "k", "-addr", ":80", "-v"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Cert, qt.Equals, "env.pem")
+	c.Assert(f.Key, qt.Equals, "k")
+	c.Assert(f.Addr, qt.Equals, ":80")
+	c.Assert(f.Verbose, qt.IsTrue)
+	c.Assert(f.flags, qt.DeepEquals, map[string]bool{"tls-key": true, "addr": true, "v": true})
+	c.Assert(p.usage("prog", &Fembed{ServerFlags: &ServerFlags{}}), qt.Equals, `Usage of prog:
+  -tls-cert string
+    	certificate file
+  -tls-key string
+  -addr string
+  -v
+`)
+
+	// a nil embedded pointer defines no flag
+	f = Fembed{}
+	err = p.Parse([]string{"prog", "-addr", ":80"}, &f)
+	c.Assert(err, qt.ErrorMatches, `flag provided but not defined: -addr`)
+
+	type Dup struct {
+		TLSFlags
+		Other string `flag:"tls-key"`
+	}
+	c.Assert(func() { _ = p.Parse([]string{"prog"}, &Dup{}) }, qt.PanicMatches, `flag redefined: tls-key`)
+}
+
+type DBFlags struct {
+	Host  string `flag:"host" env:"HOST" usage:"database host"`
+	Port  int    `flag:"port,requires=host"`
+	Cache bool   `flag:"cache,no-cache"`
+}
+
+type Fprefixed struct {
+	Primary DBFlags  `flagprefix:"primary-" envPrefix:"PRIMARY_"`
+	Replica *DBFlags `flagprefix:"replica-" envPrefix:"REPLICA_"`
+
+	flags map[string]bool
+}
+
+func (f *Fprefixed) SetFlags(flags map[string]bool) {
+	f.flags = flags
+}
+
+func TestParseFlagPrefix(t *testing.T) {
+	c := qt.New(t)
+
+	c.Setenv("PROG_REPLICA_HOST", "replica.local")
+
+	p := Parser{EnvVars: true}
+	f := Fprefixed{Primary: DBFlags{Cache: true}, Replica: &DBFlags{}}
+	err := p.Parse([]string{"prog", "-primary-host", "primary.local", "-primary-port", "1",
+		"-replica-port", "2", "-no-primary-cache", "-replica-cache"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Primary, qt.Equals, DBFlags{Host: "primary.local", Port: 1, Cache: false})
+	c.Assert(*f.Replica, qt.Equals, DBFlags{Host: "replica.local", Port: 2, Cache: true})
+	c.Assert(f.flags, qt.DeepEquals, map[string]bool{
+		"primary-host": true, "primary-port": true, "replica-port": true, "primary-cache": true, "replica-cache": true,
+	})
+
+	infos := p.FlagNames(&Fprefixed{Replica: &DBFlags{}})
+	c.Assert(infos, qt.HasLen, 6)
+	c.Assert(infos[3].Name, qt.Equals, "replica-host")
+	c.Assert(infos[3].Env, qt.Equals, "REPLICA_HOST")
+
+	// the required flags are prefixed too
+	f = Fprefixed{Replica: &DBFlags{}}
+	err = p.Parse([]string{"prog", "-primary-port", "1", "-replica-host", "x", "-replica-port", "2"}, &f)
+	c.Assert(err, qt.ErrorMatches, `-primary-port requires -primary-host`)
+
+	type Dup struct {
+		DB  DBFlags `flagprefix:"db-"`
+		DB2 DBFlags `flagprefix:"db-"`
+	}
+	c.Assert(func() { _ = p.Parse([]string{"prog"}, &Dup{}) }, qt.PanicMatches, `flag redefined: db-host\n(?s:.*)`)
+}
+
+func TestParseExclusiveGroups(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		JSON    bool   `flag:"json,j,group=format"`
+		YAML    bool   `flag:"yaml,group=format"`
+		Text    bool   `flag:"text,group=format"`
+		Quiet   bool   `flag:"q,group=output"`
+		Out     string `flag:"o,group=output"`
+		Help    bool   `flag:"h,help"`
+		Version bool   `flag:"version"`
+	}
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		flag string
+		err  string
+	}{
+		{args: []string{"-json", "-q"}},
+		{args: []string{"-json", "-j", "--json"}},
+		{args: []string{"-yaml", "-json"}, flag: "yaml", err: `mutually exclusive flags provided: -json, -yaml`},
+		{args: []string{"-j", "-text", "-yaml"}, flag: "yaml", err: `mutually exclusive flags provided: -json, -yaml, -text`},
+		{args: []string{"-json", "-o", "x", "-q"}, flag: "o", err: `mutually exclusive flags provided: -q, -o`},
+		{args: []string{"-json", "-yaml", "-h"}},
+		{args: []string{"-json", "-yaml", "-version"}},
+		{args: []string{"-json", "-yaml=false"}, flag: "yaml", err: `mutually exclusive flags provided: -json, -yaml`},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var f F
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &f)
+			if tc.err == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tc.err)
+			var pe *ParseError
+			c.Assert(errors.As(err, &pe), qt.IsTrue)
+			c.Assert(pe.Kind, qt.Equals, ErrExclusive)
+			c.Assert(pe.Flag, qt.Equals, tc.flag)
+		})
+	}
+}
+
+func TestParseDashValues(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Label   string   `flag:"label,l"`
+		Tags    []string `flag:"tag"`
+		N       int      `flag:"n"`
+		X       float64  `flag:"x"`
+		Prod    bool     `flag:"prod,p"`
+		Verbose bool     `flag:"verbose,v"`
+		Version bool     `flag:"version"`
+	}
+
+	cases := []struct {
+		args     string // space-separated, index 0 added automatically
+		want     F
+		nonFlags []string
+		err      string
+	}{
+		{args: "-label -prod", want: F{Label: "-prod"}},
+		{args: "a -label -prod b", want: F{Label: "-prod"}, nonFlags: []string{"a", "b"}},
+		{args: "-l -pv -p", want: F{Label: "-pv", Prod: true}},
+		{args: "--label -ver", want: F{Label: "-ver"}},
+		{args: "-label -l", want: F{Label: "-l"}},
+		{args: "-label --", want: F{Label: "--"}},
+		{args: "-label -- x", want: F{Label: "--"}, nonFlags: []string{"x"}},
+		{args: "-tag -a -tag --b", want: F{Tags: []string{"-a", "--b"}}},
+		{args: "-n -5 -x -1.5 -label -1", want: F{Label: "-1", N: -5, X: -1.5}},
+		{args: "a -n -5 b -label -1e3 c", want: F{Label: "-1e3", N: -5}, nonFlags: []string{"a", "b", "c"}},
+		{args: "-prod -label", err: `flag needs an argument: -label`},
+	}
+
+	parsers := []Parser{
+		{},
+		{AllowPrefixMatch: true},
+		{NormalizeFlagNames: true},
+		{AllowGluedValues: true},
+		{CollectAllErrors: true},
+		{AllowUnknown: true},
+	}
+	for i, p := range parsers {
+		p := p
+		for _, tc := range cases {
+			c.Run(fmt.Sprintf("%d: %s", i, tc.args), func(c *qt.C) {
+				var f F
+				nonFlags, err := p.ParseArgs(append([]string{""}, strings.Fields(tc.args)...), &f)
+				if tc.err != "" {
+					c.Assert(err, qt.ErrorMatches, tc.err)
+					return
+				}
+				c.Assert(err, qt.IsNil)
+				c.Assert(f, qt.DeepEquals, tc.want)
+				c.Assert(nonFlags, qt.DeepEquals, tc.nonFlags)
+			})
+		}
+	}
+}
+
+type color int
+
+const (
+	red color = iota + 1
+	green
+	blue
+)
+
+type point struct{ X, Y int }
+
+func TestParseRegisterConverter(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Color   color   `flag:"color" env:"COLOR"`
+		Colors  []color `flag:"colors" flagSeparator:","`
+		Palette []color `flag:"p" env:"PALETTE"`
+		Origin  point   `flag:"origin"`
+		Last    color   `arg:"0"`
+	}
+
+	// without converters, those types are not supported
+	var p Parser
+	c.Assert(p.ValidateDefinition(&F{}), qt.ErrorMatches, `(?s).*unsupported flag field kind: struct \(Origin: mainer.point\)`)
+
+	p = Parser{EnvVars: true, EnvPrefix: "PROG"}
+	p.RegisterConverter(reflect.TypeOf(color(0)), func(s string) (interface{}, error) {
+		switch s {
+		case "red":
+			return red, nil
+		case "green":
+			return green, nil
+		case "blue":
+			return blue, nil
+		case "bad":
+			return 1, nil
+		default:
+			return nil, errors.New("unknown color")
+		}
+	})
+	p.RegisterConverter(reflect.TypeOf(point{}), func(s string) (interface{}, error) {
+		var pt point
+		_, err := fmt.Sscanf(s, "%d,%d", &pt.X, &pt.Y)
+		return pt, err
+	})
+	c.Assert(p.ValidateDefinition(&F{}), qt.IsNil)
+
+	c.Setenv("PROG_COLOR", "green")
+	c.Setenv("PROG_PALETTE", "red,blue")
+	var f F
+	err := p.Parse([]string{"", "-colors", "blue,red", "-origin", "1,2", "green"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{
+		Color:   green,
+		Colors:  []color{blue, red},
+		Palette: []color{red, blue},
+		Origin:  point{1, 2},
+		Last:    green,
+	})
+
+	f = F{}
+	err = p.Parse([]string{"", "-color", "blue", "-p", "green", "-p", "red", "blue"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Color, qt.Equals, blue)
+	c.Assert(f.Palette, qt.DeepEquals, []color{red, blue, green, red})
+
+	err = p.Parse([]string{"", "-color", "pink", "red"}, &F{})
+	c.Assert(err, qt.ErrorMatches, `invalid value "pink" for flag -color: unknown color`)
+	err = p.Parse([]string{"", "-p", "bad", "red"}, &F{})
+	c.Assert(err, qt.ErrorMatches, `invalid value "bad" for flag -p: converter returned int, want mainer.color`)
+	c.Setenv("PROG_COLOR", "pink")
+	err = p.Parse([]string{"", "red"}, &F{})
+	c.Assert(err, qt.ErrorMatches, `.*unknown color`)
+
+	// a nil converter removes the registered one
+	p.RegisterConverter(reflect.TypeOf(point{}), nil)
+	c.Assert(p.ValidateDefinition(&F{}), qt.ErrorMatches, `unsupported flag field kind: struct \(Origin: mainer.point\)`)
+}
+
+func TestParseChoices(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Level   string   `flag:"level,l" env:"LEVEL" choices:"debug,info,warn,error" usage:"log level"`
+		Formats []string `flag:"format" env:"FORMATS" choices:"json, yaml" choicesIgnoreCase:"true"`
+		Split   []string `flag:"split" flagSeparator:"," choices:"a,b"`
+	}
+
+	cases := []struct {
+		env  map[string]string
+		args string // space-separated, index 0 added automatically
+		want F
+		err  string
+	}{
+		{args: "-level warn -format JSON -format yaml", want: F{Level: "warn", Formats: []string{"json", "yaml"}}},
+		{args: "-l foo", err: `invalid value "foo" for flag -l: must be one of debug, info, warn, error`},
+		{args: "-level Info", err: `invalid value "Info" for flag -level: must be one of debug, info, warn, error`},
+		{args: "-format xml", err: `invalid value "xml" for flag -format: must be one of json, yaml`},
+		{args: "-split b,a", want: F{Split: []string{"b", "a"}}},
+		{args: "-split a,c", err: `invalid value "a,c" for flag -split: must be one of a, b`},
+		{env: map[string]string{"LEVEL": "error", "FORMATS": "Yaml,JSON"}, want: F{Level: "error", Formats: []string{"yaml", "json"}}},
+		{env: map[string]string{"LEVEL": "fatal"}, err: `env: invalid value "fatal" for PROG_LEVEL: must be one of debug, info, warn, error`},
+		{env: map[string]string{"FORMATS": "json,xml"}, err: `env: invalid value "xml" for PROG_FORMATS: must be one of json, yaml`},
+	}
+
+	p := Parser{EnvVars: true, EnvPrefix: "PROG"}
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%v %s", tc.env, tc.args), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			var f F
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	c.Assert(p.usage("prog", &F{Level: "info"}), qt.Equals, `Usage of prog:
+  -level, -l string
+    	log level (one of debug, info, warn, error) (default "info")
+  -format string
+    	(one of json, yaml)
+  -split string
+    	(one of a, b)
+`)
+
+	type Invalid struct {
+		N int `flag:"n" choices:"1,2"`
+	}
+	c.Assert(p.ValidateDefinition(&Invalid{}), qt.ErrorMatches, `choices set on non-string field N`)
+}
+
+func TestParseRange(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Port    int           `flag:"port" env:"PORT" min:"1" max:"65535" usage:"listen port"`
+		Ratio   float32       `flag:"ratio" min:"0.5"`
+		Timeout time.Duration `flag:"timeout" max:"1m"`
+		Weights []uint8       `flag:"w" env:"WEIGHTS" min:"1" max:"9"`
+		Verbose int           `flag:"v,count" max:"2"`
+	}
+
+	cases := []struct {
+		env  map[string]string
+		args string // space-separated, index 0 added automatically
+		want F
+		err  string
+	}{
+		{args: "-port 1 -ratio 0.5 -timeout 1m -w 1 -w 9 -v -v", want: F{Port: 1, Ratio: 0.5, Timeout: time.Minute, Weights: []uint8{1, 9}, Verbose: 2}},
+		{args: "-port 65535", want: F{Port: 65535}},
+		{args: "-port 0", err: `invalid value "0" for flag -port: value out of range: must be between 1 and 65535`},
+		{args: "-port 65536", err: `invalid value "65536" for flag -port: value out of range: must be between 1 and 65535`},
+		{args: "-ratio 0.49", err: `invalid value "0.49" for flag -ratio: value out of range: must be at least 0.5`},
+		{args: "-timeout 61s", err: `invalid value "61s" for flag -timeout: value out of range: must be at most 1m`},
+		{args: "-w 5 -w 10", err: `invalid value "10" for flag -w: value out of range: must be between 1 and 9`},
+		{args: "-v -v -v", err: `invalid boolean flag v: value out of range: must be at most 2`},
+		{env: map[string]string{"PORT": "80", "WEIGHTS": "1,2"}, want: F{Port: 80, Weights: []uint8{1, 2}}},
+		{env: map[string]string{"PORT": "70000"}, err: `env: invalid value "70000" for PROG_PORT: value out of range: must be between 1 and 65535`},
+		{env: map[string]string{"WEIGHTS": "1,0"}, err: `env: invalid value "0" for PROG_WEIGHTS: value out of range: must be between 1 and 9`},
+	}
+
+	p := Parser{EnvVars: true, EnvPrefix: "PROG"}
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%v %s", tc.env, tc.args), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			var f F
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
+	}
+
+	// with CollectAllErrors, the out of range value is not stored
+	p = Parser{CollectAllErrors: true}
+	f := F{Port: 80}
+	err := p.Parse([]string{"", "-port", "0", "-ratio", "1"}, &f)
+	c.Assert(err, qt.ErrorMatches, `invalid value "0" for flag -port: .*`)
+	c.Assert(f.Port, qt.Equals, 80)
+	c.Assert(f.Ratio, qt.Equals, float32(1))
+
+	c.Assert(p.usage("prog", &F{Port: 80}), qt.Equals, `Usage of prog:
+  -port int
+    	listen port (between 1 and 65535) (default 80)
+  -ratio float
+    	(at least 0.5)
+  -timeout duration
+    	(at most 1m)
+  -w uint
+    	(between 1 and 9)
+  -v
+    	(at most 2)
+`)
+
+	type NonNumeric struct {
+		S string `flag:"s" min:"1"`
+	}
+	c.Assert(p.ValidateDefinition(&NonNumeric{}), qt.ErrorMatches, `min or max set on non-numeric field S`)
+	type InvalidBound struct {
+		N int `flag:"n" max:"x"`
+	}
+	c.Assert(p.ValidateDefinition(&InvalidBound{}), qt.ErrorMatches, `invalid max validation rule on field N: .*`)
+}
+
+func TestParseHelpFlags(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		JSON  bool `flag:"json,group=format"`
+		YAML  bool `flag:"yaml,group=format"`
+		Help  bool `flag:"?,usage"`
+		Other bool `flag:"help"`
+	}
+
+	cases := []struct {
+		helpFlags []string
+		args      []string
+		err       string
+	}{
+		{nil, []string{"-json", "-yaml", "-?"}, `mutually exclusive flags provided: -json, -yaml`},
+		{nil, []string{"-json", "-yaml", "-help"}, ``},
+		{nil, []string{"-json", "-h"}, `flag provided but not defined: -h`},
+		{[]string{"?", "usage"}, []string{"-json", "-yaml", "-?"}, ``},
+		{[]string{"?", "usage"}, []string{"-json", "-yaml", "--usage"}, ``},
+		{[]string{"?", "usage"}, []string{"-json", "-yaml", "-help"}, `mutually exclusive flags provided: -json, -yaml`},
+		{[]string{"?", "usage"}, []string{"-json", "--h=1"}, `flag provided but not defined: -h`},
+		{[]string{}, []string{"-json", "-yaml", "-?"}, `mutually exclusive flags provided: -json, -yaml`},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%v %s", tc.helpFlags, strings.Join(tc.args, " ")), func(c *qt.C) {
+			p := Parser{HelpFlags: tc.helpFlags}
+			var f F
+			err := p.Parse(append([]string{""}, tc.args...), &f)
+			if tc.err == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tc.err)
+		})
+	}
+}
+
+func TestParseRequires(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		TLS     bool   `flag:"tls,t" env:"TLS"`
+		TLSCert string `flag:"tls-cert,requires=tls" env:"TLS_CERT"`
+		TLSKey  string `flag:"tls-key,requires=t,requires=tls-cert"`
+	}
+
+	cases := []struct {
+		env  map[string]string // prefix-less env vars, EnvVars is true if set
+		args []string
+		flag string
+		err  string
+	}{
+		{args: []string{}},
+		{args: []string{"-tls"}},
+		{args: []string{"-tls", "-tls-cert", "x"}},
+		{args: []string{"-t", "-tls-cert", "x", "-tls-key", "y"}},
+		{args: []string{"-tls-cert", "x"}, flag: "tls-cert", err: `-tls-cert requires -tls`},
+		{args: []string{"-tls", "-tls-key", "y"}, flag: "tls-key", err: `-tls-key requires -tls-cert`},
+		{args: []string{"-tls-key", "y"}, flag: "tls-key", err: `-tls-key requires -t`},
+		{env: map[string]string{"TLS": "1"}, args: []string{"-tls-cert", "x"}},
+		{env: map[string]string{"TLS": "1", "TLS_CERT": "x"}, args: []string{"-tls-key", "y"}},
+		{env: map[string]string{"TLS_CERT": "x"}, flag: "tls-cert", err: `-tls-cert requires -tls`},
+	}
+
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var p Parser
+			if tc.env != nil {
+				p.EnvVars = true
+				for k, v := range tc.env {
+					c.Setenv("PROG_"+k, v)
+				}
+			}
+
+			var f F
+			err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+			if tc.err == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tc.err)
+			var pe *ParseError
+			c.Assert(errors.As(err, &pe), qt.IsTrue)
+			c.Assert(pe.Kind, qt.Equals, ErrRequired)
+			c.Assert(pe.Flag, qt.Equals, tc.flag)
+		})
+	}
+
+	type Undef struct {
+		A string `flag:"a,requires=b"`
+	}
+	var p Parser
+	c.Assert(func() { _ = p.Parse([]string{""}, &Undef{}) }, qt.PanicMatches, `undefined flag b required by field A`)
+
+	c.Run("normalized", func(c *qt.C) {
+		type N struct {
+			UseTLS bool   `flag:"use_tls"`
+			Cert   string `flag:"cert,requires=use_tls"`
+			Key    string `flag:"key,requires=use-tls"`
+		}
+		p := Parser{NormalizeFlagNames: true}
+		c.Assert(p.ValidateDefinition(&N{}), qt.IsNil)
+
+		var f N
+		err := p.Parse([]string{"", "-cert", "x"}, &f)
+		c.Assert(err, qt.ErrorMatches, `-cert requires -use-tls`)
+
+		f = N{}
+		err = p.Parse([]string{"", "-use_tls", "-cert", "x", "-key", "y"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f, qt.Equals, N{UseTLS: true, Cert: "x", Key: "y"})
+	})
+}
+
+type versioned struct {
+	ShowVersion bool   `flag:"v,version"`
+	Addr        string `flag:"addr"`
+
+	requested *string
+}
+
+func (*versioned) Version() string { return "1.2.3" }
+
+func (f *versioned) SetVersionRequested(version string) {
+	f.requested = &version
+}
+
+func (f *versioned) Validate() error {
+	if f.requested == nil && f.Addr == "" {
+		return errors.New("addr must be set")
+	}
+	return nil
+}
+
+type versionRequestedOnly struct {
+	V bool `flag:"version"`
+
+	requested *string
+}
+
+func (f *versionRequestedOnly) SetVersionRequested(version string) {
+	f.requested = &version
+}
+
+func TestParseVersionRequested(t *testing.T) {
+	c := qt.New(t)
+
+	var p Parser
+
+	for _, flag := range []string{"-v", "--version", "-v=true"} {
+		var f versioned
+		err := p.Parse([]string{"", "-addr", "x", flag}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.requested, qt.IsNotNil)
+		c.Assert(*f.requested, qt.Equals, "1.2.3")
+	}
+
+	// not called if the version flag is not set, or set to false
+	var f versioned
+	err := p.Parse([]string{"", "-addr", "x"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.requested, qt.IsNil)
+	err = p.Parse([]string{"", "-addr", "x", "-version=false"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.requested, qt.IsNil)
+
+	// the hook can be used by Validate
+	f = versioned{}
+	err = p.Parse([]string{"", "-v"}, &f)
+	c.Assert(err, qt.IsNil)
+	err = p.Parse([]string{""}, &versioned{})
+	c.Assert(err, qt.ErrorMatches, "addr must be set")
+
+	// empty version without Version method
+	var fo versionRequestedOnly
+	err = p.Parse([]string{"", "-version"}, &fo)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fo.requested, qt.IsNotNil)
+	c.Assert(*fo.requested, qt.Equals, "")
+}
+
+type prodDefaults struct {
+	Production bool     `flag:"production,prod"`
+	LogLevel   string   `flag:"log-level" env:"LOG_LEVEL"`
+	Tags       []string `flag:"tag"`
+
+	set map[string]bool
+}
+
+func (f *prodDefaults) SetDefaultsForFlags(set map[string]bool) {
+	f.set = set
+	if set["production"] {
+		f.LogLevel = "warn"
+	}
+}
+
+func TestParseSetDefaultsForFlags(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		env  map[string]string // with the PROG_ prefix added automatically
+		args []string
+		want string
+	}{
+		{args: nil, want: "debug"},
+		{args: []string{"-tag", "a"}, want: "debug"},
+		{args: []string{"-prod"}, want: "warn"},
+		{args: []string{"-production", "-log-level", "info"}, want: "info"},
+		{env: map[string]string{"LOG_LEVEL": "error"}, args: []string{"-prod"}, want: "error"},
+	}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			p := Parser{EnvVars: true}
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+
+			f := prodDefaults{LogLevel: "debug", Tags: make([]string, 0, 4)}
+			err := p.Parse(append([]string{"prog"}, tc.args...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f.LogLevel, qt.Equals, tc.want)
+		})
+	}
+
+	// the set is determined without altering the value, and is reported even if
+	// the parsing fails afterwards.
+	f := prodDefaults{LogLevel: "debug", Tags: make([]string, 0, 4)}
+	var p Parser
+	err := p.Parse([]string{"prog", "-tag", "a", "-prod", "-z"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -z")
+	c.Assert(f.set, qt.DeepEquals, map[string]bool{"tag": true, "production": true})
+	c.Assert(f.Tags, qt.DeepEquals, []string{"a"})
+}
+
+// labelsValue is a map-backed flag.Value, where each value is a key=value
+// pair.
+type labelsValue map[string]string
+
+func (l labelsValue) Set(s string) error {
+	k, v, _ := strings.Cut(s, "=")
+	l[k] = v
+	return nil
+}
+
+func (l labelsValue) String() string { return fmt.Sprint(map[string]string(l)) }
+
+// countingValue is a pointer-backed flag.Value that counts its Set calls.
+type countingValue struct{ n int }
+
+func (cv *countingValue) Set(string) error { cv.n++; return nil }
+func (cv *countingValue) String() string   { return "" }
+
+type sharedStorageDefaults struct {
+	Labels  labelsValue    `flag:"label"`
+	Counter *countingValue `flag:"count-me"`
+	*DiffDB
+
+	set map[string]bool
+}
+
+func (f *sharedStorageDefaults) SetDefaultsForFlags(set map[string]bool) {
+	f.set = set
+}
+
+func TestParseSetDefaultsForFlagsFreshValue(t *testing.T) {
+	c := qt.New(t)
+
+	f := sharedStorageDefaults{
+		Labels:  labelsValue{"keep": "1"},
+		Counter: &countingValue{},
+		DiffDB:  &DiffDB{},
+	}
+	args := []string{"prog", "-label", "a=b", "-count-me", "x", "-db-host", "h"}
+	var p Parser
+	err := p.Parse(args, &f)
+	c.Assert(err, qt.IsNil)
+
+	// the dry run reports the flags, including those of the embedded pointer
+	c.Assert(f.set, qt.DeepEquals, map[string]bool{"label": true, "count-me": true, "db-host": true})
+	// the values are only applied once, by the actual parsing
+	c.Assert(f.Labels, qt.DeepEquals, labelsValue{"keep": "1", "a": "b"})
+	c.Assert(f.Counter.n, qt.Equals, 1)
+	c.Assert(f.DiffDB.Host, qt.Equals, "h")
+}
+
+type linuxOnly string
+
+func (linuxOnly) SkipOnPlatform() bool { return true }
+
+type windowsOnly struct{ upcaseVal }
+
+func (*windowsOnly) SkipOnPlatform() bool { return false }
+
+func TestParseSkipOnPlatform(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Socket linuxOnly   `flag:"socket"`
+		Pipe   windowsOnly `flag:"pipe"`
+		Name   string      `flag:"name"`
+
+		// the type is not a supported flag type, but as it is skipped it does
+		// not panic.
+		Skipped struct{ linuxOnly } `flag:"skipped"`
+	}
+
+	var (
+		f F
+		p Parser
+	)
+	err := p.Parse([]string{"", "-pipe", "p", "-name", "x"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Pipe.upcaseVal, qt.Equals, upcaseVal("P"))
+	c.Assert(f.Name, qt.Equals, "x")
+
+	err = p.Parse([]string{"", "-socket", "/tmp/x"}, &f)
+	c.Assert(err, qt.ErrorMatches, "flag provided but not defined: -socket")
+	c.Assert(f.Socket, qt.Equals, linuxOnly(""))
+}
+
+type E struct {
+	Addr    string `flag:"addr" env:"ADDR"`
+	DB      string `flag:"db" env:"DB"`
+	Help    bool   `flag:"h,help"`
+	Version bool   `flag:"v,version"`
+}
+
+func (e *E) Validate() error {
+	if e.Help || e.Version {
+		return nil
+	}
+	if e.Addr == "" {
+		return errors.New("address must be set")
+	}
+	if e.DB == "" {
+		return errors.New("db must be set")
+	}
+	return nil
+}
+
+type ctxValidated struct {
+	Addr string `flag:"addr"`
+
+	validateCalled bool
+}
+
+func (f *ctxValidated) Validate() error {
+	f.validateCalled = true
+	return nil
+}
+
+func (f *ctxValidated) ValidateContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.Addr == "" {
+		return errors.New("address must be set")
+	}
+	return nil
+}
+
+func TestParseContext(t *testing.T) {
+	c := qt.New(t)
+
+	var p Parser
+	var f ctxValidated
+	err := p.ParseContext(context.Background(), []string{"", "-addr", ":80"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.validateCalled, qt.IsFalse)
+
+	f = ctxValidated{}
+	err = p.Parse([]string{""}, &f)
+	c.Assert(err, qt.ErrorMatches, `address must be set`)
+	c.Assert(f.validateCalled, qt.IsFalse)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f = ctxValidated{}
+	err = p.ParseContext(ctx, []string{"", "-addr", ":80"}, &f)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue)
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrValidation)
+	c.Assert(f.validateCalled, qt.IsFalse)
+}
+
+func TestParseEnvVars(t *testing.T) {
+	c := qt.New(t)
+
+	const progName = "/tmp/go-build903761289/b001/exe/mainer-test"
+
+	p := Parser{
+		EnvVars: true,
+	}
+
+	cases := []struct {
+		env    string // prefix-less Key:val pairs, space-separated
+		args   string // space-separated, index 0 added automatically
+		want   E
+		errMsg string // error must contain that errMsg
+	}{
+		{
+			"",
+			"",
+			E{},
+			"address must be set",
+		},
+		{
+			"ADDR::1234 DB:x",
+			"",
+			E{Addr: ":1234", DB: "x"},
+			"",
+		},
+		{
+			"",
+			"-addr :2345 -db v",
+			E{Addr: ":2345", DB: "v"},
+			"",
+		},
+		{
+			"ADDR::1234",
+			"-addr :2345 -db x",
+			E{Addr: ":2345", DB: "x"},
+			"",
+		},
+		{
+			"HELP:true",
+			"-addr :2345",
+			E{Addr: ":2345"},
+			"db must be set",
+		},
+		{
+			"VERSION:1",
+			"-addr :2345 -db x",
+			E{Addr: ":2345", DB: "x"},
+			"",
+		},
+		{
+			"",
+			"-help",
+			E{Help: true},
+			"",
+		},
+		{
+			"",
+			"-v",
+			E{Version: true},
+			"",
+		},
+		{
+			"",
+			"-z",
+			E{},
+			"flag provided but not defined: -z",
+		},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%s|%s", tc.env, tc.args), func(c *qt.C) {
+			// set env vars
+			if tc.env != "" {
+				envPairs := strings.Split(tc.env, " ")
+				for _, pair := range envPairs {
+					ix := strings.Index(pair, ":")
+					c.Assert(ix >= 0, qt.IsTrue, qt.Commentf("%s: missing colon", pair))
+
+					key, val := pair[:ix], pair[ix+1:]
+					key = strings.ToUpper(prefixFromProgramName(progName)) + key
+					c.Setenv(key, val)
+				}
+			}
+
+			// parse args
+			args := []string{progName}
+			if tc.args != "" {
+				args = append(args, strings.Split(tc.args, " ")...)
+			}
+
+			var e E
+			err := p.Parse(args, &e)
+			if tc.errMsg != "" {
+				c.Assert(err, qt.IsNotNil)
+				c.Assert(err.Error(), qt.Contains, tc.errMsg)
+			} else {
+				c.Assert(err, qt.IsNil)
+			}
+
+			c.Assert(e, qt.DeepEquals, tc.want)
+		})
+	}
+}
+
+func TestPrefixFromProgramName(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"prog", "PROG_"},
+		{"/usr/bin/prog", "PROG_"},
+		{"mainer-test", "MAINER_TEST_"},
+		{"mainer_test", "MAINER_TEST_"},
+		{"tool.exe", "TOOL_"},
+		{"tool.EXE", "TOOL_"},
+		{"tool.sh", "TOOL_SH_"},
+		{"/usr/local/bin/my.app", "MY_APP_"},
+		{"tool.v2.exe", "TOOL_V2_"},
+		{".tool", "TOOL_"},
+		{"com.example.tool", "COM_EXAMPLE_TOOL_"},
+		{"/opt/com.example.my-tool", "COM_EXAMPLE_MY_TOOL_"},
+		{"my--tool..v2", "MY_TOOL_V2_"},
+		{"-tool-", "TOOL_"},
+		{"tool 2", "TOOL_2_"},
+		{"été", "T_"},
+	}
+	for _, tc := range cases {
+		c.Run(tc.in, func(c *qt.C) {
+			c.Assert(prefixFromProgramName(tc.in), qt.Equals, tc.want)
+		})
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		prefix, progName, want string
+	}{
+		{"MYAPP", "prog", "MYAPP_"},
+		{"MYAPP_", "prog", "MYAPP_"},
+		{"MYAPP__", "prog", "MYAPP__"},
+		{"", "prog", "PROG_"},
+		{"", "", ""},
+		{"-", "prog", ""},
+	}
+	for _, tc := range cases {
+		c.Run(tc.prefix+" "+tc.progName, func(c *qt.C) {
+			p := Parser{EnvPrefix: tc.prefix}
+			c.Assert(p.envPrefix([]string{tc.progName}), qt.Equals, tc.want)
+
+			c.Setenv(tc.want+"ADDR", ":1234")
+			c.Setenv(tc.want+"DB", "db")
+			var e E
+			err := p.ParseEnvOnly(tc.progName, &e)
+			c.Assert(err, qt.IsNil)
+			c.Assert(e, qt.DeepEquals, E{Addr: ":1234", DB: "db"})
+		})
+	}
+}
+
+func TestParseStopAtFirstArg(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args string // space-separated, index 0 added automatically
+		want *F
+	}{
+		{
+			args: "-b server -int 80",
+			want: &F{B: true, args: []string{"server", "-int", "80"}, flags: map[string]bool{"b": true}},
+		},
+		{
+			args: "-b -i 2",
+			want: &F{B: true, I: 2, flags: map[string]bool{"b": true, "i": true}},
+		},
+		{
+			args: "server -b -- x",
+			want: &F{args: []string{"server", "-b", "--", "x"}},
+		},
+		{
+			args: "-s x -- -b server",
+			want: &F{S: "x", args: []string{"-b", "server"}, flags: map[string]bool{"s": true}},
+		},
+		{
+			args: "-b - -i 1",
+			want: &F{B: true, args: []string{"-", "-i", "1"}, flags: map[string]bool{"b": true}},
+		},
+	}
+
+	p := Parser{StopAtFirstArg: true}
+	for _, tc := range cases {
+		c.Run(tc.args, func(c *qt.C) {
+			var f F
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, equalsF, tc.want)
+		})
+	}
+
+	// the flags before the first argument are rewritten, but not the
+	// arguments that follow it.
+	rewriteCases := []struct {
+		args string // space-separated, index 0 added automatically
+		want *F
+	}{
+		{
+			args: "-bh sub -bh",
+			want: &F{B: true, H: true, args: []string{"sub", "-bh"}, flags: map[string]bool{"b": true, "h": true}},
+		},
+		{
+			args: "-lo x sub -lo y",
+			want: &F{S: "x", args: []string{"sub", "-lo", "y"}, flags: map[string]bool{"s": true}},
+		},
+		{
+			args: "--long_string x sub --long_string y",
+			want: &F{S: "x", args: []string{"sub", "--long_string", "y"}, flags: map[string]bool{"s": true}},
+		},
+		{
+			args: "-i2 sub -i3",
+			want: &F{I: 2, args: []string{"sub", "-i3"}, flags: map[string]bool{"i": true}},
+		},
+		{
+			args: "-in 2 -b sub -b -- -in 3",
+			want: &F{I: 2, B: true, args: []string{"sub", "-b", "--", "-in", "3"}, flags: map[string]bool{"i": true, "b": true}},
+		},
+		{
+			args: "-b -- -bh",
+			want: &F{B: true, args: []string{"-bh"}, flags: map[string]bool{"b": true}},
+		},
+	}
+
+	p = Parser{StopAtFirstArg: true, NormalizeFlagNames: true, AllowPrefixMatch: true, AllowGluedValues: true}
+	for _, tc := range rewriteCases {
+		c.Run(tc.args, func(c *qt.C) {
+			var f F
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(&f, equalsF, tc.want)
+		})
+	}
+
+	c.Run("ambiguous prefix in args", func(c *qt.C) {
+		var f struct {
+			Verbose bool `flag:"verbose"`
+			Version bool `flag:"version"`
+		}
+		p := Parser{StopAtFirstArg: true, AllowPrefixMatch: true}
+		args, err := p.ParseArgs([]string{"", "-verb", "sub", "-ver"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.Verbose, qt.IsTrue)
+		c.Assert(args, qt.DeepEquals, []string{"sub", "-ver"})
+
+		_, err = p.ParseArgs([]string{"", "-ver", "sub"}, &f)
+		c.Assert(err, qt.ErrorMatches, `.*ambiguous.*`)
+	})
+}
+
+type fileValuesF struct {
+	S string    `flag:"s"`
+	U upcaseVal `flag:"u"`
+	I int       `flag:"i"`
+}
+
+func TestParseFileValues(t *testing.T) {
+	c := qt.New(t)
+
+	files := map[string]string{
+		"/secrets/token": "  s3cr3t\n",
+		"/secrets/name":  "abc\n",
+		"/secrets/num":   "42\n",
+	}
+	readFile := func(name string) ([]byte, error) {
+		if s, ok := files[name]; ok {
+			return []byte(s), nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	cases := []struct {
+		args string // space-separated, index 0 added automatically
+		want fileValuesF
+		err  string
+	}{
+		{"-s @/secrets/token", fileValuesF{S: "s3cr3t"}, ""},
+		{"-s=@/secrets/token -u @/secrets/name", fileValuesF{S: "s3cr3t", U: "ABC"}, ""},
+		{"-s @@/secrets/token -u @@x", fileValuesF{S: "@/secrets/token", U: "@X"}, ""},
+		{"-s a@b -u x", fileValuesF{S: "a@b", U: "X"}, ""},
+		{"-s @", fileValuesF{}, `invalid value "@" for flag -s: read value from file: file does not exist`},
+		{"-s @/nope", fileValuesF{}, `invalid value "@/nope" for flag -s: read value from file: file does not exist`},
+		{"-i @/secrets/num", fileValuesF{}, `invalid value "@/secrets/num" for flag -i: parse error`},
+	}
+
+	p := Parser{AllowFileValues: true, ReadFile: readFile}
+	for _, tc := range cases {
+		c.Run(tc.args, func(c *qt.C) {
+			var f fileValuesF
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.Equals, tc.want)
+		})
+	}
+
+	c.Run("disabled", func(c *qt.C) {
+		var f fileValuesF
+		err := (&Parser{ReadFile: readFile}).Parse([]string{"", "-s", "@/secrets/token"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.S, qt.Equals, "@/secrets/token")
+	})
+
+	c.Run("not cached", func(c *qt.C) {
+		cp := p
+		cp.Cache = NewParseCache(10)
+		for i, want := range []string{"s3cr3t", "changed"} {
+			if i > 0 {
+				files["/secrets/token"] = "changed"
+			}
+			var f fileValuesF
+			err := cp.Parse([]string{"", "-s", "@/secrets/token"}, &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f.S, qt.Equals, want)
+		}
+	})
+}
+
+func TestParseFileDescriptorValues(t *testing.T) {
+	c := qt.New(t)
+
+	fds := map[int]string{3: " s3cr3t\n", 4: "abc", 5: "42"}
+	var opened []int
+	openFD := func(fd int) (io.ReadCloser, error) {
+		s, ok := fds[fd]
+		if !ok {
+			return nil, errors.New("bad file descriptor")
+		}
+		opened = append(opened, fd)
+		return io.NopCloser(strings.NewReader(s)), nil
+	}
+
+	cases := []struct {
+		args   string // space-separated, index 0 added automatically
+		want   fileValuesF
+		opened []int
+		err    string
+	}{
+		{"-s fd:3", fileValuesF{S: "s3cr3t"}, []int{3}, ""},
+		{"-s=fd:3 -u fd:4", fileValuesF{S: "s3cr3t", U: "ABC"}, []int{3, 4}, ""},
+		{"-s fd:4 -u fd:4", fileValuesF{S: "abc", U: "ABC"}, []int{4}, ""},
+		{"-s xfd:3 -i 1", fileValuesF{S: "xfd:3", I: 1}, nil, ""},
+		{"-s fd::3 -u fd::x", fileValuesF{S: "fd:3", U: "FD:X"}, nil, ""},
+		{"-s @x", fileValuesF{S: "@x"}, nil, ""},
+		{"-i fd:5", fileValuesF{}, nil, `invalid value "fd:5" for flag -i: parse error`},
+		{"-s fd:x", fileValuesF{}, nil, `invalid value "fd:x" for flag -s: invalid file descriptor: "x"`},
+		{"-s fd:-1", fileValuesF{}, nil, `invalid value "fd:-1" for flag -s: invalid file descriptor: "-1"`},
+		{"-s fd:", fileValuesF{}, nil, `invalid value "fd:" for flag -s: invalid file descriptor: ""`},
+		{"-s fd:9", fileValuesF{}, nil, `invalid value "fd:9" for flag -s: open file descriptor 9: bad file descriptor`},
+	}
+
+	p := Parser{AllowFDValues: true, OpenFD: openFD, Cache: NewParseCache(10)}
+	for _, tc := range cases {
+		c.Run(tc.args, func(c *qt.C) {
+			opened = nil
+			var f fileValuesF
+			err := p.Parse(append([]string{""}, strings.Fields(tc.args)...), &f)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+				var pe *ParseError
+				c.Assert(errors.As(err, &pe), qt.IsTrue)
+				c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.Equals, tc.want)
+			c.Assert(opened, qt.DeepEquals, tc.opened)
+		})
+	}
+
+	c.Run("disabled", func(c *qt.C) {
+		var f fileValuesF
+		err := (&Parser{OpenFD: openFD}).Parse([]string{"", "-s", "fd:3"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.S, qt.Equals, "fd:3")
+
+		// AllowFileValues does not enable the file descriptors
+		f = fileValuesF{}
+		err = (&Parser{AllowFileValues: true, OpenFD: openFD}).Parse([]string{"", "-s", "fd:3", "-u", "fd::3"}, &f)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f, qt.Equals, fileValuesF{S: "fd:3", U: "FD::3"})
+	})
+}
+
+type noValidateF struct {
+	Help bool   `flag:"h,help"`
+	Addr string `flag:"addr"`
+
+	args []string
+}
+
+func (f *noValidateF) SetArgs(args []string) {
+	f.args = args
+}
 
-	type F struct {
-		X bool `flag:"x"`
-		Y int  `flag:"x"`
+func (f *noValidateF) Validate() error {
+	if f.Addr == "" {
+		return errors.New("addr is required")
 	}
-	var p Parser
-	f := F{}
-	c.Assert(func() {
-		_ = p.Parse([]string{"-x", "1"}, &f)
-	}, qt.PanicMatches, `flag redefined: x`)
+	return nil
 }
 
-func TestParseDuplicateAltFlagName(t *testing.T) {
+func TestParseNoValidate(t *testing.T) {
 	c := qt.New(t)
 
-	type F struct {
-		X bool `flag:"x,long-x"`
-		Y bool `flag:"y,long-x"`
+	var validatorCalls int
+	p := Parser{
+		Cache: NewParseCache(10),
+		Validator: func(v interface{}) error {
+			validatorCalls++
+			return nil
+		},
 	}
-	var p Parser
-	f := F{}
-	c.Assert(func() {
-		_ = p.Parse([]string{"-x", "1"}, &f)
-	}, qt.PanicMatches, `flag redefined: long-x`)
+	args := []string{"", "-h", "a"}
+
+	var f noValidateF
+	err := p.ParseNoValidate(args, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Help, qt.IsTrue)
+	c.Assert(f.args, qt.DeepEquals, []string{"a"})
+	c.Assert(validatorCalls, qt.Equals, 0)
+	c.Assert(f.Validate(), qt.ErrorMatches, `addr is required`)
+
+	// the unvalidated parse is not cached
+	f = noValidateF{}
+	err = p.Parse(args, &f)
+	c.Assert(err, qt.ErrorMatches, `addr is required`)
+	c.Assert(validatorCalls, qt.Equals, 1)
+
+	// parsing errors are still reported
+	err = p.ParseNoValidate([]string{"", "-z"}, &noValidateF{})
+	c.Assert(err, qt.ErrorMatches, `flag provided but not defined: -z`)
 }
 
-func TestParseNotStructPointer(t *testing.T) {
+func TestMustParse(t *testing.T) {
 	c := qt.New(t)
 
 	var (
-		i int
 		p Parser
+		f F
 	)
-	c.Assert(func() {
-		_ = p.Parse([]string{"-h"}, i)
-	}, qt.PanicMatches, `reflect:.+`)
+	c.Assert(func() { p.MustParse([]string{"", "-s", "x", "a"}, &f) }, qt.Not(qt.PanicMatches), `.*`)
+	c.Assert(f.S, qt.Equals, "x")
+	c.Assert(f.args, qt.DeepEquals, []string{"a"})
+
+	c.Assert(func() { p.MustParse([]string{"", "-z"}, &f) }, qt.PanicMatches, `flag provided but not defined: -z`)
+
+	// the panic value is the error, as returned by Parse
+	defer func() {
+		err, ok := recover().(error)
+		c.Assert(ok, qt.IsTrue)
+		c.Assert(IsUsageError(err), qt.IsTrue)
+	}()
+	p.MustParse([]string{"", "-i", "x"}, &f)
 }
 
-func TestParseUnsupportedFlagType(t *testing.T) {
+func TestParseProgramName(t *testing.T) {
 	c := qt.New(t)
 
 	type F struct {
-		C *bool `flag:"c"`
+		Addr  string `flag:"addr" env:"ADDR"`
+		Port  int    `flag:"port" env:"PORT"`
+		Token string `env:"TOKEN"`
 	}
-	var (
-		f F
-		p Parser
-	)
-	c.Assert(func() {
-		_ = p.Parse([]string{"", "-h"}, &f)
-	}, qt.PanicMatches, `unsupported flag field kind: ptr \(C: \*bool\)`)
-}
 
-type E struct {
-	Addr    string `flag:"addr" env:"ADDR"`
-	DB      string `flag:"db" env:"DB"`
-	Help    bool   `flag:"h,help"`
-	Version bool   `flag:"v,version"`
-}
+	// the binary is invoked via a symlink named "mt"
+	args := []string{"/usr/local/bin/mt", "-port", "80"}
+	c.Setenv("MT_ADDR", "wrong")
+	c.Setenv("MY_TOOL_ADDR", ":1234")
+	c.Setenv("MY_TOOL_TOKEN", "secret")
+	c.Setenv("MYAPP_ADDR", ":5678")
 
-func (e *E) Validate() error {
-	if e.Help || e.Version {
-		return nil
-	}
-	if e.Addr == "" {
-		return errors.New("address must be set")
+	cases := []struct {
+		desc        string
+		programName string
+		envPrefix   string
+		want        F
+	}{
+		{"args[0]", "", "", F{Addr: "wrong", Port: 80}},
+		{"program name", "my-tool", "", F{Addr: ":1234", Port: 80, Token: "secret"}},
+		{"explicit prefix", "my-tool", "MYAPP", F{Addr: ":5678", Port: 80}},
 	}
-	if e.DB == "" {
-		return errors.New("db must be set")
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			p := Parser{EnvVars: true, EnvPrefix: tc.envPrefix, ProgramName: tc.programName}
+			var f F
+			err := p.Parse(args, &f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(f, qt.DeepEquals, tc.want)
+		})
 	}
-	return nil
+
+	var buf bytes.Buffer
+	p := Parser{EnvVars: true, ProgramName: "my-tool", PrintUsageOnError: true, Usage: &buf}
+	err := p.Parse([]string{"/usr/local/bin/mt", "-unknown"}, &F{})
+	c.Assert(err, qt.ErrorMatches, `flag provided but not defined: -unknown`)
+	c.Assert(buf.String(), qt.Equals, `Usage of my-tool:
+  -addr string
+  -port int
+  MY_TOOL_TOKEN string
+    	(env only)
+`)
+
+	infos := p.FlagNames(&F{})
+	c.Assert(infos[0].Env, qt.Equals, "MY_TOOL_ADDR")
 }
 
-func TestParseEnvVars(t *testing.T) {
+func TestParseEnvOnly(t *testing.T) {
 	c := qt.New(t)
 
-	const progName = "/tmp/go-build903761289/b001/exe/mainer-test"
+	const progName = "/usr/local/bin/my-service"
 
-	p := Parser{
-		EnvVars: true,
-	}
+	var p Parser
+	var e E
+	err := p.ParseEnvOnly(progName, &e)
+	c.Assert(err, qt.ErrorMatches, "address must be set")
+
+	c.Setenv("MY_SERVICE_ADDR", ":1234")
+	c.Setenv("MY_SERVICE_DB", "db")
+	e = E{}
+	err = p.ParseEnvOnly(progName, &e)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e, qt.DeepEquals, E{Addr: ":1234", DB: "db"})
+
+	p.EnvPrefix = "-"
+	c.Setenv("ADDR", ":2345")
+	c.Setenv("DB", "x")
+	e = E{}
+	err = p.ParseEnvOnly("", &e)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e, qt.DeepEquals, E{Addr: ":2345", DB: "x"})
+}
+
+type Esrc struct {
+	Addr string `flag:"addr" env:"ADDR"`
+	DB   string `flag:"db,database" env:"DB"`
+	Dir  string `flag:"dir" env:"DIR" envDefault:"/tmp"`
+	Help bool   `flag:"h,help"`
+
+	sources map[string]FlagSource
+}
+
+func (e *Esrc) SetFlagSources(sources map[string]FlagSource) {
+	e.sources = sources
+}
+
+func TestParseFlagSources(t *testing.T) {
+	c := qt.New(t)
 
 	cases := []struct {
-		env    string // prefix-less Key:val pairs, space-separated
-		args   string // space-separated, index 0 added automatically
-		want   E
-		errMsg string // error must contain that errMsg
+		env  map[string]string // with the PROG_ prefix added automatically
+		args []string
+		want map[string]FlagSource
 	}{
 		{
-			"",
-			"",
-			E{},
-			"address must be set",
-		},
-		{
-			"ADDR::1234 DB:x",
-			"",
-			E{Addr: ":1234", DB: "x"},
-			"",
+			want: map[string]FlagSource{"addr": SourceDefault, "db": SourceDefault, "dir": SourceDefault, "h": SourceDefault},
 		},
 		{
-			"",
-			"-addr :2345 -db v",
-			E{Addr: ":2345", DB: "v"},
-			"",
+			env:  map[string]string{"ADDR": ":80"},
+			want: map[string]FlagSource{"addr": SourceEnv, "db": SourceDefault, "dir": SourceDefault, "h": SourceDefault},
 		},
 		{
-			"ADDR::1234",
-			"-addr :2345 -db x",
-			E{Addr: ":2345", DB: "x"},
-			"",
+			env:  map[string]string{"ADDR": ":80", "DB": "x", "DIR": "/var"},
+			args: []string{"-addr", ":8080", "-h"},
+			want: map[string]FlagSource{"addr": SourceFlag, "db": SourceEnv, "dir": SourceEnv, "h": SourceFlag},
 		},
 		{
-			"HELP:true",
-			"-addr :2345",
-			E{Addr: ":2345"},
-			"db must be set",
+			env:  map[string]string{"DB": ""},
+			args: []string{"-database", "y"},
+			want: map[string]FlagSource{"addr": SourceDefault, "db": SourceFlag, "dir": SourceDefault, "h": SourceDefault},
 		},
+	}
+
+	p := Parser{EnvVars: true}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
+			}
+			var e Esrc
+			err := p.Parse(append([]string{"prog"}, tc.args...), &e)
+			c.Assert(err, qt.IsNil)
+			c.Assert(e.sources, qt.DeepEquals, tc.want)
+		})
+	}
+
+	// without EnvVars, the env is never a source
+	c.Setenv("PROG_ADDR", ":80")
+	var e Esrc
+	p.EnvVars = false
+	err := p.Parse([]string{"prog", "-db", "x"}, &e)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e.sources, qt.DeepEquals, map[string]FlagSource{"addr": SourceDefault, "db": SourceFlag, "dir": SourceDefault, "h": SourceDefault})
+}
+
+type Ereq struct {
+	Token   string `flag:"token" env:"TOKEN,required"`
+	TLS     bool   `flag:"tls,t" env:"TLS"`
+	TLSCert string `flag:"tls-cert,requires=t" env:"TLS_CERT"`
+
+	required map[string]string
+}
+
+func (e *Ereq) SetRequiredSources(sources map[string]string) {
+	e.required = sources
+}
+
+func TestParseRequiredSources(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		env  map[string]string // with the PROG_ prefix added automatically
+		args []string
+		want map[string]string
+	}{
 		{
-			"VERSION:1",
-			"-addr :2345 -db x",
-			E{Addr: ":2345", DB: "x"},
-			"",
+			env:  map[string]string{"TOKEN": "x"},
+			want: map[string]string{"token": "env"},
 		},
 		{
-			"",
-			"-help",
-			E{Help: true},
-			"",
+			env:  map[string]string{"TOKEN": "x"},
+			args: []string{"-token", "y", "-tls"},
+			want: map[string]string{"token": "flag"},
 		},
 		{
-			"",
-			"-v",
-			E{Version: true},
-			"",
+			env:  map[string]string{"TOKEN": "x", "TLS": "1"},
+			args: []string{"-tls-cert", "c"},
+			want: map[string]string{"token": "env", "tls": "env"},
 		},
 		{
-			"",
-			"-z",
-			E{},
-			"flag provided but not defined: -z",
+			env:  map[string]string{"TOKEN": "x", "TLS_CERT": "c"},
+			args: []string{"-t"},
+			want: map[string]string{"token": "env", "tls": "flag"},
 		},
 	}
-	for _, tc := range cases {
-		c.Run(fmt.Sprintf("%s|%s", tc.env, tc.args), func(c *qt.C) {
-			// set env vars
-			if tc.env != "" {
-				envPairs := strings.Split(tc.env, " ")
-				for _, pair := range envPairs {
-					ix := strings.Index(pair, ":")
-					c.Assert(ix >= 0, qt.IsTrue, qt.Commentf("%s: missing colon", pair))
-
-					key, val := pair[:ix], pair[ix+1:]
-					key = strings.ToUpper(prefixFromProgramName(progName)) + key
-					c.Setenv(key, val)
-				}
-			}
-
-			// parse args
-			args := []string{progName}
-			if tc.args != "" {
-				args = append(args, strings.Split(tc.args, " ")...)
-			}
 
-			var e E
-			err := p.Parse(args, &e)
-			if tc.errMsg != "" {
-				c.Assert(err, qt.IsNotNil)
-				c.Assert(err.Error(), qt.Contains, tc.errMsg)
-			} else {
-				c.Assert(err, qt.IsNil)
+	p := Parser{EnvVars: true}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			for k, v := range tc.env {
+				c.Setenv("PROG_"+k, v)
 			}
-
-			c.Assert(e, qt.DeepEquals, tc.want)
+			var e Ereq
+			err := p.Parse(append([]string{"prog"}, tc.args...), &e)
+			c.Assert(err, qt.IsNil)
+			c.Assert(e.required, qt.DeepEquals, tc.want)
 		})
 	}
+
+	// not called if a requirement is not met
+	c.Setenv("PROG_TOKEN", "x")
+	var e Ereq
+	err := p.Parse([]string{"prog", "-tls-cert", "c"}, &e)
+	c.Assert(err, qt.ErrorMatches, `-tls-cert requires -t`)
+	c.Assert(e.required, qt.IsNil)
 }
 
 type (
@@ -599,6 +3068,122 @@ func TestTextUnmarshalerFlagPtr(t *testing.T) {
 	c.Assert(string(*f.V), qt.Equals, "olleh")
 }
 
+// netAddr only implements encoding.TextUnmarshaler (and fmt.Stringer).
+type netAddr struct {
+	Host string
+	Port int
+}
+
+func (h *netAddr) UnmarshalText(t []byte) error {
+	host, port, err := net.SplitHostPort(string(t))
+	if err != nil {
+		return err
+	}
+	h.Host = host
+	h.Port, err = strconv.Atoi(port)
+	return err
+}
+
+func (h netAddr) String() string {
+	return net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+}
+
+func TestTextUnmarshalerOnlyFlag(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Addr  netAddr    `flag:"addr"`
+		Addrs []netAddr  `flag:"a"`
+		Ptrs  []*netAddr `flag:"p"`
+	}
+	var p Parser
+	f := F{Addr: netAddr{"localhost", 80}}
+	err := p.Parse([]string{"", "-a", "a:1", "-addr", "b:2", "-p", "c:3", "-a", "d:4"}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f, qt.DeepEquals, F{
+		Addr:  netAddr{"b", 2},
+		Addrs: []netAddr{{"a", 1}, {"d", 4}},
+		Ptrs:  []*netAddr{{"c", 3}},
+	})
+
+	err = p.Parse([]string{"", "-addr", "x"}, &f)
+	c.Assert(err, qt.ErrorMatches, `invalid value "x" for flag -addr: address x: missing port in address`)
+
+	f = F{Addr: netAddr{"localhost", 80}}
+	c.Assert(p.usage("prog", &f), qt.Contains, "-addr value")
+	c.Assert(p.usage("prog", &f), qt.Contains, "(default localhost:80)")
+}
+
+// levelValue implements flag.Value, with validation of the values.
+type levelValue int
+
+func (l *levelValue) Set(s string) error {
+	switch s {
+	case "debug":
+		*l = 0
+	case "info":
+		*l = 1
+	default:
+		return errors.New("unknown level")
+	}
+	return nil
+}
+
+func (l levelValue) String() string {
+	return [...]string{"debug", "info"}[l]
+}
+
+// onOffValue implements flag.Value as a boolean flag.
+type onOffValue string
+
+func (o *onOffValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	*o = "off"
+	if b {
+		*o = "on"
+	}
+	return err
+}
+
+func (o *onOffValue) String() string {
+	if o == nil {
+		return ""
+	}
+	return string(*o)
+}
+
+func (o *onOffValue) IsBoolFlag() bool { return true }
+
+func TestFlagValueFlag(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Level  levelValue    `flag:"level"`
+		Levels []levelValue  `flag:"l"`
+		Ptrs   []*levelValue `flag:"p"`
+		Toggle onOffValue    `flag:"toggle"`
+	}
+	var p Parser
+	f := F{Level: 1}
+	err := p.Parse([]string{"", "-l", "info", "-level", "debug", "-p", "info", "-l", "debug", "-toggle", "x"}, &f)
+	c.Assert(err, qt.IsNil)
+	info := levelValue(1)
+	c.Assert(f, qt.DeepEquals, F{
+		Level:  0,
+		Levels: []levelValue{1, 0},
+		Ptrs:   []*levelValue{&info},
+		Toggle: "on",
+	})
+
+	err = p.Parse([]string{"", "-level", "x"}, &f)
+	c.Assert(err, qt.ErrorMatches, `invalid value "x" for flag -level: unknown level`)
+	err = p.Parse([]string{"", "-l", "x"}, &f)
+	c.Assert(err, qt.ErrorMatches, `invalid value "x" for flag -l: unknown level`)
+
+	f = F{Level: 1}
+	c.Assert(p.usage("prog", &f), qt.Contains, "(default info)")
+}
+
 type Fs struct {
 	Ss   []string        `flag:"s,string"`
 	Is   []int           `flag:"i"`
@@ -738,11 +3323,47 @@ func TestParseSliceFlags(t *testing.T) {
 	}
 }
 
+func TestParseSliceFlagsInvalid(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		sep  bool
+		flag string
+		err  string
+	}{
+		{args: []string{"-i", "1", "-i", "x"}, flag: "i", err: `invalid value "x" for flag -i: parse error`},
+		{args: []string{"-i", "99999999999999999999"}, flag: "i", err: `invalid value "99999999999999999999" for flag -i: value out of range`},
+		{args: []string{"-u", "-1"}, flag: "u", err: `invalid value "-1" for flag -u: parse error`},
+		{args: []string{"-u=18446744073709551616"}, flag: "u", err: `invalid value "18446744073709551616" for flag -u: value out of range`},
+		{args: []string{"-t", "1s", "-t", "1y"}, flag: "t", err: `invalid value "1y" for flag -t: parse error`},
+		{args: []string{"-i", "1,x"}, sep: true, flag: "i", err: `invalid value "1,x" for flag -i: parse error`},
+		{args: []string{"-u", "1,-1"}, sep: true, flag: "u", err: `invalid value "1,-1" for flag -u: parse error`},
+		{args: []string{"-t", "1s,1y"}, sep: true, flag: "t", err: `invalid value "1s,1y" for flag -t: parse error`},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%t %s", tc.sep, strings.Join(tc.args, " ")), func(c *qt.C) {
+			var v interface{} = &Fs{}
+			if tc.sep {
+				v = &FsSep{}
+			}
+			err := p.Parse(append([]string{""}, tc.args...), v)
+			c.Assert(err, qt.ErrorMatches, tc.err)
+			var pe *ParseError
+			c.Assert(errors.As(err, &pe), qt.IsTrue)
+			c.Assert(pe.Kind, qt.Equals, ErrInvalidValue)
+			c.Assert(pe.Flag, qt.Equals, tc.flag)
+		})
+	}
+}
+
 func TestSliceInvalidType(t *testing.T) {
 	c := qt.New(t)
 
 	type F struct {
-		S []byte `flag:"nope"`
+		S []complex64 `flag:"nope"`
 	}
 	var (
 		f F
@@ -750,7 +3371,7 @@ func TestSliceInvalidType(t *testing.T) {
 	)
 	c.Assert(func() {
 		_ = p.Parse([]string{"", "-nope", "whatever"}, &f)
-	}, qt.PanicMatches, `unsupported flag field kind: uint8 \(S: \[\]uint8\)`)
+	}, qt.PanicMatches, `unsupported flag field kind: complex64 \(S: \[\]complex64\)`)
 }
 
 type fromString []byte
@@ -988,3 +3609,109 @@ func TestParseSliceFlagsSep(t *testing.T) {
 		})
 	}
 }
+
+func TestParserRegister(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Name    string        `flag:"n,name" usage:"the name"`
+		Tags    []string      `flag:"tag" flagSeparator:","`
+		Ints    []int         `flag:"i"`
+		Level   string        `flag:"level" choices:"debug,info"`
+		Port    int           `flag:"port" min:"1"`
+		Timeout time.Duration `flag:"timeout"`
+	}
+
+	c.Run("valid", func(c *qt.C) {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		manual := fs.Bool("manual", false, "")
+
+		var p Parser
+		var v F
+		canon, err := p.Register(fs, &v)
+		c.Assert(err, qt.IsNil)
+		c.Assert(canon, qt.DeepEquals, map[string]string{
+			"n": "n", "name": "n", "tag": "tag", "i": "i", "level": "level", "port": "port", "timeout": "timeout",
+		})
+		c.Assert(fs.Lookup("name").Usage, qt.Equals, "the name")
+
+		err = fs.Parse([]string{"-manual", "--name", "x", "-tag", "a,b", "-i", "1", "-i", "2", "-level", "info", "-timeout", "1s", "arg"})
+		c.Assert(err, qt.IsNil)
+		c.Assert(*manual, qt.IsTrue)
+		c.Assert(fs.Args(), qt.DeepEquals, []string{"arg"})
+		c.Assert(v, qt.DeepEquals, F{Name: "x", Tags: []string{"a", "b"}, Ints: []int{1, 2}, Level: "info", Timeout: time.Second})
+
+		c.Assert(fs.Parse([]string{"-level", "x"}), qt.ErrorMatches, `invalid value "x" for flag -level: must be one of debug, info`)
+		c.Assert(fs.Parse([]string{"-port", "0"}), qt.ErrorMatches, `invalid value "0" for flag -port: .*must be at least 1`)
+	})
+
+	c.Run("overwrite slices", func(c *qt.C) {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		p := Parser{OverwriteSlices: true}
+		v := F{Ints: []int{9}}
+		_, err := p.Register(fs, &v)
+		c.Assert(err, qt.IsNil)
+		c.Assert(fs.Parse([]string{"-i", "1", "-i", "2"}), qt.IsNil)
+		c.Assert(v.Ints, qt.DeepEquals, []int{1, 2})
+	})
+
+	c.Run("redefined", func(c *qt.C) {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		fs.String("port", "", "")
+		var p Parser
+		_, err := p.Register(fs, &F{})
+		c.Assert(err, qt.ErrorMatches, `flag redefined: port`)
+		c.Assert(fs.Lookup("name"), qt.IsNil)
+	})
+
+	c.Run("invalid definition", func(c *qt.C) {
+		type Invalid struct {
+			V string `flag:"v,count"`
+		}
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		var p Parser
+		_, err := p.Register(fs, &Invalid{})
+		c.Assert(err, qt.ErrorMatches, `count option set on non-integer field V`)
+		c.Assert(fs.Lookup("v"), qt.IsNil)
+	})
+}
+
+func TestParseDeprecated(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		OldName string `flag:"old-name,o" deprecated:"use -new-name"`
+		NewName string `flag:"new-name"`
+		Legacy  bool   `flag:"legacy" deprecated:""`
+	}
+
+	cases := []struct {
+		args []string
+		want F
+		warn string
+	}{
+		{[]string{"", "-new-name", "x"}, F{NewName: "x"}, ""},
+		{[]string{"", "-old-name", "x"}, F{OldName: "x"}, "flag -old-name is deprecated: use -new-name\n"},
+		{[]string{"", "-o", "x", "-legacy"}, F{OldName: "x", Legacy: true}, "flag -legacy is deprecated\nflag -o is deprecated: use -new-name\n"},
+	}
+
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var buf bytes.Buffer
+			p := Parser{Warnings: &buf}
+			var v F
+			err := p.Parse(tc.args, &v)
+			c.Assert(err, qt.IsNil)
+			c.Assert(v, qt.DeepEquals, tc.want)
+			c.Assert(buf.String(), qt.Equals, tc.warn)
+
+			// no writer, no warning but the flag still works
+			p.Warnings = nil
+			v = F{}
+			err = p.Parse(tc.args, &v)
+			c.Assert(err, qt.IsNil)
+			c.Assert(v, qt.DeepEquals, tc.want)
+		})
+	}
+}
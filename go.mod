@@ -1,15 +1,17 @@
 module github.com/mna/mainer
 
-go 1.19
+go 1.21
 
 require (
 	github.com/caarlos0/env/v6 v6.10.1
 	github.com/frankban/quicktest v1.13.0
 	github.com/google/go-cmp v0.5.5
+	golang.org/x/term v0.5.0
 )
 
 require (
 	github.com/kr/pretty v0.2.1 // indirect
 	github.com/kr/text v0.1.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 )
@@ -0,0 +1,78 @@
+package mainer
+
+import (
+	"flag"
+	"io"
+	"reflect"
+)
+
+// FlagInfo describes a flag defined by a struct, as returned by
+// Parser.FlagNames.
+type FlagInfo struct {
+	// Name is the canonical name of the flag, i.e. the first one defined on
+	// the field.
+	Name string
+
+	// Aliases is the list of the other names of the flag, in the order they
+	// are defined.
+	Aliases []string
+
+	// Kind is the kind of the field's type. For a slice field, it is
+	// reflect.Slice.
+	Kind reflect.Kind
+
+	// IsBool is true if the flag does not take a value, as is the case for
+	// bool fields and counters.
+	IsBool bool
+
+	// Placeholder is the placeholder name of the flag's value, as displayed in
+	// the usage text. It is empty if the flag does not take a value.
+	Placeholder string
+
+	// Usage is the description of the flag, from the "usage" struct tag,
+	// stripped of the back quotes around the placeholder name if it specifies
+	// one.
+	Usage string
+
+	// Env is the name of the environment variable associated with the flag,
+	// including the Parser.EnvPrefix or the prefix derived from
+	// Parser.ProgramName (there are no args to derive it from otherwise), or
+	// an empty string if Parser.EnvVars is false or the field has no "env"
+	// struct tag.
+	Env string
+}
+
+// FlagNames returns the description of the flags defined by v, in the order
+// of the fields, without parsing any argument. This is meant for external
+// tooling, e.g. to generate shell completions or documentation. v must be a
+// pointer to a struct with the same requirements as for Parse.
+func (p *Parser) FlagNames(v interface{}) []FlagInfo {
+	fields := p.flagFields(v)
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerFlags(fs, fields, false, p.converters)
+
+	prefix := p.envPrefix(nil)
+	infos := make([]FlagInfo, 0, len(fields))
+	for _, ff := range fields {
+		fi := FlagInfo{
+			Name:    ff.names[0],
+			Aliases: ff.names[1:],
+			Kind:    ff.value.Kind(),
+			IsBool:  isBoolFlag(fs.Lookup(ff.names[0])),
+		}
+		if len(fi.Aliases) == 0 {
+			fi.Aliases = nil
+		}
+		fi.Placeholder, fi.Usage = flagPlaceholder(ff)
+		if fi.IsBool {
+			fi.Placeholder = ""
+		}
+		if p.EnvVars {
+			fi.Env = envVarName(prefix+ff.envPrefix, ff.field)
+		}
+		infos = append(infos, fi)
+	}
+	return infos
+}
@@ -0,0 +1,38 @@
+package mainer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFlagNames(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Help    bool          `flag:"h,help" usage:"show help"`
+		Verbose int           `flag:"v,count"`
+		Addr    string        "flag:\"addr\" env:\"ADDR\" usage:\"listen on `host:port`\""
+		Timeout time.Duration `flag:"timeout,t" env:"TIMEOUT"`
+		Tags    []string      `flag:"tag"`
+		Rev     reverseVal    `flag:"rev"`
+		NoFlag  string        `env:"NO_FLAG"`
+	}
+
+	p := Parser{EnvVars: true, EnvPrefix: "PROG"}
+	got := p.FlagNames(&F{})
+	c.Assert(got, qt.DeepEquals, []FlagInfo{
+		{Name: "h", Aliases: []string{"help"}, Kind: reflect.Bool, IsBool: true, Usage: "show help"},
+		{Name: "v", Kind: reflect.Int, IsBool: true},
+		{Name: "addr", Kind: reflect.String, Placeholder: "host:port", Usage: "listen on host:port", Env: "PROG_ADDR"},
+		{Name: "timeout", Aliases: []string{"t"}, Kind: reflect.Int64, Placeholder: "duration", Env: "PROG_TIMEOUT"},
+		{Name: "tag", Kind: reflect.Slice, Placeholder: "string"},
+		{Name: "rev", Kind: reflect.String, Placeholder: "value"},
+	})
+
+	p.EnvVars = false
+	got = p.FlagNames(&F{})
+	c.Assert(got[2].Env, qt.Equals, "")
+}
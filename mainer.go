@@ -35,17 +35,31 @@
 //	 }
 //
 //	 func main() {
+//	   // RunMain calls c.Main with os.Args and the CurrentStdio, and
+//	   // recovers from panics.
 //	   var c cmd
-//	   os.Exit(int(c.Main(os.Args, mainer.CurrentStdio())))
+//	   os.Exit(int(mainer.RunMain(&c)))
 //	 }
 package mainer
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
 )
 
 // ExitCode is the type of a process exit code.
@@ -58,6 +72,114 @@ const (
 	InvalidArgs
 )
 
+// List of pre-defined exit codes for more specific failures, with the
+// values of the BSD sysexits.h conventions.
+const (
+	// Unavailable indicates that a required service is unavailable
+	// (EX_UNAVAILABLE, 69).
+	Unavailable ExitCode = 69
+	// Timeout indicates that the operation timed out, a temporary failure
+	// that may succeed if retried (EX_TEMPFAIL, 75).
+	Timeout ExitCode = 75
+	// NoPermission indicates that the permissions were insufficient to
+	// perform the operation (EX_NOPERM, 77).
+	NoPermission ExitCode = 77
+)
+
+// String returns the name of the exit code, e.g. "invalid-args", or
+// "exit(N)" for a code that is not pre-defined.
+func (c ExitCode) String() string {
+	switch c {
+	case Success:
+		return "success"
+	case Failure:
+		return "failure"
+	case InvalidArgs:
+		return "invalid-args"
+	case Unavailable:
+		return "unavailable"
+	case Timeout:
+		return "timeout"
+	case NoPermission:
+		return "no-permission"
+	default:
+		return fmt.Sprintf("exit(%d)", int(c))
+	}
+}
+
+// ExitCodeFor returns the exit code that corresponds to err, typically as
+// returned by Parser.Parse: Success if err is nil, InvalidArgs if it is a
+// usage error (as reported by IsUsageError) and Failure otherwise.
+func ExitCodeFor(err error) ExitCode {
+	switch {
+	case err == nil:
+		return Success
+	case IsUsageError(err):
+		return InvalidArgs
+	default:
+		return Failure
+	}
+}
+
+// ExitCodeForError returns the exit code that corresponds to err: Success if
+// err is nil, InvalidArgs if it is (or wraps) a *ParseError of any kind, and
+// Failure otherwise. Unlike ExitCodeFor, a failure to read or decode the
+// config file (ErrConfig) is also reported as InvalidArgs.
+func ExitCodeForError(err error) ExitCode {
+	var pe *ParseError
+	switch {
+	case err == nil:
+		return Success
+	case errors.As(err, &pe):
+		return InvalidArgs
+	default:
+		return Failure
+	}
+}
+
+// DetailedExitCodeFor is like ExitCodeFor, but it returns a more specific
+// exit code for some common errors that are not usage errors: Timeout if
+// err is (or wraps) context.DeadlineExceeded or os.ErrDeadlineExceeded, or
+// an error with a Timeout() bool method that returns true (as is the case
+// for net.Error), and NoPermission if it is (or wraps) os.ErrPermission. No
+// error is mapped to Unavailable, which the commands can return directly.
+func DetailedExitCodeFor(err error) ExitCode {
+	var te interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return Success
+	case IsUsageError(err):
+		return InvalidArgs
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &te) && te.Timeout():
+		return Timeout
+	case errors.Is(err, os.ErrPermission):
+		return NoPermission
+	default:
+		return Failure
+	}
+}
+
+// IsUsageError returns true if err is (or wraps) a *ParseError caused by
+// invalid arguments, i.e. of any kind except ErrConfig (which is caused by a
+// failure to read or decode the config file).
+func IsUsageError(err error) bool {
+	var pe *ParseError
+	return errors.As(err, &pe) && pe.Kind != ErrConfig
+}
+
+// IsValidationError returns true if err is (or wraps) a *ParseError of kind
+// ErrValidation, i.e. an error returned by Parser.Validator or by the
+// Validate method of the parsed value, as opposed to an invalid flag or
+// argument. The error returned by the validation is preserved and can be
+// retrieved with errors.Unwrap, errors.Is or errors.As. Commands that
+// consider an invalid configuration as a failure rather than a usage error
+// can use it to map such errors to Failure instead of InvalidArgs.
+func IsValidationError(err error) bool {
+	var pe *ParseError
+	return errors.As(err, &pe) && pe.Kind == ErrValidation
+}
+
 // CurrentStdio returns the Stdio for the current process. Its Cwd
 // field reflects the working directory at the time of the call.
 func CurrentStdio() Stdio {
@@ -88,15 +210,583 @@ type Stdio struct {
 	Stderr io.Writer
 }
 
+// IsStdoutTerminal returns true if Stdout is a terminal, e.g. to decide
+// whether to write ANSI escape codes. It returns false if Stdout is not an
+// *os.File, such as a buffer injected in tests.
+func (s Stdio) IsStdoutTerminal() bool {
+	return isTerminal(s.Stdout)
+}
+
+// IsStderrTerminal returns true if Stderr is a terminal. As for
+// IsStdoutTerminal, it returns false if Stderr is not an *os.File.
+func (s Stdio) IsStderrTerminal() bool {
+	return isTerminal(s.Stderr)
+}
+
+// Colorize returns text wrapped in the ANSI escape sequence for the Select
+// Graphic Rendition code (e.g. "31" for red, or "1;31" for bold red) if
+// colors should be written to Stdout, and text unchanged otherwise. Colors
+// are written if the NO_COLOR environment variable is not set (or empty)
+// and either Stdout is a terminal or the FORCE_COLOR environment variable is
+// set to a value other than "0" (e.g. for CI pipelines that support colors).
+func (s Stdio) Colorize(code, text string) string {
+	if os.Getenv("NO_COLOR") != "" {
+		return text
+	}
+	if force := os.Getenv("FORCE_COLOR"); (force == "" || force == "0") && !s.IsStdoutTerminal() {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// Printf formats according to a format specifier and writes to Stdout. As
+// is typically the case with the fmt.Fprint family of functions, write
+// errors are ignored.
+func (s Stdio) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(s.Stdout, format, a...)
+}
+
+// Println formats using the default formats for its operands and writes to
+// Stdout, as fmt.Println does. Write errors are ignored.
+func (s Stdio) Println(a ...interface{}) {
+	fmt.Fprintln(s.Stdout, a...)
+}
+
+// Errorf formats according to a format specifier and writes to Stderr.
+// Write errors are ignored.
+func (s Stdio) Errorf(format string, a ...interface{}) {
+	fmt.Fprintf(s.Stderr, format, a...)
+}
+
+// Errorln formats using the default formats for its operands and writes to
+// Stderr, as fmt.Println does. Write errors are ignored.
+func (s Stdio) Errorln(a ...interface{}) {
+	fmt.Fprintln(s.Stderr, a...)
+}
+
+// Capture returns a copy of s where Stdout and Stderr write to distinct
+// in-memory buffers, e.g. to run a step of a command and inspect its output
+// instead of writing it directly. Cwd and Stdin are inherited from s, which
+// is left untouched. The result function returns what was written so far to
+// the captured Stdout and Stderr, it can be called many times. The buffers
+// are not safe for concurrent writes.
+func (s Stdio) Capture() (captured Stdio, result func() (stdout, stderr string)) {
+	var outBuf, errBuf bytes.Buffer
+	captured = s
+	captured.Stdout = &outBuf
+	captured.Stderr = &errBuf
+	return captured, func() (string, string) {
+		return outBuf.String(), errBuf.String()
+	}
+}
+
+// TableStyle is the style of a table written by Stdio.TableWithStyle.
+type TableStyle int
+
+// List of supported table styles.
+const (
+	// TablePlain separates the columns with two spaces, without borders.
+	TablePlain TableStyle = iota
+	// TableBordered draws ASCII borders around the table and its cells, and
+	// separates the headers from the rows.
+	TableBordered
+)
+
+// Table writes headers and rows to Stdout as a table in the TablePlain
+// style, where each column is padded to its widest cell. See
+// TableWithStyle for details.
+func (s Stdio) Table(headers []string, rows [][]string) {
+	s.TableWithStyle(TablePlain, headers, rows)
+}
+
+// TableWithStyle writes headers and rows to Stdout as a table in the
+// specified style, where each column is padded to its widest cell (as
+// measured in runes). The headers are skipped if they are empty, and rows
+// with fewer cells than the others are padded with empty cells. Nothing is
+// written if there is no cell at all. As for Printf, write errors are
+// ignored.
+func (s Stdio) TableWithStyle(style TableStyle, headers []string, rows [][]string) {
+	all := rows
+	if len(headers) > 0 {
+		all = append([][]string{headers}, rows...)
+	}
+
+	var widths []int
+	for _, row := range all {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	if len(widths) == 0 {
+		return
+	}
+
+	var sb strings.Builder
+	writeRow := func(row []string) {
+		var line strings.Builder
+		for i, w := range widths {
+			var cell string
+			if i < len(row) {
+				cell = row[i]
+			}
+			pad := strings.Repeat(" ", w-utf8.RuneCountInString(cell))
+			if style == TableBordered {
+				line.WriteString("| " + cell + pad + " ")
+				continue
+			}
+			line.WriteString(cell + pad + "  ")
+		}
+		if style == TableBordered {
+			sb.WriteString(line.String() + "|\n")
+			return
+		}
+		// no trailing spaces after the last non-empty cell
+		sb.WriteString(strings.TrimRight(line.String(), " ") + "\n")
+	}
+	writeBorder := func() {
+		if style != TableBordered {
+			return
+		}
+		for _, w := range widths {
+			sb.WriteString("+" + strings.Repeat("-", w+2))
+		}
+		sb.WriteString("+\n")
+	}
+
+	writeBorder()
+	if len(headers) > 0 {
+		writeRow(headers)
+		writeBorder()
+	}
+	for _, row := range rows {
+		writeRow(row)
+	}
+	if len(rows) > 0 {
+		writeBorder()
+	}
+	io.WriteString(s.Stdout, sb.String())
+}
+
+// spinnerFrames are the frames of the spinner animated by Stdio.Spinner.
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// spinnerInterval is the delay between two frames of the spinner.
+const spinnerInterval = 100 * time.Millisecond
+
+// Spinner indicates that a long operation is in progress. If Stdout is a
+// terminal, it animates a spinner followed by msg on a goroutine until the
+// returned stop function is called, which clears the line. Otherwise (e.g.
+// if Stdout is redirected to a file or is a buffer in tests), it writes msg
+// once, followed by a newline, and stop does nothing. Nothing else should
+// be written to Stdout until stop is called. The stop function must be
+// called once the operation is done, calling it more than once has no
+// effect.
+func (s Stdio) Spinner(msg string) (stop func()) {
+	if !s.IsStdoutTerminal() {
+		fmt.Fprintln(s.Stdout, msg)
+		return func() {}
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Fprintf(s.Stdout, "\r%s %s", spinnerFrames[i%len(spinnerFrames)], msg)
+			select {
+			case <-ticker.C:
+			case <-quit:
+				// clear the line
+				io.WriteString(s.Stdout, "\r\x1b[K")
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+	}
+}
+
+// LogLevelEnvVar is the name of the environment variable that sets the
+// minimum level of the loggers returned by Stdio.Logger and
+// Stdio.JSONLogger, e.g. "debug" or "warn" (see slog.Level.UnmarshalText for
+// the supported values).
+const LogLevelEnvVar = "MAINER_LOG_LEVEL"
+
+// Logger returns a logger that writes to Stderr in the text format of
+// slog.TextHandler. Its minimum level is set by the LogLevelEnvVar
+// environment variable, and defaults to slog.LevelInfo if it is not set or
+// invalid.
+func (s Stdio) Logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(s.Stderr, logHandlerOptions()))
+}
+
+// JSONLogger is like Logger, but the logger writes in the JSON format of
+// slog.JSONHandler, for machine-readable output.
+func (s Stdio) JSONLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(s.Stderr, logHandlerOptions()))
+}
+
+func logHandlerOptions() *slog.HandlerOptions {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv(LogLevelEnvVar))); err != nil {
+		level = slog.LevelInfo
+	}
+	return &slog.HandlerOptions{Level: level}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// Prompt writes msg to Stdout and reads a single line from Stdin, which is
+// returned without the trailing newline (and carriage return, if any). If
+// the end of the input is reached before a newline, the partial line is
+// returned along with io.EOF. Stdin is read one byte at a time so that
+// nothing past the newline is consumed, so it may be useful to provide a
+// buffered reader for large inputs.
+func (s Stdio) Prompt(msg string) (string, error) {
+	if _, err := io.WriteString(s.Stdout, msg); err != nil {
+		return "", err
+	}
+	line, err := s.readLine()
+	return string(line), err
+}
+
+// ReadPassword writes msg to Stdout and reads a single line from Stdin
+// without echoing it, for secret input such as passwords. The line is
+// returned as a byte slice so that the caller can zero it after use. Echo
+// can only be disabled if Stdin is a terminal, otherwise (e.g. if it is a
+// pipe or a reader other than an *os.File) the line is read as for Prompt.
+func (s Stdio) ReadPassword(msg string) ([]byte, error) {
+	if _, err := io.WriteString(s.Stdout, msg); err != nil {
+		return nil, err
+	}
+
+	if f, ok := s.Stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		b, err := term.ReadPassword(int(f.Fd()))
+		// the newline typed by the user is not echoed either
+		if _, werr := io.WriteString(s.Stdout, "\n"); err == nil {
+			err = werr
+		}
+		return b, err
+	}
+	return s.readLine()
+}
+
+// readLine reads a single line from Stdin, one byte at a time, and returns
+// it without the trailing newline and carriage return.
+func (s Stdio) readLine() ([]byte, error) {
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for {
+		n, err := s.Stdin.Read(b[:])
+		if n > 0 {
+			if b[0] == '\n' {
+				return bytes.TrimSuffix(line, []byte("\r")), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return line, err
+		}
+	}
+}
+
+// maxConfirmAttempts is the number of times Confirm prompts for a valid
+// response before returning an error.
+const maxConfirmAttempts = 3
+
+// Confirm prompts for a yes/no response using Prompt, with msg followed by
+// " [y/N] " or " [Y/n] " depending on the default value def. The response is
+// case-insensitive and can be y, yes, n or no, and an empty response returns
+// def. An invalid response prompts again, up to 3 attempts, after which an
+// error is returned. If Stdin fails (including io.EOF on an empty response),
+// false and the error are returned.
+func (s Stdio) Confirm(msg string, def bool) (bool, error) {
+	suffix := " [y/N] "
+	if def {
+		suffix = " [Y/n] "
+	}
+
+	var resp string
+	for i := 0; i < maxConfirmAttempts; i++ {
+		line, err := s.Prompt(msg + suffix)
+		if err != nil && !(err == io.EOF && line != "") {
+			return false, err
+		}
+
+		resp = strings.TrimSpace(line)
+		switch strings.ToLower(resp) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	return false, fmt.Errorf("invalid response: %q", resp)
+}
+
 // Mainer defines the method to implement for a type that
 // implements a Main entrypoint of a command.
 type Mainer interface {
 	Main([]string, Stdio) ExitCode
 }
 
+// DebugEnvVar is the name of the environment variable that, if set to a
+// non-empty value, causes Run, RunMain and RunWith to print the stack trace
+// of a recovered panic.
+const DebugEnvVar = "MAINER_DEBUG"
+
+// RunMain is like Run, using os.Args as args. It reduces a command's main
+// function to:
+//
+//	func main() {
+//	  var c cmd
+//	  os.Exit(int(mainer.RunMain(&c)))
+//	}
+func RunMain(m Mainer) ExitCode {
+	return Run(m, os.Args)
+}
+
+// Run calls m.Main with args and the Stdio returned by CurrentStdio. If
+// m.Main panics, the panic is recovered, the panic value is written to
+// Stderr (along with the stack trace if the DebugEnvVar environment variable
+// is set) and Failure is returned. Otherwise it returns the exit code of
+// m.Main.
+func Run(m Mainer, args []string) ExitCode {
+	return RunWith(m, args, CurrentStdio())
+}
+
+// RunWith is like Run, but with the provided stdio instead of the
+// CurrentStdio. It does not use os.Args nor the process' standard I/O, so
+// that tests can drive a command with buffers and assert on its exit code
+// and output.
+func RunWith(m Mainer, args []string, stdio Stdio) ExitCode {
+	rm := recoverMainer{m: m, withStack: os.Getenv(DebugEnvVar) != ""}
+	return rm.Main(args, stdio)
+}
+
+// Recover returns a Mainer that calls m.Main and recovers from a panic, in
+// which case it writes the panic value and the stack trace to the Stderr of
+// the Stdio and returns Failure. The output is of the form:
+//
+//	panic: <value>
+//
+//	<stack trace>
+//
+// Otherwise it returns the exit code of m.Main.
+func Recover(m Mainer) Mainer {
+	return recoverMainer{m: m, withStack: true}
+}
+
+type recoverMainer struct {
+	m         Mainer
+	withStack bool
+}
+
+func (r recoverMainer) Main(args []string, stdio Stdio) (code ExitCode) {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Fprintf(stdio.Stderr, "panic: %v\n", e)
+			if r.withStack {
+				fmt.Fprintf(stdio.Stderr, "\n%s", debug.Stack())
+			}
+			code = Failure
+		}
+	}()
+	return r.m.Main(args, stdio)
+}
+
+// Commands is a Mainer that dispatches to a subcommand, for a command-line
+// interface with many commands (e.g. "prog server -port 80"). The key is
+// the name of the subcommand and the value is the Mainer that implements
+// it.
+//
+// To support global flags before the subcommand's name, parse them with
+// Parser.StopAtFirstArg set and call Main with the program name followed by
+// the remaining arguments.
+type Commands map[string]Mainer
+
+// Main runs the subcommand named by args[1] with the remaining arguments.
+// The subcommand's args[0] is the base name of the program followed by a
+// space and the subcommand's name (e.g. "prog server"), so that its usage
+// text refers to it; note that the environment variables prefix derived
+// from args[0] is then e.g. PROG_SERVER_, unless Parser.EnvPrefix or
+// Parser.ProgramName is set.
+//
+// If the name is "help" (or -h, -help or --help) and no such subcommand is
+// registered, the sorted list of subcommands is written to Stdout and it
+// returns Success. If the name is missing or unknown, an error and the list
+// of subcommands are written to Stderr and it returns InvalidArgs.
+func (c Commands) Main(args []string, stdio Stdio) ExitCode {
+	var progName string
+	if len(args) > 0 {
+		progName = filepath.Base(args[0])
+	}
+	if len(args) < 2 {
+		fmt.Fprintf(stdio.Stderr, "missing command\n\n%s", c.usage(progName))
+		return InvalidArgs
+	}
+
+	name := args[1]
+	if m, ok := c[name]; ok {
+		return m.Main(append([]string{progName + " " + name}, args[2:]...), stdio)
+	}
+	switch name {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdio.Stdout, c.usage(progName))
+		return Success
+	}
+	fmt.Fprintf(stdio.Stderr, "unknown command: %s\n\n%s", name, c.usage(progName))
+	return InvalidArgs
+}
+
+// usage returns the usage text that lists the subcommands.
+func (c Commands) usage(progName string) string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Usage: %s <command> [arguments]\n\nCommands:\n", progName)
+	for _, name := range names {
+		sb.WriteString("  " + name + "\n")
+	}
+	return sb.String()
+}
+
+// RunAll runs the Main method of each Mainer in order, with the same args
+// and stdio. It stops at the first Mainer that does not return Success and
+// returns its exit code, so that subsequent Mainers are not run. It returns
+// Success if all Mainers succeed (or if there are none).
+func RunAll(stdio Stdio, args []string, ms ...Mainer) ExitCode {
+	for _, m := range ms {
+		if code := m.Main(args, stdio); code != Success {
+			return code
+		}
+	}
+	return Success
+}
+
+// WithTimeout returns a context that is canceled once d has elapsed, or
+// when ctx is done. It is a thin wrapper over context.WithTimeout that
+// returns only the context, in the style of CancelOnSignal, so that both can
+// be composed, e.g. CancelOnSignal(WithTimeout(ctx, d), os.Interrupt). If d
+// is not positive, ctx is returned unchanged, so that a zero duration means
+// no timeout.
+//
+// As there is no cancel function, the timer of the context is released only
+// when the context is done, i.e. when the deadline expires or ctx is done.
+// To release it as soon as the work is done, pass a ctx that is canceled at
+// that point, e.g. one created with context.WithCancel where the cancel
+// function is deferred in the Main method.
+//
+// The context is only canceled, the command must still check ctx.Err() (or
+// pass the context to functions that do) to stop its work.
+func WithTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	// cancel is called once the context is done, to release it from its
+	// parent (the timer is already stopped at that point).
+	context.AfterFunc(ctx, cancel)
+	return ctx
+}
+
+// TimeoutFromFlag returns a context derived from context.Background that is
+// canceled once d has elapsed, as for WithTimeout. It is meant to be called
+// with the value of a duration flag, e.g. -timeout, where the zero value
+// (the flag is not set) means no timeout:
+//
+//	type cmd struct {
+//	  Timeout time.Duration `flag:"timeout"`
+//	}
+//
+//	func (c *cmd) Main(args []string, stdio mainer.Stdio) mainer.ExitCode {
+//	  // parse the flags, then:
+//	  ctx := mainer.CancelOnSignal(mainer.TimeoutFromFlag(c.Timeout), os.Interrupt)
+//	  ...
+//	}
+//
+// As its parent cannot be canceled, the timer of the context is released
+// only once d has elapsed, which is fine when it covers the whole execution
+// of the command; use WithTimeout with a cancelable parent otherwise. As for
+// WithTimeout, the command must still check ctx.Err().
+func TimeoutFromFlag(d time.Duration) context.Context {
+	return WithTimeout(context.Background(), d)
+}
+
 // CancelOnSignal returns a context that is canceled when the process receives
-// one of the specified signals.
+// one of the specified signals. The signals are no longer relayed once the
+// context is done, whether it is due to a signal or to the parent context.
+// See CancelOnSignalWithStop to release the resources before that.
 func CancelOnSignal(ctx context.Context, signals ...os.Signal) context.Context {
+	ctx, _ = CancelOnSignalWithStop(ctx, signals...)
+	return ctx
+}
+
+// CancelOnSignalWithStop is like CancelOnSignal, but it also returns a stop
+// function that stops relaying the signals, terminates the goroutine that
+// waits for them and cancels the context. It is safe to call it many times,
+// and it should be called once the context is no longer needed (e.g. in
+// tests or in long-running services that create many such contexts). If no
+// signal is provided, ctx is returned unchanged, with a no-op stop function.
+func CancelOnSignalWithStop(ctx context.Context, signals ...os.Signal) (context.Context, func()) {
+	if len(signals) == 0 {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, signals...)
+	go func() {
+		defer close(done)
+		defer signal.Stop(ch)
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		cancel()
+		<-done
+	}
+}
+
+// OnSignal returns a context that is canceled when the process receives one
+// of the specified signals, after calling fn with the received signal. The
+// context is canceled only once fn returns, so that it can run cleanup logic
+// (e.g. flushing logs) before the cancellation propagates. The signals are
+// no longer relayed once the context is done, whether it is due to a signal
+// or to the parent context (in which case fn is not called).
+func OnSignal(ctx context.Context, fn func(os.Signal), signals ...os.Signal) context.Context {
 	if len(signals) == 0 {
 		return ctx
 	}
@@ -106,8 +796,73 @@ func CancelOnSignal(ctx context.Context, signals ...os.Signal) context.Context {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, signals...)
 	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			fn(sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx
+}
+
+// osExit is the function called to exit the process, it can be replaced in
+// tests.
+var osExit = os.Exit
+
+// ForceExitOnSecondSignal returns a context that is canceled when the process
+// receives one of the specified signals, as for CancelOnSignal, but that
+// keeps listening for the signals afterwards: a second signal exits the
+// process immediately with the code. This is the common pattern for a
+// graceful shutdown that can be forced (e.g. by hitting Ctrl-C twice). The
+// signals are no longer relayed if the parent context is done before the
+// first signal is received.
+func ForceExitOnSecondSignal(ctx context.Context, code ExitCode, signals ...os.Signal) context.Context {
+	if len(signals) == 0 {
+		return ctx
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+			return
+		}
 		<-ch
-		cancel()
+		osExit(int(code))
+	}()
+
+	return ctx
+}
+
+// CancelOnSignalCause is like CancelOnSignal, but the context is canceled
+// with a cause that describes the received signal, which can be retrieved
+// with context.Cause. The signals are no longer relayed once the context is
+// done, whether it is due to a signal or to the parent context.
+func CancelOnSignalCause(ctx context.Context, signals ...os.Signal) context.Context {
+	if len(signals) == 0 {
+		return ctx
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			cancel(fmt.Errorf("received signal %s", sig))
+		case <-ctx.Done():
+		}
 	}()
 
 	return ctx
@@ -3,8 +3,13 @@
 package mainer
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -20,6 +25,420 @@ func TestCurrentStdio(t *testing.T) {
 	c.Assert(cwd, qt.Equals, CurrentStdio().Cwd)
 }
 
+func TestStdioIsTerminal(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	stdio := Stdio{Stdout: &buf, Stderr: &buf}
+	c.Assert(stdio.IsStdoutTerminal(), qt.IsFalse)
+	c.Assert(stdio.IsStderrTerminal(), qt.IsFalse)
+
+	// a pipe is an *os.File but not a terminal
+	r, w, err := os.Pipe()
+	c.Assert(err, qt.IsNil)
+	defer r.Close()
+	defer w.Close()
+	stdio = Stdio{Stdout: w, Stderr: w}
+	c.Assert(stdio.IsStdoutTerminal(), qt.IsFalse)
+	c.Assert(stdio.IsStderrTerminal(), qt.IsFalse)
+}
+
+func TestStdioColorize(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		noColor, forceColor string
+		want                string
+	}{
+		{"", "", "text"},
+		{"", "1", "\x1b[1;31mtext\x1b[0m"},
+		{"", "0", "text"},
+		{"1", "1", "text"},
+	}
+	for _, tc := range cases {
+		c.Run(fmt.Sprintf("%q %q", tc.noColor, tc.forceColor), func(c *qt.C) {
+			c.Setenv("NO_COLOR", tc.noColor)
+			c.Setenv("FORCE_COLOR", tc.forceColor)
+
+			stdio := Stdio{Stdout: &bytes.Buffer{}}
+			c.Assert(stdio.Colorize("1;31", "text"), qt.Equals, tc.want)
+		})
+	}
+}
+
+func TestStdioPrint(t *testing.T) {
+	c := qt.New(t)
+
+	var stdout, stderr bytes.Buffer
+	stdio := Stdio{Stdout: &stdout, Stderr: &stderr}
+	stdio.Printf("%s=%d;", "a", 1)
+	stdio.Println("b", 2)
+	stdio.Errorf("%s=%d;", "c", 3)
+	stdio.Errorln("d", 4)
+
+	c.Assert(stdout.String(), qt.Equals, "a=1;b 2\n")
+	c.Assert(stderr.String(), qt.Equals, "c=3;d 4\n")
+}
+
+func TestStdioCapture(t *testing.T) {
+	c := qt.New(t)
+
+	var out, ebuf bytes.Buffer
+	stdin := strings.NewReader("in")
+	stdio := Stdio{Cwd: "/tmp", Stdin: stdin, Stdout: &out, Stderr: &ebuf}
+
+	captured, result := stdio.Capture()
+	c.Assert(captured.Cwd, qt.Equals, "/tmp")
+	c.Assert(captured.Stdin, qt.Equals, io.Reader(stdin))
+
+	gotOut, gotErr := result()
+	c.Assert(gotOut, qt.Equals, "")
+	c.Assert(gotErr, qt.Equals, "")
+
+	captured.Println("hello")
+	captured.Errorf("oops %d\n", 1)
+	gotOut, gotErr = result()
+	c.Assert(gotOut, qt.Equals, "hello\n")
+	c.Assert(gotErr, qt.Equals, "oops 1\n")
+
+	captured.Printf("world")
+	gotOut, _ = result()
+	c.Assert(gotOut, qt.Equals, "hello\nworld")
+
+	// the original streams are untouched
+	c.Assert(stdio.Stdout, qt.Equals, io.Writer(&out))
+	c.Assert(out.String(), qt.Equals, "")
+	c.Assert(ebuf.String(), qt.Equals, "")
+}
+
+func TestStdioTable(t *testing.T) {
+	c := qt.New(t)
+
+	headers := []string{"NAME", "AGE", "CITY"}
+	rows := [][]string{
+		{"alice", "30", "Montréal"},
+		{"bob", "4"},
+		{"charlotte", "", "Paris", "extra"},
+	}
+
+	cases := []struct {
+		desc    string
+		style   TableStyle
+		headers []string
+		rows    [][]string
+		want    string
+	}{
+		{"plain", TablePlain, headers, rows, `NAME       AGE  CITY
+alice      30   Montréal
+bob        4
+charlotte       Paris     extra
+`},
+		{"bordered", TableBordered, headers, rows, `+-----------+-----+----------+-------+
+| NAME      | AGE | CITY     |       |
++-----------+-----+----------+-------+
+| alice     | 30  | Montréal |       |
+| bob       | 4   |          |       |
+| charlotte |     | Paris    | extra |
++-----------+-----+----------+-------+
+`},
+		{"plain no headers", TablePlain, nil, rows[:2], `alice  30  Montréal
+bob    4
+`},
+		{"bordered no headers", TableBordered, nil, rows[:1], `+-------+----+----------+
+| alice | 30 | Montréal |
++-------+----+----------+
+`},
+		{"bordered headers only", TableBordered, headers[:2], nil, `+------+-----+
+| NAME | AGE |
++------+-----+
+`},
+		{"empty", TableBordered, nil, nil, ""},
+	}
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			var stdout bytes.Buffer
+			stdio := Stdio{Stdout: &stdout}
+			stdio.TableWithStyle(tc.style, tc.headers, tc.rows)
+			c.Assert(stdout.String(), qt.Equals, tc.want)
+
+			if tc.style == TablePlain {
+				stdout.Reset()
+				stdio.Table(tc.headers, tc.rows)
+				c.Assert(stdout.String(), qt.Equals, tc.want)
+			}
+		})
+	}
+}
+
+func TestStdioSpinnerNotTerminal(t *testing.T) {
+	c := qt.New(t)
+
+	var stdout bytes.Buffer
+	stdio := Stdio{Stdout: &stdout}
+	stop := stdio.Spinner("working...")
+	time.Sleep(2 * spinnerInterval)
+	c.Assert(stdout.String(), qt.Equals, "working...\n")
+
+	stop()
+	stop()
+	c.Assert(stdout.String(), qt.Equals, "working...\n")
+}
+
+func TestStdioLogger(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		level string
+		want  []string
+	}{
+		{"", []string{"INFO", "WARN"}},
+		{"debug", []string{"DEBUG", "INFO", "WARN"}},
+		{"WARN", []string{"WARN"}},
+		{"invalid", []string{"INFO", "WARN"}},
+	}
+	for _, tc := range cases {
+		c.Run(tc.level, func(c *qt.C) {
+			c.Setenv(LogLevelEnvVar, tc.level)
+
+			var stdout, stderr bytes.Buffer
+			stdio := Stdio{Stdout: &stdout, Stderr: &stderr}
+
+			logger := stdio.Logger()
+			logger.Debug("d", "k", 1)
+			logger.Info("i", "k", 2)
+			logger.Warn("w", "k", 3)
+
+			var levels []string
+			for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+				_, rest, _ := strings.Cut(line, "level=")
+				lvl, _, _ := strings.Cut(rest, " ")
+				levels = append(levels, lvl)
+			}
+			c.Assert(levels, qt.DeepEquals, tc.want)
+			c.Assert(stdout.Len(), qt.Equals, 0)
+
+			stderr.Reset()
+			stdio.JSONLogger().Warn("w", "k", 3)
+			var got map[string]interface{}
+			c.Assert(json.Unmarshal(stderr.Bytes(), &got), qt.IsNil)
+			c.Assert(got["level"], qt.Equals, "WARN")
+			c.Assert(got["msg"], qt.Equals, "w")
+			c.Assert(got["k"], qt.Equals, float64(3))
+		})
+	}
+}
+
+func TestStdioPrompt(t *testing.T) {
+	c := qt.New(t)
+
+	var out bytes.Buffer
+	stdio := Stdio{
+		Stdin:  strings.NewReader("alice\nbob\r\n\ncarol"),
+		Stdout: &out,
+	}
+
+	cases := []struct {
+		msg  string
+		want string
+		err  error
+	}{
+		{"name: ", "alice", nil},
+		{"other: ", "bob", nil},
+		{"empty: ", "", nil},
+		{"last: ", "carol", io.EOF},
+		{"eof: ", "", io.EOF},
+	}
+	for _, tc := range cases {
+		out.Reset()
+		got, err := stdio.Prompt(tc.msg)
+		c.Assert(err, qt.Equals, tc.err)
+		c.Assert(got, qt.Equals, tc.want)
+		c.Assert(out.String(), qt.Equals, tc.msg)
+	}
+}
+
+func TestStdioReadPassword(t *testing.T) {
+	c := qt.New(t)
+
+	var out bytes.Buffer
+	stdio := Stdio{
+		Stdin:  strings.NewReader("s3cr3t\r\nlast"),
+		Stdout: &out,
+	}
+	got, err := stdio.ReadPassword("password: ")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(got), qt.Equals, "s3cr3t")
+	c.Assert(out.String(), qt.Equals, "password: ")
+
+	got, err = stdio.ReadPassword("again: ")
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(string(got), qt.Equals, "last")
+
+	// a pipe is an *os.File but not a terminal
+	r, w, err := os.Pipe()
+	c.Assert(err, qt.IsNil)
+	defer r.Close()
+	_, err = io.WriteString(w, "piped\n")
+	c.Assert(err, qt.IsNil)
+	c.Assert(w.Close(), qt.IsNil)
+
+	out.Reset()
+	stdio.Stdin = r
+	got, err = stdio.ReadPassword("password: ")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(got), qt.Equals, "piped")
+	c.Assert(out.String(), qt.Equals, "password: ")
+}
+
+func TestStdioConfirm(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		in     string
+		def    bool
+		want   bool
+		prompt string
+		err    string
+	}{
+		{"\n", false, false, "ok? [y/N] ", ""},
+		{"\n", true, true, "ok? [Y/n] ", ""},
+		{"y\n", false, true, "ok? [y/N] ", ""},
+		{"YES\n", false, true, "ok? [y/N] ", ""},
+		{" No \n", true, false, "ok? [Y/n] ", ""},
+		{"maybe\nyes\n", false, true, "ok? [y/N] ok? [y/N] ", ""},
+		{"a\nb\n\n", true, true, "ok? [Y/n] ok? [Y/n] ok? [Y/n] ", ""},
+		{"a\nb\nc\nyes\n", true, false, "ok? [Y/n] ok? [Y/n] ok? [Y/n] ", `invalid response: "c"`},
+		{"y", false, true, "ok? [y/N] ", ""},
+		{"x", false, false, "ok? [y/N] ", `invalid response: "x"`},
+		{"", true, false, "ok? [Y/n] ", `EOF`},
+	}
+	for _, tc := range cases {
+		c.Run(tc.in, func(c *qt.C) {
+			var out bytes.Buffer
+			stdio := Stdio{Stdin: strings.NewReader(tc.in), Stdout: &out}
+			got, err := stdio.Confirm("ok?", tc.def)
+			if tc.err != "" {
+				c.Assert(err, qt.ErrorMatches, tc.err)
+			} else {
+				c.Assert(err, qt.IsNil)
+			}
+			c.Assert(got, qt.Equals, tc.want)
+			c.Assert(out.String(), qt.Equals, tc.prompt)
+		})
+	}
+}
+
+type mainerFunc func([]string, Stdio) ExitCode
+
+func (f mainerFunc) Main(args []string, stdio Stdio) ExitCode {
+	return f(args, stdio)
+}
+
+func TestRunAll(t *testing.T) {
+	c := qt.New(t)
+
+	var calls []int
+	step := func(i int, code ExitCode) Mainer {
+		return mainerFunc(func(args []string, stdio Stdio) ExitCode {
+			c.Assert(args, qt.DeepEquals, []string{"prog", "-v"})
+			c.Assert(stdio.Cwd, qt.Equals, "/tmp")
+			calls = append(calls, i)
+			return code
+		})
+	}
+
+	args := []string{"prog", "-v"}
+	stdio := Stdio{Cwd: "/tmp"}
+
+	code := RunAll(stdio, args, step(1, Success), step(2, Success), step(3, Success))
+	c.Assert(code, qt.Equals, Success)
+	c.Assert(calls, qt.DeepEquals, []int{1, 2, 3})
+
+	calls = nil
+	code = RunAll(stdio, args, step(1, Success), step(2, InvalidArgs), step(3, Success))
+	c.Assert(code, qt.Equals, InvalidArgs)
+	c.Assert(calls, qt.DeepEquals, []int{1, 2})
+
+	c.Assert(RunAll(stdio, args), qt.Equals, Success)
+}
+
+func TestCommands(t *testing.T) {
+	c := qt.New(t)
+
+	var gotArgs []string
+	cmds := Commands{
+		"server": mainerFunc(func(args []string, stdio Stdio) ExitCode {
+			gotArgs = args
+			return Success
+		}),
+		"client": mainerFunc(func(args []string, stdio Stdio) ExitCode {
+			gotArgs = args
+			return Failure
+		}),
+	}
+	wantList := "Usage: prog <command> [arguments]\n\nCommands:\n  client\n  server\n"
+
+	cases := []struct {
+		args     []string
+		code     ExitCode
+		wantArgs []string
+		out      string
+		err      string
+	}{
+		{[]string{"/bin/prog", "server", "-port", "80"}, Success, []string{"prog server", "-port", "80"}, "", ""},
+		{[]string{"prog", "client"}, Failure, []string{"prog client"}, "", ""},
+		{[]string{"prog", "help"}, Success, nil, wantList, ""},
+		{[]string{"prog", "-h"}, Success, nil, wantList, ""},
+		{[]string{"prog"}, InvalidArgs, nil, "", "missing command\n\n" + wantList},
+		{[]string{"prog", "nope", "server"}, InvalidArgs, nil, "", "unknown command: nope\n\n" + wantList},
+	}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			gotArgs = nil
+			var out, ebuf bytes.Buffer
+			code := cmds.Main(tc.args, Stdio{Stdout: &out, Stderr: &ebuf})
+			c.Assert(code, qt.Equals, tc.code)
+			c.Assert(gotArgs, qt.DeepEquals, tc.wantArgs)
+			c.Assert(out.String(), qt.Equals, tc.out)
+			c.Assert(ebuf.String(), qt.Equals, tc.err)
+		})
+	}
+
+	// a registered "help" command takes precedence
+	cmds["help"] = cmds["server"]
+	var out bytes.Buffer
+	c.Assert(cmds.Main([]string{"prog", "help", "x"}, Stdio{Stdout: &out}), qt.Equals, Success)
+	c.Assert(gotArgs, qt.DeepEquals, []string{"prog help", "x"})
+	c.Assert(out.String(), qt.Equals, "")
+}
+
+func TestRecover(t *testing.T) {
+	c := qt.New(t)
+
+	args := []string{"prog", "x"}
+	var gotArgs []string
+	ok := mainerFunc(func(args []string, stdio Stdio) ExitCode {
+		gotArgs = args
+		return InvalidArgs
+	})
+	panics := mainerFunc(func(args []string, stdio Stdio) ExitCode {
+		panic("boom")
+	})
+
+	var stderr bytes.Buffer
+	stdio := Stdio{Stderr: &stderr}
+	c.Assert(Recover(ok).Main(args, stdio), qt.Equals, InvalidArgs)
+	c.Assert(gotArgs, qt.DeepEquals, args)
+	c.Assert(stderr.String(), qt.Equals, "")
+
+	c.Assert(recoverMainer{m: panics}.Main(args, stdio), qt.Equals, Failure)
+	c.Assert(stderr.String(), qt.Equals, "panic: boom\n")
+
+	stderr.Reset()
+	c.Assert(Recover(panics).Main(args, stdio), qt.Equals, Failure)
+	c.Assert(stderr.String(), qt.Matches, `(?s)panic: boom\n\ngoroutine \d+ \[running\]:\n.+mainer_test\.go.+`)
+}
+
 func TestCancelOnSignal(t *testing.T) {
 	c := qt.New(t)
 
@@ -44,6 +463,36 @@ func TestCancelOnSignal(t *testing.T) {
 	}
 }
 
+func TestWithTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	c.Assert(WithTimeout(ctx, 0), qt.Equals, ctx)
+	c.Assert(TimeoutFromFlag(-time.Second), qt.Equals, ctx)
+
+	ctx = TimeoutFromFlag(10 * time.Millisecond)
+	_, ok := ctx.Deadline()
+	c.Assert(ok, qt.IsTrue)
+	select {
+	case <-ctx.Done():
+		c.Assert(ctx.Err(), qt.Equals, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		c.Fatal("context should be done")
+	}
+
+	// the parent's cancellation propagates, and releases the context before
+	// the deadline
+	parent, cancel := context.WithCancel(context.Background())
+	ctx = WithTimeout(parent, time.Hour)
+	cancel()
+	select {
+	case <-ctx.Done():
+		c.Assert(ctx.Err(), qt.Equals, context.Canceled)
+	case <-time.After(time.Second):
+		c.Fatal("context should be done")
+	}
+}
+
 func TestCancelOnSignal_NoSignal(t *testing.T) {
 	c := qt.New(t)
 
@@ -51,3 +500,148 @@ func TestCancelOnSignal_NoSignal(t *testing.T) {
 	ctx2 := CancelOnSignal(ctx)
 	c.Assert(ctx, qt.Equals, ctx2)
 }
+
+func TestCancelOnSignalWithStop(t *testing.T) {
+	c := qt.New(t)
+
+	ctx, stop := CancelOnSignalWithStop(context.Background(), syscall.SIGUSR1)
+	select {
+	case <-ctx.Done():
+		c.Fatal("context should block")
+	default:
+	}
+
+	stop()
+	c.Assert(ctx.Err(), qt.Equals, context.Canceled)
+	stop()
+
+	ctx = context.Background()
+	ctx2, stop := CancelOnSignalWithStop(ctx)
+	c.Assert(ctx, qt.Equals, ctx2)
+	stop()
+}
+
+func TestOnSignal(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		got     os.Signal
+		doneErr error
+	)
+	var ctx context.Context
+	ready := make(chan struct{})
+	ctx = OnSignal(context.Background(), func(sig os.Signal) {
+		<-ready
+		got = sig
+		doneErr = ctx.Err()
+	}, syscall.SIGUSR1)
+	close(ready)
+
+	proc, err := os.FindProcess(os.Getpid())
+	c.Assert(err, qt.IsNil)
+	c.Assert(proc.Signal(syscall.SIGUSR1), qt.IsNil)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("context should be done")
+	}
+	c.Assert(got, qt.Equals, syscall.SIGUSR1)
+	// the context was not canceled yet when the callback ran
+	c.Assert(doneErr, qt.IsNil)
+
+	parent, cancel := context.WithCancel(context.Background())
+	ctx = OnSignal(parent, func(os.Signal) { c.Error("unexpected call") }, syscall.SIGUSR1)
+	cancel()
+	<-ctx.Done()
+}
+
+func TestForceExitOnSecondSignal(t *testing.T) {
+	c := qt.New(t)
+
+	exited := make(chan int, 1)
+	c.Patch(&osExit, func(code int) { exited <- code })
+
+	ctx := ForceExitOnSecondSignal(context.Background(), InvalidArgs, syscall.SIGUSR1)
+	proc, err := os.FindProcess(os.Getpid())
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(proc.Signal(syscall.SIGUSR1), qt.IsNil)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("context should be done")
+	}
+	select {
+	case <-exited:
+		c.Fatal("should not exit on first signal")
+	default:
+	}
+
+	c.Assert(proc.Signal(syscall.SIGUSR1), qt.IsNil)
+	select {
+	case code := <-exited:
+		c.Assert(code, qt.Equals, int(InvalidArgs))
+	case <-time.After(time.Second):
+		c.Fatal("should exit on second signal")
+	}
+}
+
+func TestCancelOnSignalCause(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := CancelOnSignalCause(context.Background(), syscall.SIGUSR2)
+
+	select {
+	case <-ctx.Done():
+		c.Fatal("context should block")
+	default:
+	}
+
+	proc, err := os.FindProcess(os.Getpid())
+	c.Assert(err, qt.IsNil)
+	err = proc.Signal(syscall.SIGUSR2)
+	c.Assert(err, qt.IsNil)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("context should be done")
+	}
+	c.Assert(ctx.Err(), qt.Equals, context.Canceled)
+	c.Assert(context.Cause(ctx), qt.ErrorMatches, `received signal user defined signal 2`)
+}
+
+func TestCancelOnSignalCause_Parent(t *testing.T) {
+	c := qt.New(t)
+
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := CancelOnSignalCause(parent, syscall.SIGUSR2)
+	cancel()
+
+	<-ctx.Done()
+	c.Assert(context.Cause(ctx), qt.Equals, context.Canceled)
+}
+
+func TestParseFileDescriptorValueOS(t *testing.T) {
+	c := qt.New(t)
+
+	r, w, err := os.Pipe()
+	c.Assert(err, qt.IsNil)
+	defer r.Close()
+	_, err = io.WriteString(w, "from pipe\n")
+	c.Assert(err, qt.IsNil)
+	c.Assert(w.Close(), qt.IsNil)
+
+	// the parser closes the descriptor once read, so pass it a duplicate
+	fd, err := syscall.Dup(int(r.Fd()))
+	c.Assert(err, qt.IsNil)
+
+	var f struct {
+		S string `flag:"s"`
+	}
+	p := Parser{AllowFDValues: true}
+	err = p.Parse([]string{"", "-s", fmt.Sprintf("fd:%d", fd)}, &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.S, qt.Equals, "from pipe")
+}
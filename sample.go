@@ -0,0 +1,136 @@
+package mainer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SampleConfig writes a sample config file for the flags defined by v to w,
+// in the specified format, which must be "json" or "toml". The v argument
+// must be a pointer to a struct with the same requirements as for Parse.
+//
+// Each flag field is written under its canonical flag name, with the current
+// value of the field as value and the field's "usage" struct tag as comment.
+// The value of a field with a "secret" (or "sensitive") struct tag set to
+// true is left blank (an empty string), so that the sample never contains
+// sensitive values, e.g.:
+//
+//	type S struct {
+//	  Token string `flag:"token" secret:"true"`
+//	}
+//
+// Note that the JSON format has no support for comments, the generated
+// sample uses "//" line comments that must be removed (or supported by
+// Parser.ConfigDecoder) before it can be used as Parser.ConfigFile.
+func (p *Parser) SampleConfig(v interface{}, format string, w io.Writer) error {
+	var (
+		comment   string
+		writeLine func(buf *bytes.Buffer, key string, val []byte, last bool)
+	)
+	switch format {
+	case "json":
+		comment = "//"
+		writeLine = func(buf *bytes.Buffer, key string, val []byte, last bool) {
+			fmt.Fprintf(buf, "  %s: %s", strconv.Quote(key), val)
+			if !last {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+	case "toml":
+		comment = "#"
+		writeLine = func(buf *bytes.Buffer, key string, val []byte, _ bool) {
+			if !tomlBareKey.MatchString(key) {
+				key = strconv.Quote(key)
+			}
+			fmt.Fprintf(buf, "%s = %s\n", key, val)
+		}
+	default:
+		return fmt.Errorf("unsupported sample config format: %s", format)
+	}
+
+	var buf bytes.Buffer
+	if format == "json" {
+		buf.WriteString("{\n")
+	}
+
+	fields := p.flagFields(v)
+	for i, ff := range fields {
+		var (
+			val interface{} = ""
+			err error
+		)
+		if !isSensitive(ff.field) {
+			if val, err = sampleValue(ff.value); err != nil {
+				return fmt.Errorf("invalid value for flag %s: %w", ff.names[0], err)
+			}
+		}
+
+		// JSON scalars and arrays are also valid TOML values.
+		b, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Errorf("invalid value for flag %s: %w", ff.names[0], err)
+		}
+
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		if _, usage := flagPlaceholder(ff); usage != "" {
+			indent := ""
+			if format == "json" {
+				indent = "  "
+			}
+			for _, line := range strings.Split(usage, "\n") {
+				fmt.Fprintf(&buf, "%s%s %s\n", indent, comment, line)
+			}
+		}
+		writeLine(&buf, ff.names[0], b, i == len(fields)-1)
+	}
+
+	if format == "json" {
+		buf.WriteString("}\n")
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// sampleValue returns the value of a flag field in a form that can be encoded
+// in a config file and decoded back by setConfigValue.
+func sampleValue(val reflect.Value) (interface{}, error) {
+	if val.Kind() == reflect.Pointer && val.IsNil() {
+		return "", nil
+	}
+	if val.Type() == durationType {
+		return val.Interface().(time.Duration).String(), nil
+	}
+	if t, ok := textMarshalerUnmarshaler(val); ok {
+		b, err := t.MarshalText()
+		return string(b), err
+	}
+
+	switch val.Kind() {
+	case reflect.Slice:
+		list := make([]interface{}, 0, val.Len())
+		for i := 0; i < val.Len(); i++ {
+			elem, err := sampleValue(val.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+		return list, nil
+	case reflect.Pointer:
+		return sampleValue(val.Elem())
+	default:
+		return val.Interface(), nil
+	}
+}
@@ -0,0 +1,164 @@
+package mainer
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestSampleConfigE(t *testing.T) {
+	c := qt.New(t)
+
+	var p Parser
+	e := E{Addr: ":80"}
+
+	var buf bytes.Buffer
+	err := p.SampleConfig(&e, "json", &buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `{
+  "addr": ":80",
+
+  "db": "",
+
+  "h": false,
+
+  "v": false
+}
+`)
+
+	buf.Reset()
+	err = p.SampleConfig(&e, "toml", &buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `addr = ":80"
+
+db = ""
+
+h = false
+
+v = false
+`)
+}
+
+type Sample struct {
+	Addr    string        "flag:\"addr,a\" usage:\"listen on `address`\""
+	Token   string        `flag:"token" usage:"API token" secret:"true"`
+	Timeout time.Duration `flag:"timeout" usage:"request timeout,\nin seconds"`
+	Port    int           `flag:"port"`
+	Ratio   float64       `flag:"ratio"`
+	Verbose int           `flag:"v,count"`
+	Tags    []string      `flag:"tag"`
+	IDs     []int         `flag:"ids" flagSeparator:","`
+	Rev     reverseVal    `flag:"rev"`
+	Dotted  string        `flag:"a.b"`
+	NoFlag  string
+}
+
+func TestSampleConfig(t *testing.T) {
+	c := qt.New(t)
+
+	s := Sample{
+		Addr:    ":80",
+		Token:   "s3cr3t",
+		Timeout: 10 * time.Second,
+		Ratio:   0.5,
+		Verbose: 2,
+		Tags:    []string{"a", "b"},
+		IDs:     []int{1, 2},
+		Rev:     "abc",
+		NoFlag:  "x",
+	}
+	var p Parser
+
+	var buf bytes.Buffer
+	err := p.SampleConfig(&s, "json", &buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `{
+  // listen on address
+  "addr": ":80",
+
+  // API token
+  "token": "",
+
+  // request timeout,
+  // in seconds
+  "timeout": "10s",
+
+  "port": 0,
+
+  "ratio": 0.5,
+
+  "v": 2,
+
+  "tag": ["a","b"],
+
+  "ids": [1,2],
+
+  "rev": "abc",
+
+  "a.b": ""
+}
+`)
+
+	buf.Reset()
+	err = p.SampleConfig(&s, "toml", &buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `# listen on address
+addr = ":80"
+
+# API token
+token = ""
+
+# request timeout,
+# in seconds
+timeout = "10s"
+
+port = 0
+
+ratio = 0.5
+
+v = 2
+
+tag = ["a","b"]
+
+ids = [1,2]
+
+rev = "abc"
+
+"a.b" = ""
+`)
+
+	err = p.SampleConfig(&s, "yaml", &buf)
+	c.Assert(err, qt.ErrorMatches, `unsupported sample config format: yaml`)
+}
+
+func TestSampleConfigRoundTrip(t *testing.T) {
+	c := qt.New(t)
+
+	cfg := Cfg{
+		Addr:    ":80",
+		Timeout: time.Minute,
+		Port:    8080,
+		Debug:   true,
+		Tags:    []string{"a", "b"},
+		IDs:     []int{1, 2, 3},
+		Verbose: 3,
+	}
+	var p Parser
+
+	var buf bytes.Buffer
+	err := p.SampleConfig(&cfg, "json", &buf)
+	c.Assert(err, qt.IsNil)
+
+	// strip the comments so that it can be read by the default decoder
+	content := regexp.MustCompile(`(?m)^\s*//.*$`).ReplaceAllString(buf.String(), "")
+	p.ConfigFile = writeConfigFile(c, content)
+
+	var got Cfg
+	err = p.Parse([]string{"prog"}, &got)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.CmpEquals(cmpopts.IgnoreUnexported(Cfg{})), cfg)
+}
@@ -0,0 +1,258 @@
+package mainer
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// WriteUsage writes the usage text of the flags defined by v to w. The
+// progName is used in the header line, v must be a pointer to a struct with
+// the same requirements as for Parse.
+//
+// The description of a flag is taken from its field's "usage" struct tag. As
+// for the stdlib's flag package, a name enclosed in back quotes in that
+// description is used as the flag's value placeholder (otherwise it is
+// derived from the field's type). The current value of the field is displayed
+// as default value if it is not the zero value. If the field's type
+// implements an IsZero() bool method, it decides if the value is the zero
+// value instead of the reflect package's check.
+//
+// The default value of a field with a "secret" or "sensitive" struct tag set
+// to true is displayed as **** so that the usage text never leaks it, e.g.:
+//
+//	type S struct {
+//	  Token string `flag:"token" sensitive:"true"`
+//	}
+//
+// If Parser.EnvVars is true, the fields that have an "env" struct tag but
+// no "flag" tag are listed after the flags, under the name of their
+// environment variable (including the prefix derived from progName if
+// Parser.EnvPrefix and Parser.ProgramName are not set), with "(env only)"
+// added to their description. Such fields are useful for secrets that
+// should not be visible in the process listing, as a flag's value would be.
+//
+// If v has a SetUsage(string) method, it is called with the generated usage
+// text before it is written to w, so that the command can store or augment
+// it. Note that Parse does not render the usage when a help flag is set (the
+// -h and -help flags are not special, they must be defined like any other
+// flag), so the hook is only called when the command itself calls WriteUsage,
+// typically after Parse when its help flag field is true. The hook is not
+// called when the usage is rendered by Parse for PrintUsageOnError.
+func (p *Parser) WriteUsage(w io.Writer, progName string, v interface{}) error {
+	usage := p.usage(progName, v)
+	if su, ok := v.(interface{ SetUsage(string) }); ok {
+		su.SetUsage(usage)
+	}
+	_, err := io.WriteString(w, usage)
+	return err
+}
+
+// usage returns the generated usage text of the flags defined by v.
+func (p *Parser) usage(progName string, v interface{}) string {
+	var sb strings.Builder
+
+	if progName == "" {
+		sb.WriteString("Usage:\n")
+	} else {
+		fmt.Fprintf(&sb, "Usage of %s:\n", progName)
+	}
+
+	for _, ff := range p.flagFields(v) {
+		placeholder, usage := flagPlaceholder(ff)
+
+		sb.WriteString(" ")
+		for i, nm := range ff.names {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(" -" + nm)
+		}
+		if placeholder != "" {
+			sb.WriteString(" " + placeholder)
+		}
+		sb.WriteString("\n")
+
+		if choices, _ := fieldChoices(ff); choices != nil {
+			if usage != "" {
+				usage += " "
+			}
+			usage += "(one of " + strings.Join(choices, ", ") + ")"
+		}
+		if fieldPercent(ff) {
+			if usage != "" {
+				usage += " "
+			}
+			usage += "(ratio or percentage, e.g. 0.25 or 25%)"
+		}
+		if lo, hi := fieldRange(ff); lo != "" || hi != "" {
+			if usage != "" {
+				usage += " "
+			}
+			usage += "(" + rangeDescription(lo, hi) + ")"
+		}
+		if def := flagDefault(ff); def != "" {
+			if usage != "" {
+				usage += " "
+			}
+			usage += "(default " + def + ")"
+		}
+		if usage != "" {
+			sb.WriteString("    \t")
+			sb.WriteString(strings.ReplaceAll(usage, "\n", "\n    \t"))
+			sb.WriteString("\n")
+		}
+	}
+
+	if p.EnvVars {
+		var args []string
+		if progName != "" {
+			args = []string{progName}
+		}
+		prefix := p.envPrefix(args)
+		for _, ff := range envOnlyFields(reflect.ValueOf(v).Elem(), "") {
+			placeholder, usage := flagPlaceholder(ff)
+
+			sb.WriteString("  " + envVarName(prefix+ff.envPrefix, ff.field))
+			if placeholder != "" {
+				sb.WriteString(" " + placeholder)
+			}
+			sb.WriteString("\n")
+
+			if usage != "" {
+				usage += " "
+			}
+			usage += "(env only)"
+			if def := flagDefault(ff); def != "" {
+				usage += " (default " + def + ")"
+			}
+			sb.WriteString("    \t")
+			sb.WriteString(strings.ReplaceAll(usage, "\n", "\n    \t"))
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// flagPlaceholder returns the placeholder name of the flag's value and its
+// usage description, which is stripped of the back quotes around the
+// placeholder name if it specifies one.
+func flagPlaceholder(ff flagField) (name, usage string) {
+	usage = ff.field.Tag.Get("usage")
+	if start := strings.Index(usage, "`"); start >= 0 {
+		if end := strings.Index(usage[start+1:], "`"); end >= 0 {
+			end += start + 1
+			name = usage[start+1 : end]
+			usage = usage[:start] + name + usage[end+1:]
+			return name, usage
+		}
+	}
+	if ff.count {
+		return "", usage
+	}
+	return typePlaceholder(ff.value.Type()), usage
+}
+
+func typePlaceholder(typ reflect.Type) string {
+	if typ == durationType {
+		return "duration"
+	}
+	if reflect.PointerTo(typ).Implements(textUnmarshalerType) {
+		return "value"
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool:
+		return ""
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice:
+		return typePlaceholder(typ.Elem())
+	case reflect.Pointer:
+		return typePlaceholder(typ.Elem())
+	default:
+		return "value"
+	}
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// redactedValue is the representation of the value of a sensitive field in
+// the usage text and the debug trace.
+const redactedValue = "****"
+
+// isSensitive returns true if the field holds a sensitive value that must
+// not be displayed, as set by its "secret" struct tag (or its "sensitive"
+// alias) set to true.
+func isSensitive(fld reflect.StructField) bool {
+	for _, tag := range []string{"secret", "sensitive"} {
+		if b, _ := strconv.ParseBool(fld.Tag.Get(tag)); b {
+			return true
+		}
+	}
+	return false
+}
+
+// flagDefault returns the string representation of the current value of the
+// flag's field, or an empty string if it is the zero value (as reported by
+// isZero). The value of a sensitive field is masked.
+func flagDefault(ff flagField) string {
+	val := ff.value
+	if isZero(val) {
+		return ""
+	}
+	if isSensitive(ff.field) {
+		return redactedValue
+	}
+
+	if t, ok := textMarshalerUnmarshaler(val); ok {
+		b, err := t.MarshalText()
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%q", b)
+	}
+	if val.Kind() == reflect.String {
+		return fmt.Sprintf("%q", val.String())
+	}
+	return fmt.Sprint(val.Interface())
+}
+
+// isZero returns true if val is the zero value. If the type implements an
+// IsZero() bool method (on the type or on a pointer to the type, as is the
+// case for time.Time), it is used instead of the reflect package's zero
+// check.
+func isZero(val reflect.Value) bool {
+	if z, ok := val.Interface().(interface{ IsZero() bool }); ok {
+		return z.IsZero()
+	}
+	if val.CanAddr() {
+		if z, ok := val.Addr().Interface().(interface{ IsZero() bool }); ok {
+			return z.IsZero()
+		}
+	}
+	return val.IsZero()
+}
+
+// programName returns Parser.ProgramName if it is set, otherwise the base
+// name of args[0], or an empty string if there is none.
+func (p *Parser) programName(args []string) string {
+	if p.ProgramName != "" {
+		return p.ProgramName
+	}
+	if len(args) == 0 || args[0] == "" {
+		return ""
+	}
+	return filepath.Base(args[0])
+}
@@ -0,0 +1,262 @@
+package mainer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type U struct {
+	Help    bool          `flag:"h,help" usage:"show this help"`
+	Addr    string        "flag:\"addr\" usage:\"listen on `address`\""
+	Timeout time.Duration `flag:"t,timeout" usage:"request timeout"`
+	Level   int8          `flag:"level"`
+	Verbose int           `flag:"v,count"`
+	Tags    []string      `flag:"tag" usage:"add a tag,\nmay be repeated"`
+	Rev     reverseVal    `flag:"rev"`
+	NoFlag  string
+}
+
+func (u *U) Validate() error {
+	if u.Addr == "" {
+		return errors.New("addr must be set")
+	}
+	return nil
+}
+
+func TestWriteUsage(t *testing.T) {
+	c := qt.New(t)
+
+	u := U{Timeout: time.Second, Rev: "abc"}
+	var (
+		buf bytes.Buffer
+		p   Parser
+	)
+	err := p.WriteUsage(&buf, "prog", &u)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `Usage of prog:
+  -h, -help
+    	show this help
+  -addr address
+    	listen on address
+  -t, -timeout duration
+    	request timeout (default 1s)
+  -level int
+  -v
+  -tag string
+    	add a tag,
+    	may be repeated
+  -rev value
+    	(default "abc")
+`)
+}
+
+type UEnv struct {
+	Addr   string `flag:"addr" env:"ADDR"`
+	Token  string `env:"TOKEN,required" usage:"API token"`
+	Debug  bool   `env:"DEBUG"`
+	Level  string `env:"LEVEL"`
+	NoFlag string
+	Nested struct {
+		Key string `env:"KEY" usage:"signing key"`
+	} `envPrefix:"SIGN_"`
+}
+
+func TestUsageEnvOnly(t *testing.T) {
+	c := qt.New(t)
+
+	u := UEnv{Level: "info"}
+	p := Parser{EnvVars: true}
+	c.Assert(p.usage("prog", &u), qt.Equals, `Usage of prog:
+  -addr string
+  PROG_TOKEN string
+    	API token (env only)
+  PROG_DEBUG
+    	(env only)
+  PROG_LEVEL string
+    	(env only) (default "info")
+  PROG_SIGN_KEY string
+    	signing key (env only)
+`)
+
+	// env-only fields are not listed if environment variables are disabled
+	p.EnvVars = false
+	c.Assert(p.usage("prog", &u), qt.Equals, `Usage of prog:
+  -addr string
+`)
+
+	// a missing required env-only field is an error
+	p.EnvVars = true
+	c.Setenv("PROG_ADDR", "x")
+	err := p.Parse([]string{"prog"}, &UEnv{})
+	c.Assert(err, qt.ErrorMatches, `.*required environment variable "PROG_TOKEN" is not set`)
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), qt.IsTrue)
+	c.Assert(pe.Kind, qt.Equals, ErrRequired)
+
+	c.Setenv("PROG_TOKEN", "secret")
+	var got UEnv
+	err = p.Parse([]string{"prog"}, &got)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got.Token, qt.Equals, "secret")
+}
+
+func TestPrintUsageOnError(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		desc      string
+		args      []string
+		print     bool
+		nilWriter bool
+		want      string
+	}{
+		{"no error", []string{"-addr", "x"}, true, false, ""},
+		{"disabled", []string{"-z"}, false, false, ""},
+		{"nil writer", []string{"-z"}, true, true, ""},
+		{"validation error", []string{"-h"}, true, false, ""},
+		{"unknown flag", []string{"-addr", "x", "-z"}, true, false, "Usage of prog:\n"},
+		{"invalid value", []string{"-level", "1000"}, true, false, "Usage of prog:\n"},
+	}
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			var buf bytes.Buffer
+			p := Parser{PrintUsageOnError: tc.print, Usage: &buf}
+			if tc.nilWriter {
+				p.Usage = nil
+			}
+
+			var u U
+			_ = p.Parse(append([]string{"/bin/prog"}, tc.args...), &u)
+			if tc.want == "" {
+				c.Assert(buf.String(), qt.Equals, "")
+				return
+			}
+			c.Assert(buf.String(), qt.Matches, tc.want+`(?s).+-addr address.+`)
+		})
+	}
+}
+
+// hostPort is the zero value if its host is empty, regardless of its port.
+type hostPort struct {
+	host string
+	port int
+}
+
+func (h hostPort) IsZero() bool { return h.host == "" }
+
+func (h hostPort) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%s:%d", h.host, h.port)), nil
+}
+
+func (h *hostPort) UnmarshalText(b []byte) error {
+	host, port, _ := strings.Cut(string(b), ":")
+	n, err := strconv.Atoi(port)
+	*h = hostPort{host: host, port: n}
+	return err
+}
+
+func TestWriteUsageIsZero(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Addr  hostPort  `flag:"addr"`
+		Since time.Time `flag:"since"`
+	}
+
+	cases := []struct {
+		desc string
+		f    F
+		want string
+	}{
+		{"zero", F{}, "Usage:\n  -addr value\n  -since value\n"},
+		{"port only", F{Addr: hostPort{port: 80}}, "Usage:\n  -addr value\n  -since value\n"},
+		{"zero time with location", F{Since: time.Time{}.In(time.FixedZone("X", 3600))}, "Usage:\n  -addr value\n  -since value\n"},
+		{"host", F{Addr: hostPort{host: "localhost", port: 80}}, "Usage:\n  -addr value\n    \t(default \"localhost:80\")\n  -since value\n"},
+	}
+
+	var p Parser
+	for _, tc := range cases {
+		c.Run(tc.desc, func(c *qt.C) {
+			var buf bytes.Buffer
+			err := p.WriteUsage(&buf, "", &tc.f)
+			c.Assert(err, qt.IsNil)
+			c.Assert(buf.String(), qt.Equals, tc.want)
+		})
+	}
+}
+
+func TestWriteUsageSensitive(t *testing.T) {
+	c := qt.New(t)
+
+	type F struct {
+		Token  string   `flag:"token" usage:"API token" sensitive:"true"`
+		Keys   []string `flag:"key" secret:"true"`
+		Empty  string   `flag:"empty" sensitive:"true"`
+		Public string   `flag:"public" sensitive:"false"`
+		Pass   string   `env:"PASS" sensitive:"true"`
+	}
+
+	f := F{Token: "s3cr3t", Keys: []string{"a", "b"}, Public: "p", Pass: "hunter2"}
+	var buf bytes.Buffer
+	p := Parser{EnvVars: true, EnvPrefix: "PROG"}
+	err := p.WriteUsage(&buf, "prog", &f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `Usage of prog:
+  -token string
+    	API token (default ****)
+  -key string
+    	(default ****)
+  -empty string
+  -public string
+    	(default "p")
+  PROG_PASS string
+    	(env only) (default ****)
+`)
+	c.Assert(buf.String(), qt.Not(qt.Contains), "s3cr3t")
+	c.Assert(f.Token, qt.Equals, "s3cr3t")
+}
+
+type usageHook struct {
+	Help bool `flag:"h,help" usage:"show this help"`
+
+	usage string
+}
+
+func (u *usageHook) SetUsage(s string) {
+	u.usage = s + "\nSee the manual for details.\n"
+}
+
+func TestSetUsage(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		u   usageHook
+		buf bytes.Buffer
+	)
+	p := Parser{PrintUsageOnError: true, Usage: &buf}
+
+	// not called during Parse, even when the usage is printed
+	err := p.Parse([]string{"prog", "-z"}, &u)
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(u.usage, qt.Equals, "")
+	c.Assert(buf.String(), qt.Not(qt.Equals), "")
+
+	err = p.Parse([]string{"prog", "-h"}, &u)
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Help, qt.IsTrue)
+	c.Assert(u.usage, qt.Equals, "")
+
+	buf.Reset()
+	err = p.WriteUsage(&buf, "prog", &u)
+	c.Assert(err, qt.IsNil)
+	want := "Usage of prog:\n  -h, -help\n    \tshow this help (default true)\n"
+	c.Assert(buf.String(), qt.Equals, want)
+	c.Assert(u.usage, qt.Equals, want+"\nSee the manual for details.\n")
+}
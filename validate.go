@@ -0,0 +1,152 @@
+package mainer
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidateTags validates the fields of the struct pointed to by v based on
+// their "validate" struct tag, in a minimal subset of the
+// github.com/go-playground/validator style. It can be used as
+// Parser.Validator. The tag is a comma-separated list of rules, e.g.:
+//
+//	type S struct {
+//	  Workers int    `flag:"workers" validate:"required,min=1,max=10"`
+//	  Format  string `flag:"format" validate:"oneof=json yaml"`
+//	}
+//
+// The supported rules are:
+//   - required: the field must not be the zero value (as for the usage's
+//     default value, an IsZero method is used if the type has one)
+//   - min=N and max=N: for numbers (including time.Duration, where N is a
+//     duration string), the value must be at least or at most N; for
+//     strings, slices and maps, this applies to the length
+//   - oneof=A B C: the string representation of the value must be one of
+//     the space-separated values
+//
+// The rules of a field are checked in order up to the first one that fails,
+// and the errors of all fields are joined. It panics
+// if v is not a pointer to a struct or if a rule is invalid.
+func ValidateTags(v interface{}) error {
+	val := reflect.ValueOf(v).Elem()
+	strct := val.Type()
+
+	var errs []error
+	for i := 0; i < strct.NumField(); i++ {
+		fld := strct.Field(i)
+		tag, ok := fld.Tag.Lookup("validate")
+		if !ok || !fld.IsExported() {
+			continue
+		}
+		for _, rule := range strings.Split(tag, ",") {
+			if err := validateRule(fld.Name, val.Field(i), rule); err != nil {
+				errs = append(errs, err)
+				break
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+func validateRule(name string, val reflect.Value, rule string) error {
+	rule, arg, _ := strings.Cut(rule, "=")
+	switch rule {
+	case "":
+		return nil
+	case "required":
+		if isZero(val) {
+			return fmt.Errorf("%s is required", name)
+		}
+	case "min", "max":
+		cmp, desc := compareRuleValue(name, val, rule, arg)
+		if (rule == "min" && cmp < 0) || (rule == "max" && cmp > 0) {
+			bound := "least"
+			if rule == "max" {
+				bound = "most"
+			}
+			return fmt.Errorf("%s %s must be at %s %s", name, desc, bound, arg)
+		}
+	case "oneof":
+		s := validateString(val)
+		for _, opt := range strings.Fields(arg) {
+			if s == opt {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s", name, strings.Join(strings.Fields(arg), ", "))
+	default:
+		panic(fmt.Sprintf("unsupported validation rule on field %s: %s", name, rule))
+	}
+	return nil
+}
+
+// compareRuleValue compares the value (or length) of val with arg and
+// returns -1, 0 or 1 if it is respectively lower, equal or greater than arg,
+// along with a description of what is compared ("value" or "length").
+func compareRuleValue(name string, val reflect.Value, rule, arg string) (int, string) {
+	invalid := func(err error) {
+		panic(fmt.Sprintf("invalid %s validation rule on field %s: %s", rule, name, err))
+	}
+
+	if val.Type() == durationType {
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			invalid(err)
+		}
+		return compareResult(time.Duration(val.Int()) < d, time.Duration(val.Int()) > d), "value"
+	}
+
+	switch val.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			invalid(err)
+		}
+		return compareResult(val.Len() < n, val.Len() > n), "length"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			invalid(err)
+		}
+		return compareResult(val.Int() < n, val.Int() > n), "value"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(arg, 0, 64)
+		if err != nil {
+			invalid(err)
+		}
+		return compareResult(val.Uint() < n, val.Uint() > n), "value"
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			invalid(err)
+		}
+		return compareResult(val.Float() < n, val.Float() > n), "value"
+	default:
+		panic(fmt.Sprintf("unsupported %s validation rule on field %s of kind %s", rule, name, val.Kind()))
+	}
+}
+
+func compareResult(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// validateString returns the string representation of val used by the oneof
+// rule.
+func validateString(val reflect.Value) string {
+	if t, ok := textMarshalerUnmarshaler(val); ok {
+		if b, err := t.MarshalText(); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(val.Interface())
+}
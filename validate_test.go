@@ -0,0 +1,102 @@
+package mainer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type validated struct {
+	Workers int           `flag:"workers" validate:"required,min=1,max=10"`
+	Format  string        `flag:"format" validate:"oneof=json yaml"`
+	Name    string        `flag:"name" validate:"min=2,max=5"`
+	Tags    []string      `flag:"tag" validate:"max=2"`
+	Timeout time.Duration `flag:"timeout" validate:"min=1s"`
+	Ratio   float64       `flag:"ratio" validate:"max=1"`
+
+	validated bool
+}
+
+func (v *validated) Validate() error {
+	v.validated = true
+	if v.Workers == 5 {
+		return errors.New("workers cannot be 5")
+	}
+	return nil
+}
+
+func TestParseValidateTags(t *testing.T) {
+	c := qt.New(t)
+
+	cases := []struct {
+		args []string // args only, the 0-index is automatically added in test
+		err  string
+	}{
+		{args: []string{"-workers", "1", "-format", "json", "-name", "ab", "-timeout", "1s"}},
+		{args: []string{"-workers", "10", "-format", "yaml", "-name", "abcde", "-tag", "a", "-tag", "b", "-timeout", "1m", "-ratio", "0.5"}},
+		{args: []string{"-format", "json", "-name", "ab", "-timeout", "1s"}, err: `Workers is required`},
+		{args: []string{"-workers", "11", "-format", "json", "-name", "ab", "-timeout", "1s"}, err: `Workers value must be at most 10`},
+		{args: []string{"-workers", "-1", "-format", "json", "-name", "ab", "-timeout", "1s"}, err: `Workers value must be at least 1`},
+		{
+			args: []string{"-workers", "1", "-format", "xml", "-name", "a", "-tag", "a", "-tag", "b", "-tag", "c", "-timeout", "1ms", "-ratio", "1.5"},
+			err: `Format must be one of json, yaml
+Name length must be at least 2
+Tags length must be at most 2
+Timeout value must be at least 1s
+Ratio value must be at most 1`,
+		},
+	}
+
+	p := Parser{Validator: ValidateTags}
+	for _, tc := range cases {
+		c.Run(strings.Join(tc.args, " "), func(c *qt.C) {
+			var v validated
+			args := append([]string{""}, tc.args...)
+			err := p.Parse(args, &v)
+			if tc.err == "" {
+				c.Assert(err, qt.IsNil)
+				c.Assert(v.validated, qt.IsTrue)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tc.err)
+			var pe *ParseError
+			c.Assert(errors.As(err, &pe), qt.IsTrue)
+			c.Assert(pe.Kind, qt.Equals, ErrValidation)
+
+			// the Validate method is not called if the Validator fails
+			c.Assert(v.validated, qt.IsFalse)
+		})
+	}
+
+	// the Validator runs before Validate
+	var v validated
+	err := p.Parse([]string{"", "-workers", "5", "-format", "json", "-name", "ab", "-timeout", "1s"}, &v)
+	c.Assert(err, qt.ErrorMatches, `workers cannot be 5`)
+
+	// with CollectAllErrors, both are called and the errors joined
+	p.CollectAllErrors = true
+	v = validated{}
+	err = p.Parse([]string{"", "-workers", "5", "-format", "x", "-name", "ab", "-timeout", "1s"}, &v)
+	c.Assert(err, qt.ErrorMatches, "Format must be one of json, yaml\nworkers cannot be 5")
+}
+
+func TestValidateTagsInvalid(t *testing.T) {
+	c := qt.New(t)
+
+	type Unknown struct {
+		A string `validate:"email"`
+	}
+	type BadArg struct {
+		A int `validate:"min=x"`
+	}
+	type BadKind struct {
+		A bool `validate:"max=1"`
+	}
+
+	c.Assert(func() { _ = ValidateTags(&Unknown{}) }, qt.PanicMatches, `unsupported validation rule on field A: email`)
+	c.Assert(func() { _ = ValidateTags(&BadArg{}) }, qt.PanicMatches, `invalid min validation rule on field A: .+`)
+	c.Assert(func() { _ = ValidateTags(&BadKind{}) }, qt.PanicMatches, `unsupported max validation rule on field A of kind bool`)
+}